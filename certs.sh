@@ -0,0 +1,37 @@
+#!/bin/bash
+# Generates a local CA, a certificate for the broker and a client certificate
+# for use with ./rabbit.sh start-tls. The client certificate's common name is
+# the RabbitMQ user it logs in as with EXTERNAL auth.
+
+set -e
+
+dir=${CERTS_DIR:-certs}
+client=${1:-peril}
+days=365
+
+mkdir -p "$dir"
+cd "$dir"
+
+echo "Generating CA..."
+openssl req -x509 -newkey rsa:2048 -nodes -days "$days" \
+  -keyout ca-key.pem -out ca.pem -subj "/CN=Peril local CA"
+
+echo "Generating broker certificate for localhost..."
+openssl req -newkey rsa:2048 -nodes \
+  -keyout server-key.pem -out server.csr -subj "/CN=localhost"
+openssl x509 -req -in server.csr -CA ca.pem -CAkey ca-key.pem -CAcreateserial \
+  -days "$days" -out server.pem \
+  -extfile <(printf "subjectAltName=DNS:localhost,IP:127.0.0.1\nextendedKeyUsage=serverAuth")
+
+echo "Generating client certificate for $client..."
+openssl req -newkey rsa:2048 -nodes \
+  -keyout client-key.pem -out client.csr -subj "/CN=$client"
+openssl x509 -req -in client.csr -CA ca.pem -CAkey ca-key.pem -CAcreateserial \
+  -days "$days" -out client.pem \
+  -extfile <(printf "extendedKeyUsage=clientAuth")
+
+rm -f server.csr client.csr ca.srl
+# The broker runs as the rabbitmq user inside the container.
+chmod 644 server-key.pem
+
+echo "Certificates written to $dir/"
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gabrieldiem/learn-pub-sub-starter/internal/config"
+	"github.com/gabrieldiem/learn-pub-sub-starter/internal/gamelogic"
+	_ "github.com/gabrieldiem/learn-pub-sub-starter/internal/perilpb"
+	"github.com/gabrieldiem/learn-pub-sub-starter/internal/pubsub"
+	"github.com/gabrieldiem/learn-pub-sub-starter/internal/routing"
+)
+
+const idleTimeout = time.Second
+
+func usage(fs *flag.FlagSet) {
+	fmt.Fprintln(os.Stderr, "Usage:")
+	fmt.Fprintln(os.Stderr, "  peril-dlq [flags] list")
+	fmt.Fprintln(os.Stderr, "  peril-dlq [flags] replay <index> <index>...")
+	fmt.Fprintln(os.Stderr, "  peril-dlq [flags] replay all")
+	fmt.Fprintln(os.Stderr, "Flags:")
+	fs.PrintDefaults()
+}
+
+// collect takes up to max messages from the dead-letter queue without
+// settling them. Closing the returned consumer puts back the ones that were
+// not acked.
+func collect(broker pubsub.Broker, max int) (pubsub.Consumer, []pubsub.RawDelivery, error) {
+	consumer, err := broker.Consume(routing.QueuePerilDLQ, pubsub.ConsumeOptions{Prefetch: max})
+	if err != nil {
+		return nil, nil, err
+	}
+	msgs := []pubsub.RawDelivery{}
+	for len(msgs) < max {
+		select {
+		case msg, ok := <-consumer.Deliveries():
+			if !ok {
+				return consumer, msgs, nil
+			}
+			msgs = append(msgs, msg)
+		case <-time.After(idleTimeout):
+			return consumer, msgs, nil
+		}
+	}
+	return consumer, msgs, nil
+}
+
+func decodeBody(key, contentType string, body []byte) (any, error) {
+	var target any
+	switch {
+	case strings.HasPrefix(key, routing.ArmyMovesPrefix+"."):
+		target = &gamelogic.ArmyMove{}
+	case strings.HasPrefix(key, routing.WarRecognitionsPrefix+"."):
+		target = &gamelogic.RecognitionOfWar{}
+	case key == routing.PauseKey:
+		target = &routing.PlayingState{}
+	case strings.HasPrefix(key, routing.GameLogSlug+"."):
+		target = &routing.GameLog{}
+	case key == routing.GetPlayingStateKey:
+		target = &routing.GetPlayingState{}
+	case key == routing.SpawnKey:
+		target = &gamelogic.SpawnIntent{}
+	case key == routing.MoveKey:
+		target = &gamelogic.MoveIntent{}
+	case key == routing.GetStateKey:
+		target = &routing.GetState{}
+	case key == routing.JoinKey:
+		target = &routing.Join{}
+	case strings.HasPrefix(key, routing.StateDeltasPrefix+"."):
+		target = &gamelogic.StateDelta{}
+	case strings.HasPrefix(key, routing.WarResultsPrefix+"."):
+		target = &gamelogic.WarResult{}
+	default:
+		return nil, fmt.Errorf("unknown routing key %s", key)
+	}
+
+	codec, err := pubsub.CodecFor(contentType)
+	if err != nil {
+		return nil, err
+	}
+	err = codec.Unmarshal(body, target)
+	if err != nil {
+		return nil, err
+	}
+	return target, nil
+}
+
+func printMessage(index int, msg pubsub.RawDelivery) {
+	exchange, key, _ := pubsub.OriginalDestination(msg.Headers)
+	fmt.Printf("[%d] %s -> %q (%s)\n", index, exchange, key, msg.ContentType)
+	if msg.MessageID != "" {
+		fmt.Printf("    message %s from %q, correlation %s, sent at %s\n",
+			msg.MessageID, msg.AppID, msg.CorrelationID, msg.Timestamp.Format(time.RFC3339))
+	}
+	for _, death := range pubsub.Deaths(msg.Headers) {
+		fmt.Printf("    died %d time(s) in %s: %s, last at %s\n",
+			death.Count, death.Queue, death.Reason, death.Time.Format(time.RFC3339))
+	}
+	val, err := decodeBody(key, msg.ContentType, msg.Body)
+	if err != nil {
+		fmt.Printf("    could not decode body: %v\n", err)
+		fmt.Printf("    raw: %q\n", msg.Body)
+		return
+	}
+	fmt.Printf("    %+v\n", val)
+}
+
+func list(broker pubsub.Broker, max int) error {
+	consumer, msgs, err := collect(broker, max)
+	if err != nil {
+		return err
+	}
+	defer consumer.Close()
+
+	if len(msgs) == 0 {
+		fmt.Println("The dead-letter queue is empty.")
+		return nil
+	}
+	for i, msg := range msgs {
+		printMessage(i, msg)
+	}
+	return nil
+}
+
+func replay(broker pubsub.Broker, max int, args []string) error {
+	all := len(args) == 1 && args[0] == "all"
+	selected := map[int]struct{}{}
+	if !all {
+		if len(args) == 0 {
+			return fmt.Errorf("replay needs at least one index or \"all\"")
+		}
+		for _, arg := range args {
+			i, err := strconv.Atoi(arg)
+			if err != nil {
+				return fmt.Errorf("%s is not a valid index", arg)
+			}
+			selected[i] = struct{}{}
+		}
+	}
+
+	consumer, msgs, err := collect(broker, max)
+	if err != nil {
+		return err
+	}
+	defer consumer.Close()
+
+	for i, msg := range msgs {
+		if _, ok := selected[i]; !ok && !all {
+			continue
+		}
+		exchange, key, ok := pubsub.OriginalDestination(msg.Headers)
+		if !ok {
+			fmt.Printf("[%d] has no x-death header, skipping\n", i)
+			continue
+		}
+
+		// Give the replayed message a fresh set of retries.
+		replayed := msg.Message
+		delete(replayed.Headers, pubsub.HeaderRetryAttempt)
+		delete(replayed.Headers, pubsub.HeaderOriginalExchange)
+		delete(replayed.Headers, pubsub.HeaderOriginalRoutingKey)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		err := broker.PublishConfirmed(ctx, exchange, key, replayed)
+		cancel()
+		if err != nil {
+			fmt.Printf("[%d] could not republish to %s %q: %v\n", i, exchange, key, err)
+			continue
+		}
+		if err := msg.Ack(); err != nil {
+			return fmt.Errorf("could not ack message %d: %v", i, err)
+		}
+		fmt.Printf("[%d] republished to %s %q\n", i, exchange, key)
+	}
+	return nil
+}
+
+func main() {
+	fs := flag.NewFlagSet("peril-dlq", flag.ContinueOnError)
+	max := fs.Int("max", 100, "maximum number of messages to inspect")
+	fs.Usage = func() { usage(fs) }
+	cfg, err := config.LoadFlags(fs, os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if cfg.PrintConfig {
+		err = cfg.Print(os.Stdout)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if fs.NArg() == 0 {
+		usage(fs)
+		os.Exit(2)
+	}
+
+	broker, err := cfg.Broker.Dial(nil, nil)
+	if err != nil {
+		log.Fatalf("could not connect to RabbitMQ: %v", err)
+	}
+	defer broker.Close()
+
+	err = pubsub.DeclareDeadLetterQueue(broker, routing.ExchangePerilDLX, routing.QueuePerilDLQ)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	switch fs.Arg(0) {
+	case "list":
+		err = list(broker, *max)
+	case "replay":
+		err = replay(broker, *max, fs.Args()[1:])
+	default:
+		usage(fs)
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
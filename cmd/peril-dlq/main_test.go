@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gabrieldiem/learn-pub-sub-starter/internal/gamelogic"
+	"github.com/gabrieldiem/learn-pub-sub-starter/internal/pubsub"
+	"github.com/gabrieldiem/learn-pub-sub-starter/internal/routing"
+)
+
+// deadLetter sends every key through a queue that rejects them, leaving them
+// in the dead-letter queue in order, and returns a consumer of the queue.
+func deadLetter(t *testing.T, keys ...string) (*pubsub.MemoryBroker, pubsub.Consumer) {
+	t.Helper()
+	b := pubsub.NewMemoryBroker()
+	t.Cleanup(func() { b.Close() })
+	err := pubsub.DeclareDeadLetterQueue(b, routing.ExchangePerilDLX, routing.QueuePerilDLQ)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b.DeclareExchange(routing.ExchangePerilTopic, pubsub.ExchangeTopic, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	queue, err := pubsub.DeclareAndBind(b, routing.ExchangePerilTopic, "war", routing.WarRecognitionsPrefix+".*", pubsub.SimpleQueueDurable)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := b.Consume(queue, pubsub.ConsumeOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+
+	for _, key := range keys {
+		war := gamelogic.RecognitionOfWar{Attacker: gamelogic.Player{Username: key}}
+		body, err := json.Marshal(war)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = b.Publish(context.Background(), routing.ExchangePerilTopic, key, pubsub.Message{
+			ContentType: pubsub.ContentTypeJSON,
+			Headers:     map[string]any{pubsub.HeaderRetryAttempt: 3},
+			Body:        body,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		d := next(t, c)
+		err = d.Nack(false)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return b, c
+}
+
+func next(t *testing.T, c pubsub.Consumer) pubsub.RawDelivery {
+	t.Helper()
+	select {
+	case d := <-c.Deliveries():
+		return d
+	case <-time.After(2 * time.Second):
+		t.Fatal("no delivery")
+		return pubsub.RawDelivery{}
+	}
+}
+
+// remaining returns the routing keys left in the dead-letter queue.
+func remaining(t *testing.T, b pubsub.Broker, max int) []string {
+	t.Helper()
+	consumer, msgs, err := collect(b, max)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer consumer.Close()
+	keys := []string{}
+	for _, msg := range msgs {
+		_, key, _ := pubsub.OriginalDestination(msg.Headers)
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func TestReplay(t *testing.T) {
+	tests := []struct {
+		name         string
+		args         []string
+		wantReplayed []string
+		wantLeft     []string
+	}{
+		{"all", []string{"all"}, []string{"war.alice", "war.bob", "war.carol"}, []string{}},
+		{"some", []string{"2", "0"}, []string{"war.alice", "war.carol"}, []string{"war.bob"}},
+		{"out of range", []string{"7"}, []string{}, []string{"war.alice", "war.bob", "war.carol"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, c := deadLetter(t, "war.alice", "war.bob", "war.carol")
+
+			err := replay(b, 3, tt.args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			replayed := []string{}
+			for range tt.wantReplayed {
+				d := next(t, c)
+				replayed = append(replayed, d.RoutingKey)
+				if _, ok := d.Headers[pubsub.HeaderRetryAttempt]; ok {
+					t.Errorf("replayed %s still carries its retry attempt", d.RoutingKey)
+				}
+				d.Ack()
+			}
+			if !reflect.DeepEqual(replayed, tt.wantReplayed) {
+				t.Errorf("replayed %v, want %v", replayed, tt.wantReplayed)
+			}
+			if left := remaining(t, b, 3); !reflect.DeepEqual(left, tt.wantLeft) {
+				t.Errorf("left %v in the dead-letter queue, want %v", left, tt.wantLeft)
+			}
+		})
+	}
+}
+
+func TestReplayKeepsMessagesWithoutDestination(t *testing.T) {
+	b, _ := deadLetter(t)
+	err := b.Publish(context.Background(), routing.ExchangePerilDLX, "", pubsub.Message{Body: []byte("{}")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = replay(b, 1, []string{"all"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if left := remaining(t, b, 1); len(left) != 1 {
+		t.Errorf("left %v in the dead-letter queue, want the message", left)
+	}
+}
+
+func TestReplayArgs(t *testing.T) {
+	b, _ := deadLetter(t)
+	for _, args := range [][]string{nil, {"first"}} {
+		if err := replay(b, 1, args); err == nil {
+			t.Errorf("replay %q succeeded", args)
+		}
+	}
+}
+
+func TestDecodeBody(t *testing.T) {
+	war := gamelogic.RecognitionOfWar{Attacker: gamelogic.Player{Username: "alice"}}
+	var body bytes.Buffer
+	err := gob.NewEncoder(&body).Encode(war)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := decodeBody("war.alice", "application/gob", body.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, &war) {
+		t.Errorf("decoded %+v, want %+v", got, war)
+	}
+
+	_, err = decodeBody("nobody.listens", "application/gob", body.Bytes())
+	if err == nil {
+		t.Error("decoded a message for an unknown routing key")
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"github.com/gabrieldiem/learn-pub-sub-starter/internal/config"
+	"github.com/gabrieldiem/learn-pub-sub-starter/internal/gateway"
+	_ "github.com/gabrieldiem/learn-pub-sub-starter/internal/perilpb"
+	"github.com/gabrieldiem/learn-pub-sub-starter/internal/pubsub"
+	"github.com/gabrieldiem/learn-pub-sub-starter/internal/topology"
+)
+
+const shutdownTimeout = 10 * time.Second
+
+func main() {
+	fs := flag.NewFlagSet("peril-gateway", flag.ContinueOnError)
+	listen := fs.String("listen", ":8080", "address to serve /ws and /events on")
+	origins := fs.String("origins", "", "comma separated origins browsers may connect from, * for any, the gateway's own when empty")
+	cfg, err := config.LoadFlags(fs, os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if cfg.PrintConfig {
+		err = cfg.Print(os.Stdout)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	broker, err := cfg.Broker.Dial(
+		func(err error) {
+			log.Printf("Lost connection to RabbitMQ (%v), reconnecting…", err)
+		},
+		func() {
+			log.Println("Reconnected to RabbitMQ")
+		},
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer broker.Close()
+
+	err = topology.Apply(broker, topology.Peril())
+	if err != nil {
+		log.Fatalf("could not provision RabbitMQ: %v", err)
+	}
+
+	pubsub.Use(pubsub.Recover())
+
+	hub, err := gateway.NewHub(broker)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var allowed []string
+	if *origins != "" {
+		allowed = strings.Split(*origins, ",")
+	}
+	srv := &http.Server{
+		Addr:              *listen,
+		Handler:           gateway.Handler(hub, allowed),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		err := srv.ListenAndServe()
+		if !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
+	log.Printf("Serving spectators on %s", *listen)
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt)
+	<-sigChan
+	log.Println("Shutting down...")
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	err = hub.Close(ctx)
+	if err != nil {
+		log.Printf("could not stop subscriptions cleanly: %v", err)
+	}
+	// Streams never finish on their own, so they are cut rather than
+	// waited for.
+	err = srv.Close()
+	if err != nil {
+		log.Printf("could not stop the server cleanly: %v", err)
+	}
+}
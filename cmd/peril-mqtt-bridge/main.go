@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/gabrieldiem/learn-pub-sub-starter/internal/config"
+	"github.com/gabrieldiem/learn-pub-sub-starter/internal/mqttbridge"
+	_ "github.com/gabrieldiem/learn-pub-sub-starter/internal/perilpb"
+	"github.com/gabrieldiem/learn-pub-sub-starter/internal/pubsub"
+	"github.com/gabrieldiem/learn-pub-sub-starter/internal/topology"
+)
+
+const shutdownTimeout = 10 * time.Second
+
+func main() {
+	fs := flag.NewFlagSet("peril-mqtt-bridge", flag.ContinueOnError)
+	mqttURL := fs.String("mqtt", "tcp://localhost:1883", "MQTT broker to relay to")
+	embedded := fs.String("embedded", "", "run an MQTT broker in process listening on this address, e.g. :1883, instead of using -mqtt")
+	prefix := fs.String("prefix", mqttbridge.TopicPrefix, "topic level routing keys are mapped under")
+	cfg, err := config.LoadFlags(fs, os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if cfg.PrintConfig {
+		err = cfg.Print(os.Stdout)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if *embedded != "" {
+		server, err := mqttbridge.ServeEmbedded(*embedded)
+		if err != nil {
+			log.Fatalf("could not start MQTT broker: %v", err)
+		}
+		defer server.Close()
+		host, port, err := net.SplitHostPort(*embedded)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if host == "" {
+			host = "localhost"
+		}
+		*mqttURL = "tcp://" + net.JoinHostPort(host, port)
+		log.Printf("MQTT broker listening on %s", *embedded)
+	}
+
+	broker, err := cfg.Broker.Dial(
+		func(err error) {
+			log.Printf("Lost connection to RabbitMQ (%v), reconnecting…", err)
+		},
+		func() {
+			log.Println("Reconnected to RabbitMQ")
+		},
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer broker.Close()
+
+	err = topology.Apply(broker, topology.Peril())
+	if err != nil {
+		log.Fatalf("could not provision RabbitMQ: %v", err)
+	}
+
+	pubsub.Use(
+		pubsub.LogAcks(slog.Default()),
+		pubsub.Recover(),
+	)
+
+	bridge, err := mqttbridge.Dial(broker, *mqttURL, mqttbridge.Routes(), mqttbridge.Options{
+		Prefix:   *prefix,
+		Prefetch: cfg.Prefetch,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("Relaying between RabbitMQ and %s under %s/\n", *mqttURL, *prefix)
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt)
+	<-sigChan
+	log.Println("Shutting down...")
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	err = bridge.Close(ctx)
+	if err != nil {
+		log.Printf("could not stop the bridge cleanly: %v", err)
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gabrieldiem/learn-pub-sub-starter/internal/gamelogic"
+	"github.com/gabrieldiem/learn-pub-sub-starter/internal/history"
+	"github.com/gabrieldiem/learn-pub-sub-starter/internal/routing"
+)
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "Usage:")
+	fmt.Fprintln(os.Stderr, "  peril-replay [flags] [history file]")
+	fmt.Fprintln(os.Stderr, "Replays the events the server recorded, printing the board they leave.")
+	fmt.Fprintln(os.Stderr, "Flags:")
+	flag.PrintDefaults()
+}
+
+// replayer keeps every player's game state as the events rebuild it.
+type replayer struct {
+	states map[string]*gamelogic.GameState
+	// player is whose eyes moves are seen through, the mover's when
+	// empty.
+	player   string
+	paused   bool
+	disputed int
+}
+
+func (r *replayer) state(username string) *gamelogic.GameState {
+	gs, ok := r.states[username]
+	if !ok {
+		gs = gamelogic.NewGameState(username)
+		r.states[username] = gs
+	}
+	return gs
+}
+
+func (r *replayer) viewer(username string) *gamelogic.GameState {
+	if r.player != "" {
+		return r.state(r.player)
+	}
+	return r.state(username)
+}
+
+// step shows the event through the client's handlers, then folds it into
+// every player's state.
+func (r *replayer) step(e gamelogic.Event) {
+	fmt.Printf("\n#%d %s %s\n", e.Seq, e.Time.Format(time.DateTime), e.Kind)
+	switch e.Kind {
+	case gamelogic.EventSpawn:
+		r.state(e.Username)
+		if e.Unit != nil {
+			fmt.Printf("%s spawned a(n) %s in %s with id %v\n", e.Username, e.Unit.Rank, e.Unit.Location, e.Unit.ID)
+		}
+	case gamelogic.EventMove:
+		if e.Move != nil {
+			r.state(e.Move.Player.Username)
+			r.viewer(e.Move.Player.Username).HandleMove(*e.Move)
+		}
+	case gamelogic.EventWar:
+		if e.War != nil {
+			r.war(*e.War)
+		}
+	case gamelogic.EventPause, gamelogic.EventResume:
+		r.paused = e.Kind == gamelogic.EventPause
+		viewer := gamelogic.NewGameState("")
+		if r.player != "" {
+			viewer = r.state(r.player)
+		}
+		viewer.HandlePause(routing.PlayingState{IsPaused: r.paused})
+	case gamelogic.EventBaseline:
+		for _, d := range e.States {
+			r.state(d.Username)
+		}
+		fmt.Printf("the server restored a world of %d player(s)\n", len(e.States))
+	default:
+		fmt.Printf("unknown event %q, skipping\n", e.Kind)
+	}
+	for _, gs := range r.states {
+		gs.ApplyEvent(e)
+	}
+}
+
+// war fights the war again with HandleWar and reports where it disagrees
+// with what the server recorded.
+func (r *replayer) war(wr gamelogic.WarResult) {
+	for _, side := range []struct {
+		username string
+		fought   []gamelogic.Unit
+	}{{wr.Attacker, wr.AttackerUnits}, {wr.Defender, wr.DefenderUnits}} {
+		had := unitIDsAt(r.state(side.username).GetPlayerSnap().Units, wr.Location)
+		fought := unitIDsAt(playerOf(side.username, side.fought).Units, wr.Location)
+		if had != fought {
+			fmt.Printf("!! %s had units [%s] in %s, the server fought with [%s]\n",
+				side.username, had, wr.Location, fought)
+			r.disputed++
+		}
+	}
+
+	// HandleWar only settles a war from the attacker's side. It is given a
+	// state of its own, as units are only taken away by folding the event.
+	outcome, winner, _ := gamelogic.NewGameState(wr.Attacker).HandleWar(gamelogic.RecognitionOfWar{
+		Attacker: playerOf(wr.Attacker, wr.AttackerUnits),
+		Defender: playerOf(wr.Defender, wr.DefenderUnits),
+	})
+	if outcome == gamelogic.WarOutcomeDraw || outcome == gamelogic.WarOutcomeNoUnits {
+		winner = ""
+	}
+	if winner != wr.Winner {
+		fmt.Printf("!! the server recorded %s, the rules give %s\n", describe(wr.Winner), describe(winner))
+		r.disputed++
+	}
+}
+
+func describe(winner string) string {
+	if winner == "" {
+		return "a draw"
+	}
+	return winner + " winning"
+}
+
+func playerOf(username string, units []gamelogic.Unit) gamelogic.Player {
+	p := gamelogic.Player{Username: username, Units: map[int]gamelogic.Unit{}}
+	for _, u := range units {
+		p.Units[u.ID] = u
+	}
+	return p
+}
+
+func unitIDsAt(units map[int]gamelogic.Unit, loc gamelogic.Location) string {
+	ids := []int{}
+	for _, u := range units {
+		if u.Location == loc {
+			ids = append(ids, u.ID)
+		}
+	}
+	sort.Ints(ids)
+	return strings.Trim(fmt.Sprint(ids), "[]")
+}
+
+// printBoard lists every location with units and whose they are.
+func (r *replayer) printBoard(after gamelogic.Event) {
+	names := make([]string, 0, len(r.states))
+	for name := range r.states {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	board := map[gamelogic.Location][]string{}
+	for _, name := range names {
+		units := r.states[name].GetPlayerSnap().Units
+		ids := make([]int, 0, len(units))
+		for id := range units {
+			ids = append(ids, id)
+		}
+		sort.Ints(ids)
+		for _, id := range ids {
+			u := units[id]
+			board[u.Location] = append(board[u.Location], fmt.Sprintf("%s #%v %s", name, u.ID, u.Rank))
+		}
+	}
+	locations := make([]string, 0, len(board))
+	for loc := range board {
+		locations = append(locations, string(loc))
+	}
+	sort.Strings(locations)
+
+	fmt.Println()
+	fmt.Printf("==== Board after #%d ====\n", after.Seq)
+	if r.paused {
+		fmt.Println("The game is paused.")
+	}
+	if len(locations) == 0 {
+		fmt.Println("No units.")
+	}
+	for _, loc := range locations {
+		fmt.Printf("%s:\n", loc)
+		for _, unit := range board[gamelogic.Location(loc)] {
+			fmt.Printf("  * %s\n", unit)
+		}
+	}
+	fmt.Println("------------------------")
+}
+
+// wait paces the replay by the time between the events, scaled by speed
+// and capped at most.
+func wait(prev, next gamelogic.Event, speed float64, most time.Duration) {
+	if speed <= 0 || prev.Time.IsZero() {
+		return
+	}
+	d := time.Duration(float64(next.Time.Sub(prev.Time)) / speed)
+	time.Sleep(min(max(d, 0), most))
+}
+
+func main() {
+	player := flag.String("player", "", "player whose eyes moves are seen through, the mover's when empty")
+	step := flag.Bool("step", false, "wait for enter after every event")
+	speed := flag.Float64("speed", 1, "how many times faster than recorded to replay, 0 for no waiting")
+	maxWait := flag.Duration("max-wait", 2*time.Second, "longest wait between two events")
+	until := flag.Int("until", 0, "last event to replay, 0 for all")
+	flag.Usage = usage
+	flag.Parse()
+
+	path := gamelogic.DefaultHistoryFile
+	switch flag.NArg() {
+	case 0:
+	case 1:
+		path = flag.Arg(0)
+	default:
+		usage()
+		os.Exit(2)
+	}
+
+	events, err := history.Read(path)
+	var corrupt *history.CorruptError
+	if errors.As(err, &corrupt) {
+		log.Printf("%v, replaying the rest", err)
+	} else if err != nil {
+		log.Fatal(err)
+	}
+	if len(events) == 0 {
+		fmt.Println("The history is empty.")
+		return
+	}
+
+	r := &replayer{
+		states: map[string]*gamelogic.GameState{},
+		player: *player,
+	}
+	if *player != "" {
+		r.state(*player)
+	}
+	input := bufio.NewScanner(os.Stdin)
+	var prev, last gamelogic.Event
+	for _, e := range events {
+		if *until > 0 && e.Seq > *until {
+			break
+		}
+		if !*step {
+			wait(prev, e, *speed, *maxWait)
+		}
+		r.step(e)
+		prev, last = e, e
+
+		if *step {
+			r.printBoard(e)
+			fmt.Print("enter for the next event, q to stop > ")
+			if !input.Scan() || strings.TrimSpace(input.Text()) == "q" {
+				break
+			}
+		}
+	}
+	if !*step {
+		r.printBoard(last)
+	}
+	if r.disputed > 0 {
+		fmt.Printf("%d disagreement(s) with the recorded wars, see the !! lines above.\n", r.disputed)
+		os.Exit(1)
+	}
+}
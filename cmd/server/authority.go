@@ -0,0 +1,356 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gabrieldiem/learn-pub-sub-starter/internal/config"
+	"github.com/gabrieldiem/learn-pub-sub-starter/internal/gamelogic"
+	"github.com/gabrieldiem/learn-pub-sub-starter/internal/history"
+	"github.com/gabrieldiem/learn-pub-sub-starter/internal/outbox"
+	"github.com/gabrieldiem/learn-pub-sub-starter/internal/pubsub"
+	"github.com/gabrieldiem/learn-pub-sub-starter/internal/routing"
+)
+
+// publishTimeout bounds how long the outbox tries to publish the changes of
+// an intent before rolling them back.
+const publishTimeout = 10 * time.Second
+
+// queueTimeout bounds how long the changes of an intent wait for the outbox
+// to start on them, behind changes it can not get out or while it is
+// stopped, before they are abandoned and rolled back.
+const queueTimeout = 2 * time.Second
+
+// authority applies the intents of clients to the world one at a time,
+// publishing what changed through the outbox before answering, so that the
+// world is rolled back if the changes cannot be published. mu is held until
+// the outbox settled the intent, so a rollback never undoes a later one.
+type authority struct {
+	mu      sync.Mutex
+	world   *gamelogic.World
+	ob      *outbox.Outbox
+	ps      *playingState
+	history *history.Log
+}
+
+// startOutbox opens the outbox and relays it to broker until the returned
+// function is called.
+func startOutbox(cfg config.Config, broker pubsub.Broker) (*outbox.Outbox, func()) {
+	ob, err := outbox.New(outbox.Options{
+		Journal:        cfg.Outbox.Journal,
+		ConfirmTimeout: publishTimeout / 2,
+		Timeout:        publishTimeout,
+		// Players that are offline pick their units up with GetState when
+		// they come back.
+		DropUnroutable: true,
+	})
+	if err != nil {
+		log.Fatalf("could not open outbox: %v", err)
+	}
+	if n := ob.Pending(); n > 0 {
+		log.Printf("Publishing %d changes left over from the last run", n)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ob.Relay(ctx, broker)
+	}()
+	return ob, func() {
+		cancel()
+		<-done
+		err := ob.Close()
+		if err != nil {
+			log.Printf("could not close outbox: %v", err)
+		}
+	}
+}
+
+// loadWorld restores the world saved by the previous run, or starts an
+// empty one, reporting whether it restored it.
+func loadWorld(path string) (*gamelogic.World, bool) {
+	world, err := gamelogic.LoadWorld(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return gamelogic.NewWorld(), false
+	}
+	if err != nil {
+		log.Fatalf("could not restore the world: %v", err)
+	}
+	log.Printf("Restored the world from %s", path)
+	return world, true
+}
+
+// save writes the world to path between intents, so that it does not hold
+// half of one.
+func (a *authority) save(path string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return gamelogic.SaveWorld(path, a.world)
+}
+
+// saveEvery saves the world every interval until the returned function is
+// called, which saves it a last time.
+func (a *authority) saveEvery(path string, interval time.Duration) func() {
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if interval == 0 {
+			<-stop
+			return
+		}
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				err := a.save(path)
+				if err != nil {
+					log.Printf("could not save the world: %v", err)
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(stop)
+		<-done
+		err := a.save(path)
+		if err != nil {
+			log.Printf("could not save the world: %v", err)
+		}
+	}
+}
+
+// serve answers intents until the returned subscriptions are closed.
+func (a *authority) serve(broker pubsub.Broker) ([]*pubsub.Subscription, error) {
+	subs := []*pubsub.Subscription{}
+	sub, err := pubsub.Serve(broker, routing.ExchangePerilDirect, routing.SpawnKey, routing.SpawnKey,
+		pubsub.SimpleQueueDurable, a.spawn)
+	if err != nil {
+		return nil, fmt.Errorf("could not serve spawns: %v", err)
+	}
+	subs = append(subs, sub)
+	sub, err = pubsub.Serve(broker, routing.ExchangePerilDirect, routing.MoveKey, routing.MoveKey,
+		pubsub.SimpleQueueDurable, a.move)
+	if err != nil {
+		return subs, fmt.Errorf("could not serve moves: %v", err)
+	}
+	subs = append(subs, sub)
+	sub, err = pubsub.Serve(broker, routing.ExchangePerilDirect, routing.GetStateKey, routing.GetStateKey,
+		pubsub.SimpleQueueDurable, a.state)
+	if err != nil {
+		return subs, fmt.Errorf("could not serve states: %v", err)
+	}
+	subs = append(subs, sub)
+	sub, err = pubsub.Serve(broker, routing.ExchangePerilDirect, routing.JoinKey, routing.JoinKey,
+		pubsub.SimpleQueueDurable, a.join)
+	if err != nil {
+		return subs, fmt.Errorf("could not serve joins: %v", err)
+	}
+	subs = append(subs, sub)
+	return subs, nil
+}
+
+// player is who sent the intent, proven by the token they were issued when
+// they joined, as anyone can stamp any sender.
+func (a *authority) player(env pubsub.Envelope) (string, error) {
+	if env.Sender == "" {
+		return "", errors.New("intent without a sender")
+	}
+	token, _ := env.Headers[routing.HeaderToken].(string)
+	err := a.world.Authenticate(env.Sender, token)
+	if err != nil {
+		return "", err
+	}
+	return env.Sender, nil
+}
+
+// join claims the sender's username, or lets them back in with the token
+// they were issued.
+func (a *authority) join(ctx context.Context, d pubsub.Delivery[routing.Join]) (routing.Session, error) {
+	token, _ := d.Headers[routing.HeaderToken].(string)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	token, err := a.world.Join(d.Sender, token)
+	if err != nil {
+		return routing.Session{}, err
+	}
+	return routing.Session{Token: token}, nil
+}
+
+func (a *authority) spawn(ctx context.Context, d pubsub.Delivery[gamelogic.SpawnIntent]) (gamelogic.StateDelta, error) {
+	username, err := a.player(d.Envelope)
+	if err != nil {
+		return gamelogic.StateDelta{}, err
+	}
+	if a.ps.get().IsPaused {
+		return gamelogic.StateDelta{}, errors.New("the game is paused, you can not spawn units")
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	before := a.world.Snapshot()
+	delta, err := a.world.Spawn(username, d.Value)
+	if err != nil {
+		return gamelogic.StateDelta{}, err
+	}
+	tx := a.begin(before)
+	err = addDelta(tx, delta, d.Envelope)
+	if err != nil {
+		tx.Rollback()
+		return gamelogic.StateDelta{}, err
+	}
+	return delta, a.commit(tx, gamelogic.Event{
+		Kind:     gamelogic.EventSpawn,
+		Username: username,
+		Unit:     &delta.Units[0],
+	})
+}
+
+func (a *authority) move(ctx context.Context, d pubsub.Delivery[gamelogic.MoveIntent]) (gamelogic.StateDelta, error) {
+	username, err := a.player(d.Envelope)
+	if err != nil {
+		return gamelogic.StateDelta{}, err
+	}
+	if a.ps.get().IsPaused {
+		return gamelogic.StateDelta{}, errors.New("the game is paused, you can not move units")
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	before := a.world.Snapshot()
+	res, err := a.world.Move(username, d.Value)
+	if err != nil {
+		return gamelogic.StateDelta{}, err
+	}
+	tx := a.begin(before)
+	err = addMove(tx, res, d.Envelope)
+	if err != nil {
+		tx.Rollback()
+		return gamelogic.StateDelta{}, err
+	}
+	events := []gamelogic.Event{{Kind: gamelogic.EventMove, Move: &res.Move}}
+	for i := range res.Wars {
+		events = append(events, gamelogic.Event{Kind: gamelogic.EventWar, War: &res.Wars[i]})
+	}
+	return res.Deltas[0], a.commit(tx, events...)
+}
+
+func (a *authority) state(ctx context.Context, d pubsub.Delivery[routing.GetState]) (gamelogic.StateDelta, error) {
+	username, err := a.player(d.Envelope)
+	if err != nil {
+		return gamelogic.StateDelta{}, err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.world.State(username), nil
+}
+
+// begin starts the transaction of an intent, restoring the world to before
+// it on rollback. The rollback runs while commit waits with a.mu held, so
+// nothing else touched the world since.
+func (a *authority) begin(before gamelogic.WorldSnapshot) *outbox.Tx {
+	tx := a.ob.Begin()
+	tx.OnRollback(func() { a.world.Restore(before) })
+	return tx
+}
+
+// commit publishes the transaction and waits for the outcome. The wait is
+// bounded, as a.mu is held meanwhile: by queueTimeout until the relay starts
+// on the transaction, then by the outbox's timeout. Its events are recorded
+// in the history by the relay, in the order the changes were made.
+func (a *authority) commit(tx *outbox.Tx, events ...gamelogic.Event) error {
+	tx.OnPublished(func() { record(a.history, events...) })
+	err := tx.Commit()
+	if err != nil {
+		return err
+	}
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), queueTimeout)
+		err = tx.Wait(ctx)
+		expired := ctx.Err() != nil
+		cancel()
+		if !expired {
+			break
+		}
+		// Fails once the relay is publishing it, and the next wait ends
+		// with the outcome.
+		tx.Abandon()
+	}
+	if errors.Is(err, outbox.ErrIncomplete) {
+		// The change stands, players missing part of it catch up with
+		// GetState.
+		return nil
+	}
+	return err
+}
+
+func addDelta(tx *outbox.Tx, delta gamelogic.StateDelta, cause pubsub.Envelope) error {
+	return outbox.Add(tx, routing.ExchangePerilTopic, routing.StateDeltasPrefix+"."+delta.Username, delta,
+		pubsub.WithSender(serverSender),
+		pubsub.CausedBy(cause),
+	)
+}
+
+// addMove adds the move for everyone to see, the deltas of the players it
+// changed and, for every war, the war, its result and its game log.
+func addMove(tx *outbox.Tx, res gamelogic.MoveResult, cause pubsub.Envelope) error {
+	opts := []pubsub.PublishOption{pubsub.WithSender(serverSender), pubsub.CausedBy(cause)}
+	username := res.Move.Player.Username
+	err := outbox.Add(tx, routing.ExchangePerilTopic, routing.ArmyMovesPrefix+"."+username, res.Move, opts...)
+	if err != nil {
+		return err
+	}
+	for _, delta := range res.Deltas {
+		err = addDelta(tx, delta, cause)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, war := range res.Wars {
+		err = outbox.Add(tx, routing.ExchangePerilTopic, routing.WarRecognitionsPrefix+"."+war.Attacker,
+			gamelogic.RecognitionOfWar{
+				Attacker: playerOf(war.Attacker, war.AttackerUnits),
+				Defender: playerOf(war.Defender, war.DefenderUnits),
+			}, opts...)
+		if err != nil {
+			return err
+		}
+		err = outbox.Add(tx, routing.ExchangePerilTopic, routing.WarResultsPrefix+"."+war.Attacker, war, opts...)
+		if err != nil {
+			return err
+		}
+
+		message := fmt.Sprintf("%s won a war against %s", war.Winner, war.Loser)
+		if war.Winner == "" {
+			message = fmt.Sprintf("A war between %s and %s resulted in a draw", war.Attacker, war.Defender)
+		}
+		err = outbox.Add(tx, routing.ExchangePerilTopic, routing.GameLogSlug+"."+war.Attacker,
+			routing.GameLog{
+				CurrentTime: time.Now(),
+				Message:     message,
+				Username:    war.Attacker,
+			}, append(opts, pubsub.WithContentType(pubsub.ContentTypeGob))...)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func playerOf(username string, units []gamelogic.Unit) gamelogic.Player {
+	p := gamelogic.Player{Username: username, Units: map[int]gamelogic.Unit{}}
+	for _, u := range units {
+		p.Units[u.ID] = u
+	}
+	return p
+}
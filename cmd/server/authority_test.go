@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gabrieldiem/learn-pub-sub-starter/internal/config"
+	"github.com/gabrieldiem/learn-pub-sub-starter/internal/gamelogic"
+	"github.com/gabrieldiem/learn-pub-sub-starter/internal/history"
+	"github.com/gabrieldiem/learn-pub-sub-starter/internal/outbox"
+	"github.com/gabrieldiem/learn-pub-sub-starter/internal/pubsub"
+	"github.com/gabrieldiem/learn-pub-sub-starter/internal/routing"
+	"github.com/gabrieldiem/learn-pub-sub-starter/internal/topology"
+)
+
+// game is a server running on a MemoryBroker.
+type game struct {
+	broker      *pubsub.MemoryBroker
+	auth        *authority
+	historyPath string
+	stop        func()
+}
+
+func startGame(t *testing.T) *game {
+	t.Helper()
+	dir := t.TempDir()
+	broker := pubsub.NewMemoryBroker()
+	err := topology.Apply(broker, topology.Peril())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := config.Default()
+	cfg.Outbox.Journal = filepath.Join(dir, "outbox.jsonl")
+	historyPath := filepath.Join(dir, "history.jsonl")
+	hist, err := history.Open(historyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ob, stopOutbox := startOutbox(cfg, broker)
+	auth := &authority{
+		world:   gamelogic.NewWorld(),
+		ob:      ob,
+		ps:      &playingState{},
+		history: hist,
+	}
+	subs, err := auth.serve(broker)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g := &game{broker: broker, auth: auth, historyPath: historyPath}
+	stopped := false
+	g.stop = func() {
+		if stopped {
+			return
+		}
+		stopped = true
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		for _, sub := range subs {
+			sub.Close(ctx)
+		}
+		stopOutbox()
+		hist.Close()
+		broker.Close()
+	}
+	t.Cleanup(g.stop)
+	return g
+}
+
+// player is a client of the game, stamping the token it joined with on its
+// intents.
+type player struct {
+	gs     *gamelogic.GameState
+	deltas chan gamelogic.StateDelta
+}
+
+func (g *game) join(t *testing.T, username string) *player {
+	t.Helper()
+	p := &player{
+		gs:     gamelogic.NewGameState(username),
+		deltas: make(chan gamelogic.StateDelta, 16),
+	}
+	_, err := pubsub.Subscribe(g.broker, routing.ExchangePerilTopic, "test_deltas."+username,
+		routing.StateDeltasPrefix+"."+username, pubsub.SimpleQueueTransient,
+		func(ctx context.Context, d pubsub.Delivery[gamelogic.StateDelta]) pubsub.Acktype {
+			p.deltas <- d.Value
+			return pubsub.Ack
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	session, err := request[routing.Join, routing.Session](g, p, routing.JoinKey, routing.Join{})
+	if err != nil {
+		t.Fatalf("%s could not join: %v", username, err)
+	}
+	p.gs.SetToken(session.Token)
+	return p
+}
+
+func request[Req, Resp any](g *game, p *player, key string, req Req) (Resp, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	opts := []pubsub.PublishOption{pubsub.WithSender(p.gs.GetUsername())}
+	if token := p.gs.Token(); token != "" {
+		opts = append(opts, pubsub.WithHeader(routing.HeaderToken, token))
+	}
+	return pubsub.Request[Req, Resp](ctx, g.broker, routing.ExchangePerilDirect, key, req, opts...)
+}
+
+// send makes an intent and applies the delta the server answers with.
+func send[T any](t *testing.T, g *game, p *player, key string, intent T) gamelogic.StateDelta {
+	t.Helper()
+	delta, err := request[T, gamelogic.StateDelta](g, p, key, intent)
+	if err != nil {
+		t.Fatalf("%s: %v", key, err)
+	}
+	p.gs.ApplyDelta(delta)
+	return delta
+}
+
+func (p *player) nextDelta(t *testing.T) gamelogic.StateDelta {
+	t.Helper()
+	select {
+	case d := <-p.deltas:
+		return d
+	case <-time.After(5 * time.Second):
+		t.Fatalf("%s got no delta", p.gs.GetUsername())
+		return gamelogic.StateDelta{}
+	}
+}
+
+func unitIDs(gs *gamelogic.GameState) []int {
+	ids := []int{}
+	for id := range gs.GetPlayerSnap().Units {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func TestGame(t *testing.T) {
+	g := startGame(t)
+	alice := g.join(t, "alice")
+	bob := g.join(t, "bob")
+
+	spawned := send(t, g, alice, routing.SpawnKey, gamelogic.SpawnIntent{Location: "europe", Rank: gamelogic.RankInfantry})
+	if got := alice.nextDelta(t); !reflect.DeepEqual(got, spawned) {
+		t.Errorf("alice was sent %+v, answered %+v", got, spawned)
+	}
+	send(t, g, bob, routing.SpawnKey, gamelogic.SpawnIntent{Location: "asia", Rank: gamelogic.RankCavalry})
+	bob.nextDelta(t)
+	cavalry := unitIDs(bob.gs)
+
+	// Bob's cavalry attacks alice's infantry in europe and wins.
+	moved := send(t, g, bob, routing.MoveKey, gamelogic.MoveIntent{UnitIDs: cavalry, ToLocation: "europe"})
+	if len(moved.Units) != 1 || moved.Units[0].Location != "europe" {
+		t.Errorf("bob's move answered %+v, want his cavalry in europe", moved)
+	}
+	bob.nextDelta(t)
+	lost := alice.nextDelta(t)
+	alice.gs.ApplyDelta(lost)
+	if !reflect.DeepEqual(lost.Removed, []int{spawned.Units[0].ID}) {
+		t.Errorf("alice lost %v, want her infantry", lost.Removed)
+	}
+	if ids := unitIDs(alice.gs); len(ids) != 0 {
+		t.Errorf("alice still has units %v", ids)
+	}
+
+	// GetState agrees with what the deltas built.
+	state, err := request[routing.GetState, gamelogic.StateDelta](g, bob, routing.GetStateKey, routing.GetState{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(state.Units, moved.Units) {
+		t.Errorf("bob's state is %+v, want %+v", state.Units, moved.Units)
+	}
+
+	g.stop()
+	events, err := history.Read(g.historyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kinds := []gamelogic.EventKind{}
+	for _, e := range events {
+		kinds = append(kinds, e.Kind)
+	}
+	wantKinds := []gamelogic.EventKind{gamelogic.EventSpawn, gamelogic.EventSpawn, gamelogic.EventMove, gamelogic.EventWar}
+	if !reflect.DeepEqual(kinds, wantKinds) {
+		t.Fatalf("history has %v, want %v", kinds, wantKinds)
+	}
+	if war := events[3].War; war.Winner != "bob" || war.Loser != "alice" {
+		t.Errorf("war won by %q over %q, want bob over alice", war.Winner, war.Loser)
+	}
+	if units := gamelogic.Rebuild("bob", events).GetPlayerSnap().Units; len(units) != 1 {
+		t.Errorf("rebuilt bob has units %v, want his cavalry", units)
+	}
+}
+
+func TestIntentsAreAuthenticated(t *testing.T) {
+	g := startGame(t)
+	alice := g.join(t, "alice")
+
+	tests := []struct {
+		name    string
+		player  *player
+		wantErr string
+	}{
+		{"not joined", &player{gs: gamelogic.NewGameState("mallory")}, "mallory has not joined the game"},
+		{"wrong token", func() *player {
+			p := &player{gs: gamelogic.NewGameState("alice")}
+			p.gs.SetToken("not-" + alice.gs.Token())
+			return p
+		}(), "wrong token for alice"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := request[gamelogic.SpawnIntent, gamelogic.StateDelta](g, tt.player, routing.SpawnKey,
+				gamelogic.SpawnIntent{Location: "europe", Rank: gamelogic.RankInfantry})
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("spawn = %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+
+	_, err := request[routing.Join, routing.Session](g, &player{gs: gamelogic.NewGameState("alice")}, routing.JoinKey, routing.Join{})
+	if err == nil {
+		t.Error("joined as alice without her token")
+	}
+}
+
+func TestPausedGameRefusesIntents(t *testing.T) {
+	g := startGame(t)
+	alice := g.join(t, "alice")
+	g.auth.ps.set(routing.PlayingState{IsPaused: true})
+
+	_, err := request[gamelogic.SpawnIntent, gamelogic.StateDelta](g, alice, routing.SpawnKey,
+		gamelogic.SpawnIntent{Location: "europe", Rank: gamelogic.RankInfantry})
+	if err == nil || !strings.Contains(err.Error(), "paused") {
+		t.Fatalf("spawn while paused = %v, want it refused", err)
+	}
+	if units := g.auth.world.State("alice").Units; len(units) != 0 {
+		t.Errorf("the world has units %v for alice after a refused spawn", units)
+	}
+}
+
+// TestIntentAbandonedWhileRelayStopped checks an intent whose changes the
+// outbox does not get to is rolled back instead of holding up the others.
+func TestIntentAbandonedWhileRelayStopped(t *testing.T) {
+	g := startGame(t)
+	alice := g.join(t, "alice")
+	stalled, err := outbox.New(outbox.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.auth.mu.Lock()
+	g.auth.ob = stalled
+	g.auth.mu.Unlock()
+
+	start := time.Now()
+	_, err = request[gamelogic.SpawnIntent, gamelogic.StateDelta](g, alice, routing.SpawnKey,
+		gamelogic.SpawnIntent{Location: "europe", Rank: gamelogic.RankInfantry})
+	if err == nil || !strings.Contains(err.Error(), outbox.ErrAbandoned.Error()) {
+		t.Fatalf("spawn = %v, want it abandoned", err)
+	}
+	if took := time.Since(start); took > queueTimeout+time.Second {
+		t.Errorf("spawn took %v, want about %v", took, queueTimeout)
+	}
+	g.auth.mu.Lock()
+	units := g.auth.world.State("alice").Units
+	g.auth.mu.Unlock()
+	if len(units) != 0 {
+		t.Errorf("the world has units %v for alice after an abandoned spawn", units)
+	}
+	if n := stalled.Pending(); n != 0 {
+		t.Errorf("%d changes left in the outbox", n)
+	}
+}
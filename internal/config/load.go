@@ -0,0 +1,277 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// EnvFile names the environment variable pointing at a config file, used
+// when -config is not given.
+const EnvFile = "PERIL_CONFIG"
+
+// setting is a single configuration value as it is named in flags and
+// environment variables.
+type setting struct {
+	flag  string
+	env   string
+	usage string
+	set   func(c *Config, v string) error
+	// envOnly keeps secrets off the command line, where other users can
+	// see them.
+	envOnly bool
+}
+
+var settings = []setting{
+	{"url", "PERIL_BROKER_URL", "RabbitMQ connection string", setString(func(c *Config) *string { return &c.Broker.URL }), false},
+	{"vhost", "PERIL_BROKER_VHOST", "vhost, overriding the one in the url", setString(func(c *Config) *string { return &c.Broker.Vhost }), false},
+	{"heartbeat", "PERIL_BROKER_HEARTBEAT", "heartbeat interval", setDuration(func(c *Config) *time.Duration { return &c.Broker.Heartbeat }), false},
+	{"tls-ca", "PERIL_TLS_CA", "PEM file of the CA the broker certificate is checked against", setString(func(c *Config) *string { return &c.Broker.TLS.CAFile }), false},
+	{"tls-cert", "PERIL_TLS_CERT", "PEM file of the client certificate", setString(func(c *Config) *string { return &c.Broker.TLS.CertFile }), false},
+	{"tls-key", "PERIL_TLS_KEY", "PEM file of the client certificate's key", setString(func(c *Config) *string { return &c.Broker.TLS.KeyFile }), false},
+	{"tls-server-name", "PERIL_TLS_SERVER_NAME", "name expected in the broker certificate, if not the url host", setString(func(c *Config) *string { return &c.Broker.TLS.ServerName }), false},
+	{"auth", "PERIL_BROKER_AUTH", "authentication mechanism, plain or external", setString(func(c *Config) *string { return &c.Broker.Auth.Mechanism }), false},
+	{"username", "PERIL_BROKER_USERNAME", "username, overriding the one in the url", setString(func(c *Config) *string { return &c.Broker.Auth.Username }), false},
+	{"username-file", "PERIL_BROKER_USERNAME_FILE", "file holding the username", setString(func(c *Config) *string { return &c.Broker.Auth.UsernameFile }), false},
+	{"password", "PERIL_BROKER_PASSWORD", "password, overriding the one in the url", setString(func(c *Config) *string { return &c.Broker.Auth.Password }), true},
+	{"password-file", "PERIL_BROKER_PASSWORD_FILE", "file holding the password", setString(func(c *Config) *string { return &c.Broker.Auth.PasswordFile }), false},
+	{"prefetch", "PERIL_PREFETCH", "unacknowledged deliveries per subscription, 0 for no limit", setInt(func(c *Config) *int { return &c.Prefetch }), false},
+	{"log-file", "PERIL_LOG_FILE", "file game logs are appended to", setString(func(c *Config) *string { return &c.GameLog.Path }), false},
+	{"log-write-delay", "PERIL_LOG_WRITE_DELAY", "time spent writing each game log", setDuration(func(c *Config) *time.Duration { return &c.GameLog.WriteDelay }), false},
+	{"outbox-journal", "PERIL_OUTBOX_JOURNAL", "file the server keeps unpublished changes in across restarts", setString(func(c *Config) *string { return &c.Outbox.Journal }), false},
+	{"snapshot-dir", "PERIL_SNAPSHOT_DIR", "directory game state snapshots are saved in", setString(func(c *Config) *string { return &c.Snapshot.Dir }), false},
+	{"snapshot-interval", "PERIL_SNAPSHOT_INTERVAL", "time between automatic snapshots, 0 to only save on quit", setDuration(func(c *Config) *time.Duration { return &c.Snapshot.Interval }), false},
+	{"history-file", "PERIL_HISTORY_FILE", "file the server records game events in, empty to record none", setString(func(c *Config) *string { return &c.History.Path }), false},
+}
+
+func setString(field func(c *Config) *string) func(*Config, string) error {
+	return func(c *Config, v string) error {
+		*field(c) = v
+		return nil
+	}
+}
+
+func setDuration(field func(c *Config) *time.Duration) func(*Config, string) error {
+	return func(c *Config, v string) error {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return err
+		}
+		*field(c) = d
+		return nil
+	}
+}
+
+func setInt(field func(c *Config) *int) func(*Config, string) error {
+	return func(c *Config, v string) error {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return err
+		}
+		*field(c) = n
+		return nil
+	}
+}
+
+// Load builds the configuration of the named binary from, by increasing
+// priority, the defaults, a YAML file given with -config or PERIL_CONFIG,
+// PERIL_* environment variables and command line flags.
+func Load(name string, args []string) (Config, error) {
+	return LoadFlags(flag.NewFlagSet(name, flag.ContinueOnError), args)
+}
+
+// LoadFlags is Load for binaries with flags of their own, which they define
+// on fs before calling it.
+func LoadFlags(fs *flag.FlagSet, args []string) (Config, error) {
+	configFile := fs.String("config", os.Getenv(EnvFile), "YAML config file")
+	printConfig := fs.Bool("print-config", false, "print the resolved configuration and exit")
+	flags := map[string]string{}
+	for _, s := range settings {
+		if s.envOnly {
+			continue
+		}
+		fs.Func(s.flag, fmt.Sprintf("%s (env %s)", s.usage, s.env), func(v string) error {
+			flags[s.flag] = v
+			return nil
+		})
+	}
+	err := fs.Parse(args)
+	if err != nil {
+		return Config{}, err
+	}
+
+	cfg := Default()
+	if *configFile != "" {
+		values, err := readFile(*configFile)
+		if err != nil {
+			return Config{}, err
+		}
+		err = apply(&cfg, values, "config file")
+		if err != nil {
+			return Config{}, err
+		}
+	}
+	env := map[string]string{}
+	for _, s := range settings {
+		if v, ok := os.LookupEnv(s.env); ok {
+			env[s.flag] = v
+		}
+	}
+	err = apply(&cfg, env, "environment")
+	if err != nil {
+		return Config{}, err
+	}
+	err = apply(&cfg, flags, "flag")
+	if err != nil {
+		return Config{}, err
+	}
+	cfg.PrintConfig = *printConfig
+
+	err = cfg.Validate()
+	if err != nil {
+		return Config{}, fmt.Errorf("invalid configuration: %v", err)
+	}
+	return cfg, nil
+}
+
+func apply(cfg *Config, values map[string]string, source string) error {
+	for _, s := range settings {
+		v, ok := values[s.flag]
+		if !ok {
+			continue
+		}
+		err := s.set(cfg, v)
+		if err != nil {
+			return fmt.Errorf("%s %s: %v", source, s.flag, err)
+		}
+	}
+	return nil
+}
+
+// file is the layout of the YAML config file, durations written the way
+// time.ParseDuration reads them. Values are pointers to tell a key set to
+// an empty string apart from one left out.
+type file struct {
+	Broker struct {
+		URL       *string `yaml:"url,omitempty"`
+		Vhost     *string `yaml:"vhost,omitempty"`
+		Heartbeat *string `yaml:"heartbeat,omitempty"`
+		TLS       struct {
+			CAFile     *string `yaml:"ca_file,omitempty"`
+			CertFile   *string `yaml:"cert_file,omitempty"`
+			KeyFile    *string `yaml:"key_file,omitempty"`
+			ServerName *string `yaml:"server_name,omitempty"`
+		} `yaml:"tls,omitempty"`
+		Auth struct {
+			Mechanism    *string `yaml:"mechanism,omitempty"`
+			Username     *string `yaml:"username,omitempty"`
+			UsernameFile *string `yaml:"username_file,omitempty"`
+			PasswordFile *string `yaml:"password_file,omitempty"`
+		} `yaml:"auth,omitempty"`
+	} `yaml:"broker"`
+	Prefetch *int `yaml:"prefetch,omitempty"`
+	GameLog  struct {
+		Path       *string `yaml:"path,omitempty"`
+		WriteDelay *string `yaml:"write_delay,omitempty"`
+	} `yaml:"game_log"`
+	Outbox struct {
+		Journal *string `yaml:"journal,omitempty"`
+	} `yaml:"outbox,omitempty"`
+	Snapshot struct {
+		Dir      *string `yaml:"dir,omitempty"`
+		Interval *string `yaml:"interval,omitempty"`
+	} `yaml:"snapshot"`
+	History struct {
+		Path *string `yaml:"path,omitempty"`
+	} `yaml:"history"`
+}
+
+func readFile(path string) (map[string]string, error) {
+	dat, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read config file: %v", err)
+	}
+	var f file
+	err = yaml.Unmarshal(dat, &f)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse config file %s: %v", path, err)
+	}
+
+	values := map[string]string{}
+	add := func(flag string, v *string) {
+		if v != nil {
+			values[flag] = *v
+		}
+	}
+	add("url", f.Broker.URL)
+	add("vhost", f.Broker.Vhost)
+	add("heartbeat", f.Broker.Heartbeat)
+	add("tls-ca", f.Broker.TLS.CAFile)
+	add("tls-cert", f.Broker.TLS.CertFile)
+	add("tls-key", f.Broker.TLS.KeyFile)
+	add("tls-server-name", f.Broker.TLS.ServerName)
+	add("auth", f.Broker.Auth.Mechanism)
+	add("username", f.Broker.Auth.Username)
+	add("username-file", f.Broker.Auth.UsernameFile)
+	add("password-file", f.Broker.Auth.PasswordFile)
+	if f.Prefetch != nil {
+		values["prefetch"] = strconv.Itoa(*f.Prefetch)
+	}
+	add("log-file", f.GameLog.Path)
+	add("log-write-delay", f.GameLog.WriteDelay)
+	add("outbox-journal", f.Outbox.Journal)
+	add("snapshot-dir", f.Snapshot.Dir)
+	add("snapshot-interval", f.Snapshot.Interval)
+	add("history-file", f.History.Path)
+	return values, nil
+}
+
+// Print writes the configuration in the config file format, with the
+// password in the broker url masked and a password from the environment
+// left out.
+func (c Config) Print(w io.Writer) error {
+	var f file
+	f.Broker.URL = nonEmpty(c.Broker.URL)
+	if u, err := url.Parse(c.Broker.URL); err == nil {
+		f.Broker.URL = nonEmpty(u.Redacted())
+	}
+	f.Broker.Vhost = nonEmpty(c.Broker.Vhost)
+	f.Broker.Heartbeat = nonEmpty(c.Broker.Heartbeat.String())
+	f.Broker.TLS.CAFile = nonEmpty(c.Broker.TLS.CAFile)
+	f.Broker.TLS.CertFile = nonEmpty(c.Broker.TLS.CertFile)
+	f.Broker.TLS.KeyFile = nonEmpty(c.Broker.TLS.KeyFile)
+	f.Broker.TLS.ServerName = nonEmpty(c.Broker.TLS.ServerName)
+	f.Broker.Auth.Mechanism = nonEmpty(c.Broker.Auth.Mechanism)
+	f.Broker.Auth.Username = nonEmpty(c.Broker.Auth.Username)
+	f.Broker.Auth.UsernameFile = nonEmpty(c.Broker.Auth.UsernameFile)
+	f.Broker.Auth.PasswordFile = nonEmpty(c.Broker.Auth.PasswordFile)
+	f.Prefetch = &c.Prefetch
+	f.GameLog.Path = nonEmpty(c.GameLog.Path)
+	f.GameLog.WriteDelay = nonEmpty(c.GameLog.WriteDelay.String())
+	f.Outbox.Journal = nonEmpty(c.Outbox.Journal)
+	f.Snapshot.Dir = nonEmpty(c.Snapshot.Dir)
+	f.Snapshot.Interval = nonEmpty(c.Snapshot.Interval.String())
+	// Written even when empty, as that turns the history off.
+	f.History.Path = &c.History.Path
+
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	err := enc.Encode(f)
+	if err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+func nonEmpty(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
@@ -0,0 +1,78 @@
+package config
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, yaml string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "peril.yaml")
+	err := os.WriteFile(path, []byte(yaml), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadEmptyValueInFile(t *testing.T) {
+	path := writeConfig(t, "history:\n  path: \"\"\nsnapshot:\n  interval: 5s\n")
+	cfg, err := Load("test", []string{"-config", path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.History.Path != "" {
+		t.Errorf("history path = %q, want it turned off", cfg.History.Path)
+	}
+	// Keys left out keep their default.
+	if cfg.Snapshot.Dir != Default().Snapshot.Dir {
+		t.Errorf("snapshot dir = %q, want the default", cfg.Snapshot.Dir)
+	}
+	if cfg.Snapshot.Interval != 5*time.Second {
+		t.Errorf("snapshot interval = %v, want 5s", cfg.Snapshot.Interval)
+	}
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	path := writeConfig(t, "prefetch: 5\ngame_log:\n  path: file.log\n  write_delay: 2s\n")
+	t.Setenv("PERIL_PREFETCH", "7")
+	t.Setenv("PERIL_LOG_FILE", "env.log")
+	cfg, err := Load("test", []string{"-config", path, "-prefetch", "9"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Prefetch != 9 {
+		t.Errorf("prefetch = %d, want the flag's 9", cfg.Prefetch)
+	}
+	if cfg.GameLog.Path != "env.log" {
+		t.Errorf("log file = %q, want the environment's", cfg.GameLog.Path)
+	}
+	if cfg.GameLog.WriteDelay != 2*time.Second {
+		t.Errorf("log write delay = %v, want the file's 2s", cfg.GameLog.WriteDelay)
+	}
+}
+
+func TestPrintRoundTrips(t *testing.T) {
+	want := Default()
+	want.GameLog.WriteDelay = 3 * time.Second
+	want.Prefetch = 3
+	// Print masks passwords, so leave the url without one.
+	want.Broker.URL = "amqp://localhost:5672/"
+	var buf bytes.Buffer
+	err := want.Print(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := writeConfig(t, buf.String())
+
+	got, err := Load("test", []string{"-config", path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("printed config loaded back as\n%+v\nwant\n%+v", got, want)
+	}
+}
@@ -0,0 +1,286 @@
+package config
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCA is a certificate authority generated for a single test.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	dir  string
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "peril test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := &testCA{cert: cert, key: key, dir: t.TempDir()}
+	writePEM(t, ca.path("ca.pem"), "CERTIFICATE", der)
+	return ca
+}
+
+func (ca *testCA) path(name string) string {
+	return filepath.Join(ca.dir, name)
+}
+
+// issue signs a certificate for name and writes it and its key to
+// <name>.pem and <name>-key.pem, returning their paths.
+func (ca *testCA) issue(t *testing.T, name string, usage x509.ExtKeyUsage) (certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = ca.path(name+".pem"), ca.path(name+"-key.pem")
+	writePEM(t, certFile, "CERTIFICATE", der)
+	writePEM(t, keyFile, "PRIVATE KEY", keyDER)
+	return certFile, keyFile
+}
+
+func writePEM(t *testing.T, path, kind string, der []byte) {
+	t.Helper()
+	err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: kind, Bytes: der}), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// serveTLS accepts a single connection requiring a client certificate signed
+// by ca, and sends the common name of that certificate, or the handshake
+// error, on the returned channel.
+func serveTLS(t *testing.T, ca *testCA) (string, <-chan string) {
+	t.Helper()
+	certFile, keyFile := ca.issue(t, "broker.test", x509.ExtKeyUsageServerAuth)
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	peer := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			peer <- err.Error()
+			return
+		}
+		defer conn.Close()
+		tc := conn.(*tls.Conn)
+		err = tc.Handshake()
+		if err != nil {
+			peer <- err.Error()
+			return
+		}
+		peer <- tc.ConnectionState().PeerCertificates[0].Subject.CommonName
+	}()
+	return ln.Addr().String(), peer
+}
+
+func dialTLS(b Broker, addr string) error {
+	cfg, err := b.TLSConfig()
+	if err != nil {
+		return err
+	}
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 2 * time.Second}, "tcp", addr, cfg)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return conn.Handshake()
+}
+
+func TestTLSConfigMutualHandshake(t *testing.T) {
+	ca := newTestCA(t)
+	addr, peer := serveTLS(t, ca)
+	certFile, keyFile := ca.issue(t, "peril-server", x509.ExtKeyUsageClientAuth)
+
+	b := Broker{TLS: TLS{
+		CAFile:     ca.path("ca.pem"),
+		CertFile:   certFile,
+		KeyFile:    keyFile,
+		ServerName: "broker.test",
+	}}
+	err := dialTLS(b, addr)
+	if err != nil {
+		t.Fatalf("handshake failed: %v", err)
+	}
+	select {
+	case name := <-peer:
+		if name != "peril-server" {
+			t.Errorf("broker saw client %q, want peril-server", name)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("broker did not finish the handshake")
+	}
+}
+
+func TestTLSConfigWrongCA(t *testing.T) {
+	ca := newTestCA(t)
+	addr, _ := serveTLS(t, ca)
+	certFile, keyFile := ca.issue(t, "peril-server", x509.ExtKeyUsageClientAuth)
+
+	other := newTestCA(t)
+	b := Broker{TLS: TLS{
+		CAFile:     other.path("ca.pem"),
+		CertFile:   certFile,
+		KeyFile:    keyFile,
+		ServerName: "broker.test",
+	}}
+	err := dialTLS(b, addr)
+	if err == nil {
+		t.Fatal("handshake succeeded against a broker signed by another CA")
+	}
+}
+
+func TestTLSConfigNone(t *testing.T) {
+	cfg, err := Broker{}.TLSConfig()
+	if err != nil || cfg != nil {
+		t.Errorf("TLSConfig() = %v, %v, want nil for the system defaults", cfg, err)
+	}
+}
+
+func TestValidateTLSAndAuth(t *testing.T) {
+	ca := newTestCA(t)
+	certFile, keyFile := ca.issue(t, "peril-server", x509.ExtKeyUsageClientAuth)
+
+	tests := []struct {
+		name    string
+		change  func(*Broker)
+		wantErr string
+	}{
+		{
+			name: "external with client certificate",
+			change: func(b *Broker) {
+				b.TLS = TLS{CAFile: ca.path("ca.pem"), CertFile: certFile, KeyFile: keyFile}
+				b.Auth = Auth{Mechanism: AuthExternal}
+			},
+		},
+		{
+			name: "external without client certificate",
+			change: func(b *Broker) {
+				b.TLS = TLS{CAFile: ca.path("ca.pem")}
+				b.Auth = Auth{Mechanism: AuthExternal}
+			},
+			wantErr: "external auth needs a tls client certificate",
+		},
+		{
+			name: "external with a password",
+			change: func(b *Broker) {
+				b.TLS = TLS{CertFile: certFile, KeyFile: keyFile}
+				b.Auth = Auth{Mechanism: AuthExternal, Password: "secret"}
+			},
+			wantErr: "external auth does not use a username or password",
+		},
+		{
+			name: "cert without key",
+			change: func(b *Broker) {
+				b.TLS = TLS{CertFile: certFile}
+			},
+			wantErr: "tls cert and key must be given together",
+		},
+		{
+			name: "tls on a plain url",
+			change: func(b *Broker) {
+				b.URL = "amqp://localhost:5672/"
+				b.TLS = TLS{CAFile: ca.path("ca.pem")}
+			},
+			wantErr: "need an amqps:// or stomp+ssl:// broker url",
+		},
+		{
+			name: "missing CA file",
+			change: func(b *Broker) {
+				b.TLS = TLS{CAFile: ca.path("missing.pem")}
+			},
+			wantErr: "missing.pem",
+		},
+		{
+			name: "unknown mechanism",
+			change: func(b *Broker) {
+				b.Auth = Auth{Mechanism: "kerberos"}
+			},
+			wantErr: `unknown auth mechanism "kerberos"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := Default()
+			cfg.Broker.URL = "amqps://broker.test:5671/"
+			tt.change(&cfg.Broker)
+			err := cfg.Validate()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("Validate() = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("Validate() = %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,110 @@
+package gamelogic
+
+import "time"
+
+const DefaultHistoryFile = "history.jsonl"
+
+type EventKind string
+
+const (
+	EventSpawn  EventKind = "spawn"
+	EventMove   EventKind = "move"
+	EventWar    EventKind = "war"
+	EventPause  EventKind = "pause"
+	EventResume EventKind = "resume"
+	// EventBaseline is the world the server started from, for histories
+	// that do not begin with an empty one.
+	EventBaseline EventKind = "baseline"
+)
+
+// Event is a change the server made to the game. Folded in order with
+// ApplyEvent, the events of a game rebuild every player's state.
+type Event struct {
+	Seq  int       `json:"seq"`
+	Time time.Time `json:"time"`
+	Kind EventKind `json:"kind"`
+	// Username is who spawned the unit, empty for other events.
+	Username string `json:"username,omitempty"`
+	// Unit is the spawned unit.
+	Unit *Unit      `json:"unit,omitempty"`
+	Move *ArmyMove  `json:"move,omitempty"`
+	War  *WarResult `json:"war,omitempty"`
+	// States are every player's units, for baseline events.
+	States []StateDelta `json:"states,omitempty"`
+}
+
+// ApplyEvent changes the game state the way the event changed the
+// player's units on the server, without printing anything.
+func (gs *GameState) ApplyEvent(e Event) {
+	username := gs.GetUsername()
+	switch e.Kind {
+	case EventSpawn:
+		if e.Username == username && e.Unit != nil {
+			gs.UpdateUnit(*e.Unit)
+		}
+	case EventMove:
+		if e.Move != nil && e.Move.Player.Username == username {
+			for _, u := range e.Move.Units {
+				gs.UpdateUnit(u)
+			}
+		}
+	case EventWar:
+		if e.War == nil {
+			return
+		}
+		lost := e.War.Loser == username
+		if e.War.Winner == "" {
+			lost = e.War.Attacker == username || e.War.Defender == username
+		}
+		if lost {
+			gs.removeUnitsInLocation(e.War.Location)
+		}
+	case EventPause:
+		gs.pauseGame()
+	case EventResume:
+		gs.resumeGame()
+	case EventBaseline:
+		// Players missing from the baseline had no units.
+		base := StateDelta{Username: username, Reset: true}
+		for _, d := range e.States {
+			if d.Username == username {
+				base = d
+				base.Reset = true
+			}
+		}
+		gs.ApplyDelta(base)
+	}
+}
+
+// Rebuild folds the events into the game state of username.
+func Rebuild(username string, events []Event) *GameState {
+	gs := NewGameState(username)
+	for _, e := range events {
+		gs.ApplyEvent(e)
+	}
+	return gs
+}
+
+// Players lists everyone that spawned a unit or was in a baseline in the
+// events, in order of appearance.
+func Players(events []Event) []string {
+	seen := map[string]bool{}
+	names := []string{}
+	add := func(name string) {
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	for _, e := range events {
+		switch e.Kind {
+		case EventSpawn:
+			add(e.Username)
+		case EventBaseline:
+			for _, d := range e.States {
+				add(d.Username)
+			}
+		}
+	}
+	return names
+}
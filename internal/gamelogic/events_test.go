@@ -0,0 +1,73 @@
+package gamelogic
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRebuildFromBaseline(t *testing.T) {
+	w := NewWorld()
+	alice, err := w.Spawn("alice", SpawnIntent{Location: "europe", Rank: RankInfantry})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = w.Spawn("bob", SpawnIntent{Location: "asia", Rank: RankCavalry})
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := alice.Units[0]
+	moved := first
+	moved.Location = "africa"
+
+	events := []Event{
+		// Left over from before the world was saved: the baseline replaces
+		// it.
+		{Kind: EventSpawn, Username: "alice", Unit: &Unit{ID: 9, Rank: RankArtillery, Location: "australia"}},
+		{Kind: EventBaseline, States: w.States()},
+		{Kind: EventSpawn, Username: "carol", Unit: &Unit{ID: 1, Rank: RankInfantry, Location: "americas"}},
+		{Kind: EventMove, Move: &ArmyMove{Player: Player{Username: "alice"}, Units: []Unit{moved}, ToLocation: "africa"}},
+	}
+
+	tests := []struct {
+		username string
+		want     map[int]Unit
+	}{
+		{"alice", map[int]Unit{first.ID: moved}},
+		{"bob", w.player("bob").Units},
+		{"carol", map[int]Unit{1: {ID: 1, Rank: RankInfantry, Location: "americas"}}},
+		{"dave", map[int]Unit{}},
+	}
+	for _, tt := range tests {
+		got := Rebuild(tt.username, events).GetPlayerSnap().Units
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Rebuild(%s) units = %v, want %v", tt.username, got, tt.want)
+		}
+	}
+
+	players := Players(events)
+	want := []string{"alice", "bob", "carol"}
+	if !reflect.DeepEqual(players, want) {
+		t.Errorf("Players = %v, want %v", players, want)
+	}
+}
+
+func TestRebuildWar(t *testing.T) {
+	events := []Event{
+		{Kind: EventSpawn, Username: "alice", Unit: &Unit{ID: 1, Rank: RankInfantry, Location: "europe"}},
+		{Kind: EventSpawn, Username: "alice", Unit: &Unit{ID: 2, Rank: RankInfantry, Location: "asia"}},
+		{Kind: EventSpawn, Username: "bob", Unit: &Unit{ID: 1, Rank: RankCavalry, Location: "europe"}},
+		{Kind: EventWar, War: &WarResult{Attacker: "bob", Defender: "alice", Winner: "bob", Loser: "alice", Location: "europe"}},
+		{Kind: EventPause},
+	}
+	alice := Rebuild("alice", events)
+	if ids := unitIDs(alice); !reflect.DeepEqual(ids, []int{2}) {
+		t.Errorf("alice has units %v after losing in europe, want [2]", ids)
+	}
+	if !alice.isPaused() {
+		t.Error("alice's game is not paused")
+	}
+	bob := Rebuild("bob", events)
+	if ids := unitIDs(bob); !reflect.DeepEqual(ids, []int{1}) {
+		t.Errorf("bob has units %v after winning, want [1]", ids)
+	}
+}
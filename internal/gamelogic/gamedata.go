@@ -32,6 +32,44 @@ type RecognitionOfWar struct {
 
 type Location string
 
+// SpawnIntent asks the server for a new unit.
+type SpawnIntent struct {
+	Location Location
+	Rank     UnitRank
+}
+
+// MoveIntent asks the server to move some of the sender's units.
+type MoveIntent struct {
+	UnitIDs    []int
+	ToLocation Location
+}
+
+// StateDelta is how the server tells a player their units changed. Units
+// are the units added or changed and Removed the IDs of those killed,
+// unless Reset says Units is every unit the player has. Version grows with
+// every change, so older deltas arriving late can be told apart.
+type StateDelta struct {
+	Username string
+	Version  int
+	Units    []Unit
+	Removed  []int
+	Reset    bool
+}
+
+// WarResult is a war fought by the server when a move brought units of two
+// players to the same location.
+type WarResult struct {
+	Attacker      string
+	Defender      string
+	Location      Location
+	AttackerUnits []Unit
+	DefenderUnits []Unit
+	// Winner and Loser are empty when the war ended in a draw and both
+	// sides lost their units.
+	Winner string
+	Loser  string
+}
+
 func getAllRanks() map[UnitRank]struct{} {
 	return map[UnitRank]struct{}{
 		RankInfantry:  {},
@@ -41,12 +79,9 @@ func getAllRanks() map[UnitRank]struct{} {
 }
 
 func getAllLocations() map[Location]struct{} {
-	return map[Location]struct{}{
-		"americas":   {},
-		"europe":     {},
-		"africa":     {},
-		"asia":       {},
-		"australia":  {},
-		"antarctica": {},
+	locations := map[Location]struct{}{}
+	for _, loc := range DefaultMap().Regions() {
+		locations[loc] = struct{}{}
 	}
+	return locations
 }
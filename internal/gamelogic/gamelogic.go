@@ -18,6 +18,9 @@ func PrintClientHelp() {
 	fmt.Println("    example:")
 	fmt.Println("    spawn europe infantry")
 	fmt.Println("* status")
+	fmt.Println("* map")
+	fmt.Println("* save")
+	fmt.Println("* load")
 	fmt.Println("* spam <n>")
 	fmt.Println("    example:")
 	fmt.Println("    spam 5")
@@ -90,3 +93,27 @@ func (gs *GameState) CommandStatus() {
 		fmt.Printf("* %v: %v, %v\n", unit.ID, unit.Location, unit.Rank)
 	}
 }
+
+// CommandMap prints every region, the regions next to it with what getting
+// there costs, and the player's units in it.
+func (gs *GameState) CommandMap() {
+	m := DefaultMap()
+	p := gs.GetPlayerSnap()
+	fmt.Println("The world map:")
+	for _, loc := range m.Regions() {
+		neighbors := []string{}
+		for _, e := range m.Neighbors(loc) {
+			neighbors = append(neighbors, fmt.Sprintf("%s (%v)", e.To, e.Cost))
+		}
+		fmt.Printf("* %s -> %s\n", loc, strings.Join(neighbors, ", "))
+		for _, unit := range sortedUnits(p.Units) {
+			if unit.Location == loc {
+				fmt.Printf("    * %v: %v\n", unit.ID, unit.Rank)
+			}
+		}
+	}
+	fmt.Printf("Units move along paths costing up to their range: %s %v, %s %v, %s %v.\n",
+		RankInfantry, rankRange(RankInfantry),
+		RankCavalry, rankRange(RankCavalry),
+		RankArtillery, rankRange(RankArtillery))
+}
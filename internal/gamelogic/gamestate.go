@@ -7,7 +7,11 @@ import (
 type GameState struct {
 	Player Player
 	Paused bool
-	mu     *sync.RWMutex
+	// version is the last StateDelta applied.
+	version int
+	// token proves the player's intents are theirs, see routing.Join.
+	token string
+	mu    *sync.RWMutex
 }
 
 func NewGameState(username string) *GameState {
@@ -39,12 +43,6 @@ func (gs *GameState) isPaused() bool {
 	return gs.Paused
 }
 
-func (gs *GameState) addUnit(u Unit) {
-	gs.mu.Lock()
-	defer gs.mu.Unlock()
-	gs.Player.Units[u.ID] = u
-}
-
 func (gs *GameState) removeUnitsInLocation(loc Location) {
 	gs.mu.Lock()
 	defer gs.mu.Unlock()
@@ -61,6 +59,18 @@ func (gs *GameState) UpdateUnit(u Unit) {
 	gs.Player.Units[u.ID] = u
 }
 
+func (gs *GameState) Token() string {
+	gs.mu.RLock()
+	defer gs.mu.RUnlock()
+	return gs.token
+}
+
+func (gs *GameState) SetToken(token string) {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	gs.token = token
+}
+
 func (gs *GameState) GetUsername() string {
 	return gs.Player.Username
 }
@@ -94,3 +104,29 @@ func (gs *GameState) GetPlayerSnap() Player {
 		Units:    Units,
 	}
 }
+
+// ApplyDelta brings the player's units up to date with the server,
+// reporting false for deltas of other players or older than the state
+// already applied. Resets are always applied, as the server's world may be
+// older than what the client has seen, after restoring an earlier save.
+func (gs *GameState) ApplyDelta(d StateDelta) bool {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	if d.Username != gs.Player.Username {
+		return false
+	}
+	if !d.Reset && d.Version <= gs.version {
+		return false
+	}
+	if d.Reset {
+		gs.Player.Units = map[int]Unit{}
+	}
+	for _, u := range d.Units {
+		gs.Player.Units[u.ID] = u
+	}
+	for _, id := range d.Removed {
+		delete(gs.Player.Units, id)
+	}
+	gs.version = d.Version
+	return true
+}
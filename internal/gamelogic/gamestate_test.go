@@ -0,0 +1,129 @@
+package gamelogic
+
+import (
+	"sort"
+	"testing"
+)
+
+func unitIDs(gs *GameState) []int {
+	ids := []int{}
+	for id := range gs.GetPlayerSnap().Units {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+func TestApplyDelta(t *testing.T) {
+	infantry := func(id int) Unit { return Unit{ID: id, Rank: RankInfantry, Location: "europe"} }
+	tests := []struct {
+		name        string
+		deltas      []StateDelta
+		wantApplied []bool
+		wantIDs     []int
+	}{
+		{
+			name: "in order",
+			deltas: []StateDelta{
+				{Username: "alice", Version: 1, Units: []Unit{infantry(1)}},
+				{Username: "alice", Version: 2, Units: []Unit{infantry(2)}},
+				{Username: "alice", Version: 3, Removed: []int{1}},
+			},
+			wantApplied: []bool{true, true, true},
+			wantIDs:     []int{2},
+		},
+		{
+			name: "late delta ignored",
+			deltas: []StateDelta{
+				{Username: "alice", Version: 2, Units: []Unit{infantry(2)}},
+				{Username: "alice", Version: 1, Units: []Unit{infantry(1)}},
+			},
+			wantApplied: []bool{true, false},
+			wantIDs:     []int{2},
+		},
+		{
+			name: "other player ignored",
+			deltas: []StateDelta{
+				{Username: "bob", Version: 1, Units: []Unit{infantry(1)}},
+			},
+			wantApplied: []bool{false},
+			wantIDs:     []int{},
+		},
+		{
+			name: "reset replaces units",
+			deltas: []StateDelta{
+				{Username: "alice", Version: 1, Units: []Unit{infantry(1)}},
+				{Username: "alice", Version: 2, Units: []Unit{infantry(2)}, Reset: true},
+			},
+			wantApplied: []bool{true, true},
+			wantIDs:     []int{2},
+		},
+		{
+			// The server restarted from an older world than the client saw.
+			name: "older reset applied",
+			deltas: []StateDelta{
+				{Username: "alice", Version: 5, Units: []Unit{infantry(1), infantry(2)}},
+				{Username: "alice", Version: 3, Units: []Unit{infantry(1)}, Reset: true},
+				{Username: "alice", Version: 4, Units: []Unit{infantry(3)}},
+			},
+			wantApplied: []bool{true, true, true},
+			wantIDs:     []int{1, 3},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gs := NewGameState("alice")
+			for i, d := range tt.deltas {
+				if got := gs.ApplyDelta(d); got != tt.wantApplied[i] {
+					t.Errorf("ApplyDelta(%+v) = %v, want %v", d, got, tt.wantApplied[i])
+				}
+			}
+			got := unitIDs(gs)
+			if len(got) != len(tt.wantIDs) {
+				t.Fatalf("units = %v, want %v", got, tt.wantIDs)
+			}
+			for i := range got {
+				if got[i] != tt.wantIDs[i] {
+					t.Fatalf("units = %v, want %v", got, tt.wantIDs)
+				}
+			}
+		})
+	}
+}
+
+func TestServerWinsOverNewerSnapshot(t *testing.T) {
+	gs := NewGameState("alice")
+	err := gs.Restore(Snapshot{
+		Player: Player{Username: "alice", Units: map[int]Unit{
+			1: {ID: 1, Rank: RankInfantry, Location: "europe"},
+			2: {ID: 2, Rank: RankInfantry, Location: "asia"},
+		}},
+		StateVersion: 7,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The server restarted from a world saved at version 3.
+	if !gs.ApplyDelta(StateDelta{Username: "alice", Version: 3, Units: []Unit{{ID: 1, Rank: RankInfantry, Location: "europe"}}, Reset: true}) {
+		t.Fatal("server reset was ignored")
+	}
+	if !gs.ApplyDelta(StateDelta{Username: "alice", Version: 4, Units: []Unit{{ID: 3, Rank: RankCavalry, Location: "africa"}}}) {
+		t.Fatal("delta after the reset was ignored")
+	}
+	got := unitIDs(gs)
+	if len(got) != 2 || got[0] != 1 || got[1] != 3 {
+		t.Errorf("units = %v, want [1 3]", got)
+	}
+	if v := gs.Snapshot().StateVersion; v != 4 {
+		t.Errorf("state version = %d, want 4", v)
+	}
+}
+
+func TestRestoreOtherPlayer(t *testing.T) {
+	gs := NewGameState("alice")
+	err := gs.Restore(Snapshot{Player: Player{Username: "bob", Units: map[int]Unit{}}})
+	if err == nil {
+		t.Error("restored bob's snapshot into alice's game")
+	}
+}
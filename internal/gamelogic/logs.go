@@ -9,9 +9,22 @@ import (
 	"github.com/gabrieldiem/learn-pub-sub-starter/internal/routing"
 )
 
-const logsFile = "game.log"
+const (
+	DefaultLogsFile  = "game.log"
+	DefaultLogsDelay = 1 * time.Second
+)
+
+var (
+	logsFile         = DefaultLogsFile
+	writeToDiskSleep = DefaultLogsDelay
+)
 
-const writeToDiskSleep = 1 * time.Second
+// ConfigureLogs sets the file WriteLog appends to and how long it pretends
+// writing to disk takes. It must be called before any log is written.
+func ConfigureLogs(path string, writeDelay time.Duration) {
+	logsFile = path
+	writeToDiskSleep = writeDelay
+}
 
 func WriteLog(gamelog routing.GameLog) error {
 	log.Printf("received game log...")
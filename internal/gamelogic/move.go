@@ -49,44 +49,41 @@ func getOverlappingLocation(p1 Player, p2 Player) Location {
 	return ""
 }
 
-func (gs *GameState) CommandMove(words []string) (ArmyMove, error) {
+// CommandMove checks the command against the units the server last told
+// the player about and turns it into an intent. Units only move once the
+// server accepts it.
+func (gs *GameState) CommandMove(words []string) (MoveIntent, error) {
 	if gs.isPaused() {
-		return ArmyMove{}, errors.New("the game is paused, you can not move units")
+		return MoveIntent{}, errors.New("the game is paused, you can not move units")
 	}
 	if len(words) < 3 {
-		return ArmyMove{}, errors.New("usage: move <location> <unitID> <unitID> <unitID> etc")
+		return MoveIntent{}, errors.New("usage: move <location> <unitID> <unitID> <unitID> etc")
 	}
 	newLocation := Location(words[1])
 	locations := getAllLocations()
 	if _, ok := locations[newLocation]; !ok {
-		return ArmyMove{}, fmt.Errorf("error: %s is not a valid location", newLocation)
+		return MoveIntent{}, fmt.Errorf("error: %s is not a valid location", newLocation)
 	}
 	unitIDs := []int{}
 	for _, word := range words[2:] {
 		id := word
 		unitID, err := strconv.Atoi(id)
 		if err != nil {
-			return ArmyMove{}, fmt.Errorf("error: %s is not a valid unit ID", id)
+			return MoveIntent{}, fmt.Errorf("error: %s is not a valid unit ID", id)
 		}
-		unitIDs = append(unitIDs, unitID)
-	}
-
-	newUnits := []Unit{}
-	for _, unitID := range unitIDs {
 		unit, ok := gs.GetUnit(unitID)
 		if !ok {
-			return ArmyMove{}, fmt.Errorf("error: unit with ID %v not found", unitID)
+			return MoveIntent{}, fmt.Errorf("error: unit with ID %v not found", unitID)
 		}
-		unit.Location = newLocation
-		gs.UpdateUnit(unit)
-		newUnits = append(newUnits, unit)
+		err = DefaultMap().CheckMove(unit, newLocation)
+		if err != nil {
+			return MoveIntent{}, fmt.Errorf("error: %v", err)
+		}
+		unitIDs = append(unitIDs, unitID)
 	}
 
-	mv := ArmyMove{
+	return MoveIntent{
+		UnitIDs:    unitIDs,
 		ToLocation: newLocation,
-		Units:      newUnits,
-		Player:     gs.GetPlayerSnap(),
-	}
-	fmt.Printf("Moved %v units to %s\n", len(mv.Units), mv.ToLocation)
-	return mv, nil
+	}, nil
 }
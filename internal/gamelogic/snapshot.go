@@ -0,0 +1,214 @@
+package gamelogic
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// SnapshotVersion is the format SaveSnapshot writes. Snapshots of any
+// other version are refused rather than read wrong.
+const SnapshotVersion = 1
+
+const (
+	DefaultSnapshotDir      = "snapshots"
+	DefaultSnapshotInterval = 30 * time.Second
+)
+
+// Snapshot is a player's game state as saved to disk.
+type Snapshot struct {
+	Version int       `json:"version"`
+	SavedAt time.Time `json:"saved_at"`
+	Player  Player    `json:"player"`
+	Paused  bool      `json:"paused"`
+	// NextUnitID is the ID the server gives the player's next unit, only
+	// kept in the world as clients leave the IDs to the server.
+	NextUnitID int `json:"next_unit_id,omitempty"`
+	// StateVersion is the version of the last StateDelta applied, so that
+	// deltas already in the snapshot are not applied again.
+	StateVersion int `json:"state_version"`
+	// Token is the one the server issued when the player joined.
+	Token string `json:"token,omitempty"`
+}
+
+// worldFile is how SaveWorld writes a World, each player as the snapshot
+// their client would save.
+type worldFile struct {
+	Version int        `json:"version"`
+	SavedAt time.Time  `json:"saved_at"`
+	Players []Snapshot `json:"players"`
+}
+
+// SnapshotPath is where the snapshot of username is kept in dir.
+func SnapshotPath(dir, username string) string {
+	return filepath.Join(dir, "player-"+url.PathEscape(username)+".json")
+}
+
+// WorldPath is where the server's world is kept in dir.
+func WorldPath(dir string) string {
+	return filepath.Join(dir, "world.json")
+}
+
+func (gs *GameState) Snapshot() Snapshot {
+	gs.mu.RLock()
+	defer gs.mu.RUnlock()
+	units := make(map[int]Unit, len(gs.Player.Units))
+	for id, u := range gs.Player.Units {
+		units[id] = u
+	}
+	return Snapshot{
+		Version:      SnapshotVersion,
+		Player:       Player{Username: gs.Player.Username, Units: units},
+		Paused:       gs.Paused,
+		StateVersion: gs.version,
+		Token:        gs.token,
+	}
+}
+
+// Restore replaces the game state with a snapshot of the same player. The
+// server's reset answering GetState still wins over it, even when the
+// snapshot saw later changes than the server's world kept.
+func (gs *GameState) Restore(s Snapshot) error {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	if s.Player.Username != gs.Player.Username {
+		return fmt.Errorf("snapshot is of %s, not %s", s.Player.Username, gs.Player.Username)
+	}
+	gs.Player.Units = map[int]Unit{}
+	for id, u := range s.Player.Units {
+		gs.Player.Units[id] = u
+	}
+	gs.Paused = s.Paused
+	gs.version = s.StateVersion
+	// Snapshots saved before the player joined have no token.
+	if s.Token != "" {
+		gs.token = s.Token
+	}
+	return nil
+}
+
+// SaveSnapshot writes s to path, replacing the previous snapshot only once
+// the new one is complete.
+func SaveSnapshot(path string, s Snapshot) error {
+	s.Version = SnapshotVersion
+	s.SavedAt = time.Now()
+	return writeJSON(path, s)
+}
+
+// LoadSnapshot reads the snapshot at path. The error wraps os.ErrNotExist
+// when there is none.
+func LoadSnapshot(path string) (Snapshot, error) {
+	var s Snapshot
+	err := readJSON(path, &s)
+	if err != nil {
+		return Snapshot{}, err
+	}
+	if s.Version != SnapshotVersion {
+		return Snapshot{}, fmt.Errorf("snapshot %s has version %d, expected %d", path, s.Version, SnapshotVersion)
+	}
+	if s.Player.Units == nil {
+		s.Player.Units = map[int]Unit{}
+	}
+	return s, nil
+}
+
+// SaveWorld writes every player of w to path.
+func SaveWorld(path string, w *World) error {
+	w.mu.Lock()
+	f := worldFile{
+		Version: SnapshotVersion,
+		SavedAt: time.Now(),
+		Players: make([]Snapshot, 0, len(w.players)),
+	}
+	for name, r := range w.players {
+		f.Players = append(f.Players, Snapshot{
+			Version:      SnapshotVersion,
+			SavedAt:      f.SavedAt,
+			Player:       w.player(name),
+			NextUnitID:   r.nextID + 1,
+			StateVersion: r.version,
+			Token:        r.token,
+		})
+	}
+	w.mu.Unlock()
+	sort.Slice(f.Players, func(i, j int) bool {
+		return f.Players[i].Player.Username < f.Players[j].Player.Username
+	})
+	return writeJSON(path, f)
+}
+
+// LoadWorld reads a world saved with SaveWorld. The error wraps
+// os.ErrNotExist when there is none.
+func LoadWorld(path string) (*World, error) {
+	var f worldFile
+	err := readJSON(path, &f)
+	if err != nil {
+		return nil, err
+	}
+	if f.Version != SnapshotVersion {
+		return nil, fmt.Errorf("world %s has version %d, expected %d", path, f.Version, SnapshotVersion)
+	}
+	w := NewWorld()
+	for _, s := range f.Players {
+		r := w.record(s.Player.Username)
+		for id, u := range s.Player.Units {
+			r.units[id] = u
+		}
+		r.nextID = max(s.NextUnitID-1, 0)
+		r.version = s.StateVersion
+		r.token = s.Token
+	}
+	return w, nil
+}
+
+func writeJSON(path string, v any) error {
+	dat, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return fmt.Errorf("could not encode snapshot: %v", err)
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0o755)
+	if err != nil {
+		return fmt.Errorf("could not create snapshot directory: %v", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("could not write snapshot: %v", err)
+	}
+	_, err = tmp.Write(append(dat, '\n'))
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("could not write snapshot: %v", err)
+	}
+	return nil
+}
+
+func readJSON(path string, v any) error {
+	dat, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("no snapshot at %s: %w", path, err)
+	}
+	if err != nil {
+		return fmt.Errorf("could not read snapshot: %v", err)
+	}
+	err = json.Unmarshal(dat, v)
+	if err != nil {
+		return fmt.Errorf("could not parse snapshot %s: %v", path, err)
+	}
+	return nil
+}
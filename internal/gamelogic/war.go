@@ -103,3 +103,36 @@ func unitsToPowerLevel(units []Unit) int {
 	}
 	return power
 }
+
+// HandleWarResult reports a war the server fought. Lost units are taken
+// away by the StateDelta sent along with it.
+func (gs *GameState) HandleWarResult(wr WarResult) {
+	defer fmt.Println("------------------------")
+	fmt.Println()
+	fmt.Println("==== War Fought ====")
+	fmt.Printf("%s has declared war on %s in %s!\n", wr.Attacker, wr.Defender, wr.Location)
+	fmt.Printf("%s's units:\n", wr.Attacker)
+	for _, unit := range wr.AttackerUnits {
+		fmt.Printf("  * %v\n", unit.Rank)
+	}
+	fmt.Printf("%s's units:\n", wr.Defender)
+	for _, unit := range wr.DefenderUnits {
+		fmt.Printf("  * %v\n", unit.Rank)
+	}
+	fmt.Printf("Attacker has a power level of %v\n", unitsToPowerLevel(wr.AttackerUnits))
+	fmt.Printf("Defender has a power level of %v\n", unitsToPowerLevel(wr.DefenderUnits))
+
+	username := gs.GetUsername()
+	if wr.Winner == "" {
+		fmt.Println("The war ended in a draw!")
+		if username == wr.Attacker || username == wr.Defender {
+			fmt.Printf("Your units in %s have been killed.\n", wr.Location)
+		}
+		return
+	}
+	fmt.Printf("%s has won the war!\n", wr.Winner)
+	if username == wr.Loser {
+		fmt.Println("You have lost the war!")
+		fmt.Printf("Your units in %s have been killed.\n", wr.Location)
+	}
+}
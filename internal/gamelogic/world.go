@@ -0,0 +1,372 @@
+package gamelogic
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// World is the server's record of every player's units. Intents are checked
+// against it rather than against what clients claim to have.
+type World struct {
+	mu      sync.Mutex
+	players map[string]*playerRecord
+}
+
+type playerRecord struct {
+	units   map[int]Unit
+	nextID  int
+	version int
+	// token proves intents come from the player, empty until they join.
+	token string
+}
+
+func (r *playerRecord) clone() *playerRecord {
+	c := *r
+	c.units = make(map[int]Unit, len(r.units))
+	for id, u := range r.units {
+		c.units[id] = u
+	}
+	return &c
+}
+
+// MoveResult is everything a move changed: the move itself, the deltas of
+// the mover and of anyone they fought, and the wars.
+type MoveResult struct {
+	Move   ArmyMove
+	Deltas []StateDelta
+	Wars   []WarResult
+}
+
+// WorldSnapshot is a copy of a World to roll back to.
+type WorldSnapshot struct {
+	players map[string]*playerRecord
+}
+
+func NewWorld() *World {
+	return &World{
+		players: map[string]*playerRecord{},
+	}
+}
+
+func (w *World) record(username string) *playerRecord {
+	r, ok := w.players[username]
+	if !ok {
+		r = &playerRecord{units: map[int]Unit{}}
+		w.players[username] = r
+	}
+	return r
+}
+
+func (w *World) Snapshot() WorldSnapshot {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	s := WorldSnapshot{players: make(map[string]*playerRecord, len(w.players))}
+	for name, r := range w.players {
+		s.players[name] = r.clone()
+	}
+	return s
+}
+
+func (w *World) Restore(s WorldSnapshot) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.players = make(map[string]*playerRecord, len(s.players))
+	for name, r := range s.players {
+		w.players[name] = r.clone()
+	}
+}
+
+// Join claims username for whoever first joins with it, returning the token
+// their intents must carry. Joining again with that token returns it, and
+// a token given for an unclaimed username is kept, so a player whose claim
+// the world lost gets it back.
+func (w *World) Join(username, token string) (string, error) {
+	if username == "" {
+		return "", errors.New("a username is needed to join")
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	r := w.record(username)
+	if r.token == "" {
+		if token == "" {
+			b := make([]byte, 16)
+			_, err := rand.Read(b)
+			if err != nil {
+				return "", fmt.Errorf("could not make a token: %v", err)
+			}
+			token = hex.EncodeToString(b)
+		}
+		r.token = token
+		return token, nil
+	}
+	if !sameToken(r.token, token) {
+		return "", fmt.Errorf("%s was already claimed by another player", username)
+	}
+	return token, nil
+}
+
+// Authenticate checks that token is the one issued to username by Join.
+func (w *World) Authenticate(username, token string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	r, ok := w.players[username]
+	if !ok || r.token == "" {
+		return fmt.Errorf("%s has not joined the game", username)
+	}
+	if !sameToken(r.token, token) {
+		return fmt.Errorf("wrong token for %s", username)
+	}
+	return nil
+}
+
+func sameToken(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// State is every unit of the player, as a delta resetting theirs.
+func (w *World) State(username string) StateDelta {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	r := w.record(username)
+	return StateDelta{
+		Username: username,
+		Version:  r.version,
+		Units:    sortedUnits(r.units),
+		Reset:    true,
+	}
+}
+
+// States is every player's units, as deltas resetting theirs, sorted by
+// username.
+func (w *World) States() []StateDelta {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	names := make([]string, 0, len(w.players))
+	for name := range w.players {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	states := make([]StateDelta, 0, len(names))
+	for _, name := range names {
+		r := w.players[name]
+		states = append(states, StateDelta{
+			Username: name,
+			Version:  r.version,
+			Units:    sortedUnits(r.units),
+			Reset:    true,
+		})
+	}
+	return states
+}
+
+func (w *World) player(username string) Player {
+	r := w.record(username)
+	units := make(map[int]Unit, len(r.units))
+	for id, u := range r.units {
+		units[id] = u
+	}
+	return Player{Username: username, Units: units}
+}
+
+func (w *World) Spawn(username string, in SpawnIntent) (StateDelta, error) {
+	if _, ok := getAllLocations()[in.Location]; !ok {
+		return StateDelta{}, fmt.Errorf("%s is not a valid location", in.Location)
+	}
+	if _, ok := getAllRanks()[in.Rank]; !ok {
+		return StateDelta{}, fmt.Errorf("%s is not a valid unit", in.Rank)
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	r := w.record(username)
+	r.nextID++
+	u := Unit{ID: r.nextID, Rank: in.Rank, Location: in.Location}
+	r.units[u.ID] = u
+	r.version++
+	return StateDelta{Username: username, Version: r.version, Units: []Unit{u}}, nil
+}
+
+// Move moves the units and fights every other player found at the
+// destination, one after the other in order of username, until the mover
+// has no units left there.
+func (w *World) Move(username string, in MoveIntent) (MoveResult, error) {
+	if _, ok := getAllLocations()[in.ToLocation]; !ok {
+		return MoveResult{}, fmt.Errorf("%s is not a valid location", in.ToLocation)
+	}
+	if len(in.UnitIDs) == 0 {
+		return MoveResult{}, errors.New("no units to move")
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	r := w.record(username)
+	moved := []Unit{}
+	for _, id := range in.UnitIDs {
+		u, ok := r.units[id]
+		if !ok {
+			return MoveResult{}, fmt.Errorf("unit with ID %v not found", id)
+		}
+		err := DefaultMap().CheckMove(u, in.ToLocation)
+		if err != nil {
+			return MoveResult{}, err
+		}
+		u.Location = in.ToLocation
+		moved = append(moved, u)
+	}
+	for _, u := range moved {
+		r.units[u.ID] = u
+	}
+
+	res := MoveResult{
+		Move: ArmyMove{
+			Player:     w.player(username),
+			Units:      moved,
+			ToLocation: in.ToLocation,
+		},
+	}
+	deltas := map[string]*StateDelta{
+		username: {Username: username, Units: moved},
+	}
+	for _, defender := range w.opponentsAt(username, in.ToLocation) {
+		war := w.fight(username, defender, in.ToLocation)
+		if len(war.AttackerUnits) == 0 {
+			break
+		}
+		res.Wars = append(res.Wars, war)
+		for _, side := range []struct {
+			name  string
+			units []Unit
+		}{{username, war.AttackerUnits}, {defender, war.DefenderUnits}} {
+			if war.Winner == side.name {
+				continue
+			}
+			d, ok := deltas[side.name]
+			if !ok {
+				d = &StateDelta{Username: side.name}
+				deltas[side.name] = d
+			}
+			for _, u := range side.units {
+				d.Removed = append(d.Removed, u.ID)
+			}
+		}
+	}
+
+	names := make([]string, 0, len(deltas))
+	for name := range deltas {
+		names = append(names, name)
+	}
+	// The mover's delta first, as it is the one replied with.
+	sort.Slice(names, func(i, j int) bool {
+		if names[i] == username || names[j] == username {
+			return names[i] == username
+		}
+		return names[i] < names[j]
+	})
+	for _, name := range names {
+		rec := w.record(name)
+		rec.version++
+		d := deltas[name]
+		d.Version = rec.version
+		// Units moved and then killed in the same move are only removed.
+		d.Units = without(d.Units, d.Removed)
+		res.Deltas = append(res.Deltas, *d)
+	}
+	return res, nil
+}
+
+func (w *World) opponentsAt(username string, loc Location) []string {
+	names := []string{}
+	for name, r := range w.players {
+		if name == username {
+			continue
+		}
+		for _, u := range r.units {
+			if u.Location == loc {
+				names = append(names, name)
+				break
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// fight resolves a war at loc the way HandleWar does, removing the losing
+// side's units there, or both sides' on a draw.
+func (w *World) fight(attacker, defender string, loc Location) WarResult {
+	a, d := w.record(attacker), w.record(defender)
+	war := WarResult{
+		Attacker:      attacker,
+		Defender:      defender,
+		Location:      loc,
+		AttackerUnits: unitsAt(a.units, loc),
+		DefenderUnits: unitsAt(d.units, loc),
+	}
+	if len(war.AttackerUnits) == 0 {
+		return war
+	}
+
+	attackerPower := unitsToPowerLevel(war.AttackerUnits)
+	defenderPower := unitsToPowerLevel(war.DefenderUnits)
+	switch {
+	case attackerPower > defenderPower:
+		war.Winner, war.Loser = attacker, defender
+		removeUnitsAt(d.units, loc)
+	case defenderPower > attackerPower:
+		war.Winner, war.Loser = defender, attacker
+		removeUnitsAt(a.units, loc)
+	default:
+		removeUnitsAt(a.units, loc)
+		removeUnitsAt(d.units, loc)
+	}
+	return war
+}
+
+func unitsAt(units map[int]Unit, loc Location) []Unit {
+	at := []Unit{}
+	for _, u := range sortedUnits(units) {
+		if u.Location == loc {
+			at = append(at, u)
+		}
+	}
+	return at
+}
+
+func removeUnitsAt(units map[int]Unit, loc Location) {
+	for id, u := range units {
+		if u.Location == loc {
+			delete(units, id)
+		}
+	}
+}
+
+func sortedUnits(units map[int]Unit) []Unit {
+	sorted := make([]Unit, 0, len(units))
+	for _, u := range units {
+		sorted = append(sorted, u)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].ID < sorted[j].ID })
+	return sorted
+}
+
+func without(units []Unit, ids []int) []Unit {
+	kept := []Unit{}
+	for _, u := range units {
+		removed := false
+		for _, id := range ids {
+			if u.ID == id {
+				removed = true
+				break
+			}
+		}
+		if !removed {
+			kept = append(kept, u)
+		}
+	}
+	return kept
+}
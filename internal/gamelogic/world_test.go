@@ -0,0 +1,100 @@
+package gamelogic
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestWorldJoin(t *testing.T) {
+	w := NewWorld()
+	token, err := w.Join("alice", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token == "" {
+		t.Fatal("Join issued an empty token")
+	}
+
+	tests := []struct {
+		name     string
+		username string
+		token    string
+		wantErr  bool
+	}{
+		{"issued token", "alice", token, false},
+		{"no token", "alice", "", true},
+		{"other token", "alice", "not-" + token, true},
+		{"not joined", "bob", token, true},
+	}
+	for _, tt := range tests {
+		err := w.Authenticate(tt.username, tt.token)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: Authenticate(%s) = %v, want error %v", tt.name, tt.username, err, tt.wantErr)
+		}
+	}
+
+	// Claimed usernames can only be joined again with their token.
+	_, err = w.Join("alice", "")
+	if err == nil {
+		t.Error("joined as alice without her token")
+	}
+	again, err := w.Join("alice", token)
+	if err != nil || again != token {
+		t.Errorf("Join(alice, token) = %q, %v, want the same token", again, err)
+	}
+}
+
+func TestWorldJoinKeepsLostClaim(t *testing.T) {
+	w := NewWorld()
+	// A world restored from before the player joined keeps their token.
+	token, err := w.Join("alice", "issued-earlier")
+	if err != nil || token != "issued-earlier" {
+		t.Fatalf("Join = %q, %v, want the token given", token, err)
+	}
+	err = w.Authenticate("alice", "issued-earlier")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWorldTokenSurvivesSave(t *testing.T) {
+	w := NewWorld()
+	token, err := w.Join("alice", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "world.json")
+	err = SaveWorld(path, w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadWorld(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = loaded.Authenticate("alice", token)
+	if err != nil {
+		t.Errorf("token lost across save: %v", err)
+	}
+}
+
+func TestWorldRollbackKeepsTokens(t *testing.T) {
+	w := NewWorld()
+	token, err := w.Join("alice", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := w.Snapshot()
+	_, err = w.Spawn("alice", SpawnIntent{Location: "europe", Rank: RankInfantry})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Restore(before)
+	if got := w.State("alice"); len(got.Units) != 0 {
+		t.Errorf("units after rollback = %v, want none", got.Units)
+	}
+	err = w.Authenticate("alice", token)
+	if err != nil {
+		t.Errorf("token lost on rollback: %v", err)
+	}
+}
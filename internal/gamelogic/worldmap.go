@@ -0,0 +1,146 @@
+package gamelogic
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Edge connects two regions of the map both ways. Cost is how much of a
+// unit's range crossing it takes.
+type Edge struct {
+	From Location
+	To   Location
+	Cost int
+}
+
+// Map is the graph of regions units move across. A unit can move to any
+// region along a path costing no more than its range.
+type Map struct {
+	edges map[Location]map[Location]int
+}
+
+// defaultMap is the world Peril is played on. Crossing an ocean costs more
+// than crossing land.
+var defaultMap = NewMap([]Edge{
+	{"americas", "europe", 2},
+	{"americas", "africa", 2},
+	{"americas", "asia", 2},
+	{"americas", "antarctica", 2},
+	{"europe", "africa", 1},
+	{"europe", "asia", 1},
+	{"africa", "asia", 1},
+	{"asia", "australia", 1},
+	{"australia", "antarctica", 2},
+})
+
+// NewMap builds a map from its edges, an edge without a cost costing 1.
+func NewMap(edges []Edge) *Map {
+	m := &Map{edges: map[Location]map[Location]int{}}
+	for _, e := range edges {
+		cost := max(e.Cost, 1)
+		m.connect(e.From, e.To, cost)
+		m.connect(e.To, e.From, cost)
+	}
+	return m
+}
+
+func (m *Map) connect(from, to Location, cost int) {
+	if m.edges[from] == nil {
+		m.edges[from] = map[Location]int{}
+	}
+	m.edges[from][to] = cost
+}
+
+func DefaultMap() *Map {
+	return defaultMap
+}
+
+// Regions lists the regions in alphabetical order.
+func (m *Map) Regions() []Location {
+	regions := make([]Location, 0, len(m.edges))
+	for loc := range m.edges {
+		regions = append(regions, loc)
+	}
+	sort.Slice(regions, func(i, j int) bool { return regions[i] < regions[j] })
+	return regions
+}
+
+func (m *Map) HasRegion(loc Location) bool {
+	_, ok := m.edges[loc]
+	return ok
+}
+
+// Neighbors lists the edges leaving loc in alphabetical order of where they
+// lead.
+func (m *Map) Neighbors(loc Location) []Edge {
+	edges := make([]Edge, 0, len(m.edges[loc]))
+	for to, cost := range m.edges[loc] {
+		edges = append(edges, Edge{From: loc, To: to, Cost: cost})
+	}
+	sort.Slice(edges, func(i, j int) bool { return edges[i].To < edges[j].To })
+	return edges
+}
+
+func (m *Map) Adjacent(from, to Location) bool {
+	_, ok := m.edges[from][to]
+	return ok
+}
+
+// Distance is the cost of the cheapest path between two regions, false
+// when there is none.
+func (m *Map) Distance(from, to Location) (int, bool) {
+	if !m.HasRegion(from) || !m.HasRegion(to) {
+		return 0, false
+	}
+	dist := map[Location]int{from: 0}
+	done := map[Location]bool{}
+	for {
+		var next Location
+		found := false
+		for loc, d := range dist {
+			if !done[loc] && (!found || d < dist[next] || d == dist[next] && loc < next) {
+				next, found = loc, true
+			}
+		}
+		if !found {
+			return 0, false
+		}
+		if next == to {
+			return dist[next], true
+		}
+		done[next] = true
+		for neighbor, cost := range m.edges[next] {
+			d, ok := dist[neighbor]
+			if !ok || dist[next]+cost < d {
+				dist[neighbor] = dist[next] + cost
+			}
+		}
+	}
+}
+
+// CheckMove returns an error when the unit cannot reach to in one move.
+func (m *Map) CheckMove(u Unit, to Location) error {
+	if !m.HasRegion(to) {
+		return fmt.Errorf("%s is not a valid location", to)
+	}
+	cost, ok := m.Distance(u.Location, to)
+	if !ok {
+		return fmt.Errorf("unit with ID %v can not reach %s from %s", u.ID, to, u.Location)
+	}
+	if cost > rankRange(u.Rank) {
+		return fmt.Errorf("unit with ID %v can not reach %s from %s: it takes %v, a(n) %s can travel %v",
+			u.ID, to, u.Location, cost, u.Rank, rankRange(u.Rank))
+	}
+	return nil
+}
+
+// rankRange is the cost of the longest path a unit of the rank can travel
+// in one move.
+func rankRange(rank UnitRank) int {
+	switch rank {
+	case RankCavalry:
+		return 3
+	default:
+		return 2
+	}
+}
@@ -0,0 +1,110 @@
+package gamelogic
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestAdjacent(t *testing.T) {
+	m := DefaultMap()
+	tests := []struct {
+		from, to Location
+		want     bool
+	}{
+		{"europe", "asia", true},
+		{"asia", "europe", true},
+		{"americas", "antarctica", true},
+		{"europe", "australia", false},
+		{"africa", "antarctica", false},
+		{"europe", "europe", false},
+		{"europe", "atlantis", false},
+	}
+	for _, tt := range tests {
+		if got := m.Adjacent(tt.from, tt.to); got != tt.want {
+			t.Errorf("Adjacent(%s, %s) = %v, want %v", tt.from, tt.to, got, tt.want)
+		}
+	}
+}
+
+func TestDistance(t *testing.T) {
+	m := DefaultMap()
+	tests := []struct {
+		from, to Location
+		want     int
+		wantOK   bool
+	}{
+		{"europe", "europe", 0, true},
+		{"europe", "asia", 1, true},
+		{"americas", "europe", 2, true},
+		{"europe", "australia", 2, true},
+		// Over asia rather than antarctica, which costs 4.
+		{"americas", "australia", 3, true},
+		{"australia", "americas", 3, true},
+		{"europe", "antarctica", 4, true},
+		{"africa", "antarctica", 4, true},
+		{"atlantis", "europe", 0, false},
+		{"europe", "atlantis", 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := m.Distance(tt.from, tt.to)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("Distance(%s, %s) = %v, %v, want %v, %v", tt.from, tt.to, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func TestDistanceDisconnected(t *testing.T) {
+	m := NewMap([]Edge{
+		{From: "europe", To: "asia"},
+		{From: "americas", To: "antarctica", Cost: 3},
+	})
+	if d, ok := m.Distance("europe", "asia"); d != 1 || !ok {
+		t.Errorf("Distance over an edge without a cost = %v, %v, want 1, true", d, ok)
+	}
+	if d, ok := m.Distance("europe", "antarctica"); ok {
+		t.Errorf("Distance between unconnected regions = %v, true, want false", d)
+	}
+	want := []Location{"americas", "antarctica", "asia", "europe"}
+	if got := m.Regions(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Regions = %v, want %v", got, want)
+	}
+}
+
+func TestCheckMove(t *testing.T) {
+	m := DefaultMap()
+	unit := func(rank UnitRank, loc Location) Unit {
+		return Unit{ID: 1, Rank: rank, Location: loc}
+	}
+	tests := []struct {
+		name    string
+		unit    Unit
+		to      Location
+		wantErr string
+	}{
+		{"stay", unit(RankInfantry, "europe"), "europe", ""},
+		{"infantry to a neighbor", unit(RankInfantry, "europe"), "asia", ""},
+		{"infantry across an ocean", unit(RankInfantry, "americas"), "europe", ""},
+		{"infantry two steps", unit(RankInfantry, "europe"), "australia", ""},
+		{"infantry out of range", unit(RankInfantry, "americas"), "australia", "it takes 3, a(n) infantry can travel 2"},
+		{"artillery out of range", unit(RankArtillery, "americas"), "australia", "it takes 3, a(n) artillery can travel 2"},
+		{"cavalry in range", unit(RankCavalry, "americas"), "australia", ""},
+		{"cavalry out of range", unit(RankCavalry, "europe"), "antarctica", "it takes 4, a(n) cavalry can travel 3"},
+		{"unknown destination", unit(RankCavalry, "europe"), "atlantis", "atlantis is not a valid location"},
+		{"unknown origin", unit(RankCavalry, "atlantis"), "europe", "can not reach europe from atlantis"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := m.CheckMove(tt.unit, tt.to)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("CheckMove = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("CheckMove = %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,173 @@
+package gateway
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	writeTimeout = 10 * time.Second
+	// keepAlive is how often idle connections are pinged, which also spots
+	// spectators that went away without saying so.
+	keepAlive = 30 * time.Second
+	pongWait  = 2 * keepAlive
+)
+
+// Subscribe is what a WebSocket spectator sends to change its routing key
+// filters, e.g. {"keys": ["war.*"]}. An empty list asks for every event.
+type Subscribe struct {
+	Keys []string `json:"keys"`
+}
+
+// Handler serves the event streams:
+//
+//	GET /ws?keys=army_moves.*,war.*   WebSocket, one JSON Event per message
+//	GET /events?keys=game_logs.*      Server-Sent Events named after the kind
+//
+// keys are topic binding patterns matched against routing keys, every event
+// being sent without them. Browsers are let in from the given origins, "*"
+// meaning any, and only from the gateway's own origin when none are given.
+func Handler(h *Hub, origins []string) http.Handler {
+	upgrader := websocket.Upgrader{}
+	if len(origins) > 0 {
+		upgrader.CheckOrigin = func(r *http.Request) bool {
+			origin := r.Header.Get("Origin")
+			return origin == "" || slices.Contains(origins, "*") || slices.Contains(origins, origin)
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /ws", func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			// Upgrade already replied with the error.
+			return
+		}
+		serveWebSocket(h, conn, parseKeys(r))
+	})
+	mux.HandleFunc("GET /events", func(w http.ResponseWriter, r *http.Request) {
+		serveSSE(h, w, r)
+	})
+	return mux
+}
+
+func parseKeys(r *http.Request) []string {
+	var keys []string
+	for _, k := range strings.Split(r.URL.Query().Get("keys"), ",") {
+		k = strings.TrimSpace(k)
+		if k != "" {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+func serveWebSocket(h *Hub, conn *websocket.Conn, keys []string) {
+	defer conn.Close()
+	c := h.join(keys)
+	defer h.leave(c)
+
+	// The reader only handles filter changes and pongs, and notices the
+	// connection closing.
+	closed := make(chan struct{})
+	conn.SetReadDeadline(time.Now().Add(pongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+	go func() {
+		defer close(closed)
+		for {
+			var sub Subscribe
+			err := conn.ReadJSON(&sub)
+			if err != nil {
+				var syntaxErr *json.SyntaxError
+				var typeErr *json.UnmarshalTypeError
+				if errors.As(err, &syntaxErr) || errors.As(err, &typeErr) {
+					continue
+				}
+				return
+			}
+			c.setFilters(sub.Keys)
+		}
+	}()
+
+	ping := time.NewTicker(keepAlive)
+	defer ping.Stop()
+	for {
+		select {
+		case e := <-c.events:
+			conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+			err := conn.WriteJSON(e)
+			if err != nil {
+				return
+			}
+		case <-ping.C:
+			err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeTimeout))
+			if err != nil {
+				return
+			}
+		case <-c.dropped:
+			conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "too far behind"),
+				time.Now().Add(writeTimeout))
+			return
+		case <-closed:
+			return
+		}
+	}
+}
+
+func serveSSE(h *Hub, w http.ResponseWriter, r *http.Request) {
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	err := rc.Flush()
+	if err != nil {
+		log.Printf("could not stream events: %v", err)
+		return
+	}
+
+	c := h.join(parseKeys(r))
+	defer h.leave(c)
+
+	ping := time.NewTicker(keepAlive)
+	defer ping.Stop()
+	for {
+		select {
+		case e := <-c.events:
+			dat, err := json.Marshal(e)
+			if err != nil {
+				continue
+			}
+			_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Kind, dat)
+			if err == nil {
+				err = rc.Flush()
+			}
+			if err != nil {
+				return
+			}
+		case <-ping.C:
+			// Comments keep proxies from timing the stream out.
+			_, err := fmt.Fprint(w, ": ping\n\n")
+			if err == nil {
+				err = rc.Flush()
+			}
+			if err != nil {
+				return
+			}
+		case <-c.dropped:
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package gateway
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/gabrieldiem/learn-pub-sub-starter/internal/gamelogic"
+	"github.com/gabrieldiem/learn-pub-sub-starter/internal/pubsub"
+	"github.com/gabrieldiem/learn-pub-sub-starter/internal/routing"
+)
+
+func serve(t *testing.T, h *Hub, origins []string) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(Handler(h, origins))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func dial(t *testing.T, srv *httptest.Server, path string, header http.Header) (*websocket.Conn, *http.Response, error) {
+	t.Helper()
+	return websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+path, header)
+}
+
+func readEvent(t *testing.T, conn *websocket.Conn) Event {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(testTimeout))
+	var e Event
+	err := conn.ReadJSON(&e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func TestSSE(t *testing.T) {
+	b, h := startHub(t)
+	srv := serve(t, h, nil)
+
+	resp, err := http.Get(srv.URL + "/events?keys=" + routing.GameLogSlug + ".*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("Content-Type = %q, want text/event-stream", ct)
+	}
+	waitForClients(t, h, 1)
+
+	// Filtered out.
+	err = pubsub.Publish(b, routing.ExchangePerilTopic, routing.ArmyMovesPrefix+".alice", gamelogic.ArmyMove{ToLocation: "asia"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	log := routing.GameLog{Message: "alice won", Username: "alice"}
+	err = pubsub.Publish(b, routing.ExchangePerilTopic, routing.GameLogSlug+".alice", log, pubsub.WithSender("alice"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := make(chan string)
+	go func() {
+		s := bufio.NewScanner(resp.Body)
+		for s.Scan() {
+			lines <- s.Text()
+		}
+		close(lines)
+	}()
+	var frame []string
+	for len(frame) < 3 {
+		select {
+		case l, ok := <-lines:
+			if !ok {
+				t.Fatalf("stream ended after %q", frame)
+			}
+			frame = append(frame, l)
+		case <-time.After(testTimeout):
+			t.Fatalf("got %q, want a whole event", frame)
+		}
+	}
+	if frame[0] != "event: "+KindGameLog {
+		t.Errorf("event line = %q, want %q", frame[0], "event: "+KindGameLog)
+	}
+	if frame[2] != "" {
+		t.Errorf("event ends with %q, want an empty line", frame[2])
+	}
+	data, ok := strings.CutPrefix(frame[1], "data: ")
+	if !ok {
+		t.Fatalf("data line = %q", frame[1])
+	}
+	var e Event
+	err = json.Unmarshal([]byte(data), &e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got routing.GameLog
+	err = json.Unmarshal(e.Data, &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Kind != KindGameLog || e.Key != routing.GameLogSlug+".alice" || e.Sender != "alice" || got.Message != log.Message {
+		t.Errorf("got %+v with %+v", e, got)
+	}
+}
+
+func TestWebSocket(t *testing.T) {
+	b, h := startHub(t)
+	srv := serve(t, h, nil)
+
+	conn, _, err := dial(t, srv, "/ws?keys="+routing.WarRecognitionsPrefix+".*", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	waitForClients(t, h, 1)
+
+	move := func() {
+		err := pubsub.Publish(b, routing.ExchangePerilTopic, routing.ArmyMovesPrefix+".alice", gamelogic.ArmyMove{ToLocation: "asia"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	war := func() {
+		err := pubsub.Publish(b, routing.ExchangePerilTopic, routing.WarRecognitionsPrefix+".alice", gamelogic.RecognitionOfWar{})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	move()
+	war()
+	if e := readEvent(t, conn); e.Kind != KindWar {
+		t.Errorf("got a %s, want the war", e.Kind)
+	}
+
+	// Spectators change their filters by sending them.
+	err = conn.WriteJSON(Subscribe{Keys: []string{routing.ArmyMovesPrefix + ".*"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := onlyClient(t, h)
+	deadline := time.Now().Add(testTimeout)
+	for c.wants(routing.WarRecognitionsPrefix+".alice") && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	war()
+	move()
+	if e := readEvent(t, conn); e.Kind != KindArmyMove {
+		t.Errorf("got a %s, want the move", e.Kind)
+	}
+
+	conn.Close()
+	waitForClients(t, h, 0)
+}
+
+func TestWebSocketDroppedWhenBehind(t *testing.T) {
+	_, h := startHub(t)
+	srv := serve(t, h, nil)
+
+	conn, _, err := dial(t, srv, "/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	waitForClients(t, h, 1)
+	c := onlyClient(t, h)
+
+	// Without reading, the connection backs up and then the spectator's
+	// buffer fills.
+	big := Event{Kind: KindGameLog, Data: json.RawMessage(`"` + strings.Repeat("x", 64<<10) + `"`)}
+	deadline := time.Now().Add(testTimeout)
+	for dropped := false; !dropped; {
+		select {
+		case <-c.dropped:
+			dropped = true
+		default:
+			if time.Now().After(deadline) {
+				t.Fatal("spectator was not dropped")
+			}
+			h.broadcast(big)
+		}
+	}
+
+	conn.SetReadDeadline(time.Now().Add(testTimeout))
+	for {
+		_, _, err := conn.ReadMessage()
+		if err == nil {
+			continue
+		}
+		if !websocket.IsCloseError(err, websocket.CloseTryAgainLater) {
+			t.Fatalf("connection ended with %v, want close code %d", err, websocket.CloseTryAgainLater)
+		}
+		return
+	}
+}
+
+func TestWebSocketOrigins(t *testing.T) {
+	_, h := startHub(t)
+	tests := []struct {
+		name    string
+		origins []string
+		origin  string
+		want    bool
+	}{
+		{"same origin by default", nil, "", true},
+		{"other origin by default", nil, "https://evil.example", false},
+		{"allowed origin", []string{"https://peril.example"}, "https://peril.example", true},
+		{"other origin", []string{"https://peril.example"}, "https://evil.example", false},
+		{"any origin", []string{"*"}, "https://evil.example", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := serve(t, h, tt.origins)
+			header := http.Header{}
+			if tt.origin != "" {
+				header.Set("Origin", tt.origin)
+			}
+			conn, resp, err := dial(t, srv, "/ws", header)
+			if tt.want {
+				if err != nil {
+					t.Fatalf("could not connect: %v", err)
+				}
+				conn.Close()
+				return
+			}
+			if err == nil {
+				conn.Close()
+				t.Fatal("connected from a forbidden origin")
+			}
+			if resp == nil || resp.StatusCode != http.StatusForbidden {
+				t.Errorf("got %v, want 403 Forbidden", err)
+			}
+		})
+	}
+}
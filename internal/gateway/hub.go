@@ -0,0 +1,196 @@
+// Package gateway streams the game's messages to browsers over WebSocket and
+// Server-Sent Events.
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/gabrieldiem/learn-pub-sub-starter/internal/gamelogic"
+	"github.com/gabrieldiem/learn-pub-sub-starter/internal/pubsub"
+	"github.com/gabrieldiem/learn-pub-sub-starter/internal/routing"
+)
+
+// QueuePrefix names the transient queues the gateway reads RabbitMQ from.
+const QueuePrefix = "peril_gateway"
+
+// Event is what a spectator receives for every message, Data holding the
+// message as its Go type marshals to JSON.
+type Event struct {
+	Kind      string          `json:"kind"`
+	Key       string          `json:"key"`
+	Sender    string          `json:"sender,omitempty"`
+	Timestamp time.Time       `json:"timestamp"`
+	Data      json.RawMessage `json:"data"`
+}
+
+const (
+	KindArmyMove = "army_move"
+	KindWar      = "war"
+	KindPause    = "pause"
+	KindGameLog  = "game_log"
+	// Intents players send the server, and what the server made of them.
+	KindSpawn     = "spawn"
+	KindMove      = "move"
+	KindGetState  = "get_state"
+	KindDelta     = "delta"
+	KindWarResult = "war_result"
+)
+
+// stream subscribes the hub to one kind of message.
+type stream func(h *Hub, id string) (*pubsub.Subscription, error)
+
+func streamOf[T any](kind, exchange, pattern string) stream {
+	return func(h *Hub, id string) (*pubsub.Subscription, error) {
+		return pubsub.Subscribe(
+			h.broker,
+			exchange,
+			QueuePrefix+"."+kind+"."+id,
+			pattern,
+			pubsub.SimpleQueueTransient,
+			func(ctx context.Context, d pubsub.Delivery[T]) pubsub.Acktype {
+				dat, err := json.Marshal(d.Value)
+				if err != nil {
+					return pubsub.NackDiscard
+				}
+				h.broadcast(Event{
+					Kind:      kind,
+					Key:       d.RoutingKey,
+					Sender:    d.Sender,
+					Timestamp: d.Timestamp,
+					Data:      dat,
+				})
+				return pubsub.Ack
+			},
+		)
+	}
+}
+
+var streams = []stream{
+	streamOf[gamelogic.ArmyMove](KindArmyMove, routing.ExchangePerilTopic, routing.ArmyMovesPrefix+".*"),
+	streamOf[gamelogic.RecognitionOfWar](KindWar, routing.ExchangePerilTopic, routing.WarRecognitionsPrefix+".*"),
+	streamOf[routing.PlayingState](KindPause, routing.ExchangePerilDirect, routing.PauseKey),
+	streamOf[routing.GameLog](KindGameLog, routing.ExchangePerilTopic, routing.GameLogSlug+".*"),
+	// Only the bodies are streamed, never the tokens intents carry.
+	streamOf[gamelogic.SpawnIntent](KindSpawn, routing.ExchangePerilDirect, routing.SpawnKey),
+	streamOf[gamelogic.MoveIntent](KindMove, routing.ExchangePerilDirect, routing.MoveKey),
+	streamOf[routing.GetState](KindGetState, routing.ExchangePerilDirect, routing.GetStateKey),
+	streamOf[gamelogic.StateDelta](KindDelta, routing.ExchangePerilTopic, routing.StateDeltasPrefix+".*"),
+	streamOf[gamelogic.WarResult](KindWarResult, routing.ExchangePerilTopic, routing.WarResultsPrefix+".*"),
+}
+
+// clientBuffer is how many events a spectator may fall behind before it is
+// disconnected, so one slow browser does not hold up the others.
+const clientBuffer = 64
+
+// Hub fans the game's messages out to connected spectators.
+type Hub struct {
+	broker pubsub.Broker
+	subs   []*pubsub.Subscription
+
+	mu      sync.Mutex
+	clients map[*client]struct{}
+}
+
+type client struct {
+	events chan Event
+	// dropped is closed when the client fell too far behind.
+	dropped chan struct{}
+
+	mu      sync.Mutex
+	filters []string
+}
+
+// NewHub subscribes to moves, wars, pauses, game logs, intents, deltas and
+// war results on b.
+func NewHub(b pubsub.Broker) (*Hub, error) {
+	h := &Hub{
+		broker:  b,
+		clients: map[*client]struct{}{},
+	}
+	id := uuid.NewString()[:8]
+	for _, s := range streams {
+		sub, err := s(h, id)
+		if err != nil {
+			h.Close(context.Background())
+			return nil, fmt.Errorf("could not subscribe: %v", err)
+		}
+		h.subs = append(h.subs, sub)
+	}
+	return h, nil
+}
+
+func (h *Hub) join(filters []string) *client {
+	c := &client{
+		events:  make(chan Event, clientBuffer),
+		dropped: make(chan struct{}),
+		filters: filters,
+	}
+	h.mu.Lock()
+	h.clients[c] = struct{}{}
+	h.mu.Unlock()
+	return c
+}
+
+func (h *Hub) leave(c *client) {
+	h.mu.Lock()
+	delete(h.clients, c)
+	h.mu.Unlock()
+}
+
+func (h *Hub) broadcast(e Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for c := range h.clients {
+		if !c.wants(e.Key) {
+			continue
+		}
+		select {
+		case c.events <- e:
+		default:
+			delete(h.clients, c)
+			close(c.dropped)
+		}
+	}
+}
+
+// setFilters replaces the routing key filters, no filters meaning every
+// event.
+func (c *client) setFilters(filters []string) {
+	c.mu.Lock()
+	c.filters = filters
+	c.mu.Unlock()
+}
+
+func (c *client) wants(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.filters) == 0 {
+		return true
+	}
+	for _, f := range c.filters {
+		if pubsub.MatchTopic(f, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// Close stops the subscriptions. Connected spectators stay connected until
+// their requests are cancelled.
+func (h *Hub) Close(ctx context.Context) error {
+	var errs []error
+	for _, sub := range h.subs {
+		err := sub.Close(ctx)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
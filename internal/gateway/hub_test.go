@@ -0,0 +1,162 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gabrieldiem/learn-pub-sub-starter/internal/gamelogic"
+	"github.com/gabrieldiem/learn-pub-sub-starter/internal/pubsub"
+	"github.com/gabrieldiem/learn-pub-sub-starter/internal/routing"
+	"github.com/gabrieldiem/learn-pub-sub-starter/internal/topology"
+)
+
+const testTimeout = 2 * time.Second
+
+func startHub(t *testing.T) (*pubsub.MemoryBroker, *Hub) {
+	t.Helper()
+	b := pubsub.NewMemoryBroker()
+	err := topology.Apply(b, topology.Peril())
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := NewHub(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		h.Close(context.Background())
+		b.Close()
+	})
+	return b, h
+}
+
+// waitForClients waits until n spectators joined h, as they do a moment
+// after their request is answered.
+func waitForClients(t *testing.T, h *Hub, n int) {
+	t.Helper()
+	deadline := time.Now().Add(testTimeout)
+	for {
+		h.mu.Lock()
+		joined := len(h.clients)
+		h.mu.Unlock()
+		if joined == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d spectators joined, want %d", joined, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func onlyClient(t *testing.T, h *Hub) *client {
+	t.Helper()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.clients) != 1 {
+		t.Fatalf("%d spectators joined, want 1", len(h.clients))
+	}
+	for c := range h.clients {
+		return c
+	}
+	return nil
+}
+
+func nextEvent(t *testing.T, c *client) Event {
+	t.Helper()
+	select {
+	case e := <-c.events:
+		return e
+	case <-time.After(testTimeout):
+		t.Fatal("no event")
+		return Event{}
+	}
+}
+
+func TestHubNeverStreamsTokens(t *testing.T) {
+	b, h := startHub(t)
+	c := h.join(nil)
+	defer h.leave(c)
+
+	intent := gamelogic.SpawnIntent{Location: "europe", Rank: gamelogic.RankInfantry}
+	err := pubsub.Publish(b, routing.ExchangePerilDirect, routing.SpawnKey, intent,
+		pubsub.WithSender("alice"),
+		pubsub.WithHeader(routing.HeaderToken, "s3cret"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := nextEvent(t, c)
+	if e.Kind != KindSpawn || e.Key != routing.SpawnKey || e.Sender != "alice" {
+		t.Errorf("got %s %s from %q, want a spawn from alice", e.Kind, e.Key, e.Sender)
+	}
+	var got gamelogic.SpawnIntent
+	err = json.Unmarshal(e.Data, &got)
+	if err != nil || got != intent {
+		t.Errorf("data = %s (%v), want %+v", e.Data, err, intent)
+	}
+	dat, err := json.Marshal(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(dat), "s3cret") {
+		t.Errorf("event %s carries the token", dat)
+	}
+}
+
+func TestHubFilters(t *testing.T) {
+	tests := []struct {
+		filters []string
+		key     string
+		want    bool
+	}{
+		{nil, "war.alice", true},
+		{[]string{"war.*"}, "war.alice", true},
+		{[]string{"war.*"}, "army_moves.alice", false},
+		{[]string{"army_moves.*", "game_logs.#"}, "game_logs.alice", true},
+		{[]string{"army_moves.bob"}, "army_moves.alice", false},
+	}
+	for _, tt := range tests {
+		c := &client{filters: tt.filters}
+		if got := c.wants(tt.key); got != tt.want {
+			t.Errorf("%v wants %s = %v, want %v", tt.filters, tt.key, got, tt.want)
+		}
+	}
+}
+
+// TestHubDropsSlowClients checks a spectator that stops reading is dropped
+// once its buffer is full, without holding up the others.
+func TestHubDropsSlowClients(t *testing.T) {
+	_, h := startHub(t)
+	slow := h.join(nil)
+	fast := h.join(nil)
+	defer h.leave(fast)
+
+	for i := range clientBuffer + 1 {
+		h.broadcast(Event{Kind: KindGameLog, Key: "game_logs.alice"})
+		if i < clientBuffer {
+			nextEvent(t, fast)
+		}
+	}
+	select {
+	case <-slow.dropped:
+	default:
+		t.Fatal("slow spectator was not dropped")
+	}
+	nextEvent(t, fast)
+	select {
+	case <-fast.dropped:
+		t.Fatal("fast spectator was dropped")
+	default:
+	}
+	waitForClients(t, h, 1)
+
+	// Broadcasting on without the slow spectator does not close its
+	// channel twice.
+	h.broadcast(Event{Kind: KindGameLog, Key: "game_logs.alice"})
+	nextEvent(t, fast)
+}
@@ -0,0 +1,170 @@
+// Package history records the events that changed the game in an
+// append-only log, for games to be rebuilt and replayed later.
+package history
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gabrieldiem/learn-pub-sub-starter/internal/gamelogic"
+)
+
+var ErrClosed = errors.New("history is closed")
+
+// CorruptError is returned by Read, along with the events it could decode,
+// when some lines of the log could not be, such as the torn one a crash
+// halfway through a write leaves.
+type CorruptError struct {
+	Path string
+	// Lines are the skipped lines, counting from 1, and Err the error of
+	// the first one.
+	Lines []int
+	Err   error
+}
+
+func (e *CorruptError) Error() string {
+	return fmt.Sprintf("skipped %d undecodable line(s) of history %s, first line %d: %v", len(e.Lines), e.Path, e.Lines[0], e.Err)
+}
+
+func (e *CorruptError) Unwrap() error {
+	return e.Err
+}
+
+type Log struct {
+	mu     sync.Mutex
+	f      *os.File
+	seq    int
+	closed bool
+}
+
+// Open opens the log at path for appending, creating it if needed. Events
+// are numbered on from the last one already in it.
+func Open(path string) (*Log, error) {
+	events, err := Read(path)
+	var corrupt *CorruptError
+	if err != nil && !errors.Is(err, os.ErrNotExist) && !errors.As(err, &corrupt) {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("could not open history: %v", err)
+	}
+	// Start on a line of its own after a torn one.
+	torn, err := tornEnd(path)
+	if err == nil && torn {
+		_, err = f.Write([]byte{'\n'})
+	}
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("could not open history: %v", err)
+	}
+	l := &Log{f: f}
+	if len(events) > 0 {
+		l.seq = events[len(events)-1].Seq
+	}
+	return l, nil
+}
+
+// Append numbers the events and writes them at the end of the log, timing
+// those that are not yet.
+func (l *Log) Append(events ...gamelogic.Event) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return ErrClosed
+	}
+	buf := []byte{}
+	for _, e := range events {
+		l.seq++
+		e.Seq = l.seq
+		if e.Time.IsZero() {
+			e.Time = time.Now()
+		}
+		dat, err := json.Marshal(e)
+		if err != nil {
+			return fmt.Errorf("could not encode event: %v", err)
+		}
+		buf = append(append(buf, dat...), '\n')
+	}
+	_, err := l.f.Write(buf)
+	if err != nil {
+		return fmt.Errorf("could not write history: %v", err)
+	}
+	return nil
+}
+
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return nil
+	}
+	l.closed = true
+	return l.f.Close()
+}
+
+// tornEnd reports whether the file at path does not end with a newline.
+func tornEnd(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil || info.Size() == 0 {
+		return false, err
+	}
+	last := make([]byte, 1)
+	_, err = f.ReadAt(last, info.Size()-1)
+	if err != nil {
+		return false, err
+	}
+	return last[0] != '\n', nil
+}
+
+// Read returns every event in the log at path, in order. The error wraps
+// os.ErrNotExist when there is no log, and is a *CorruptError when lines
+// were skipped.
+func Read(path string) ([]gamelogic.Event, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("no history at %s: %w", path, err)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not open history: %v", err)
+	}
+	defer f.Close()
+
+	events := []gamelogic.Event{}
+	var corrupt *CorruptError
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 16<<20)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var e gamelogic.Event
+		err := json.Unmarshal(scanner.Bytes(), &e)
+		if err != nil {
+			if corrupt == nil {
+				corrupt = &CorruptError{Path: path, Err: err}
+			}
+			corrupt.Lines = append(corrupt.Lines, line)
+			continue
+		}
+		events = append(events, e)
+	}
+	err = scanner.Err()
+	if err != nil {
+		return nil, fmt.Errorf("could not read history: %v", err)
+	}
+	if corrupt != nil {
+		return events, corrupt
+	}
+	return events, nil
+}
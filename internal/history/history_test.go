@@ -0,0 +1,166 @@
+package history
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/gabrieldiem/learn-pub-sub-starter/internal/gamelogic"
+)
+
+func kinds(events []gamelogic.Event) []gamelogic.EventKind {
+	ks := []gamelogic.EventKind{}
+	for _, e := range events {
+		ks = append(ks, e.Kind)
+	}
+	return ks
+}
+
+func seqs(events []gamelogic.Event) []int {
+	ss := []int{}
+	for _, e := range events {
+		ss = append(ss, e.Seq)
+	}
+	return ss
+}
+
+func TestAppendAndRead(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.jsonl")
+	l, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unit := gamelogic.Unit{ID: 1, Rank: gamelogic.RankInfantry, Location: "europe"}
+	err = l.Append(
+		gamelogic.Event{Kind: gamelogic.EventSpawn, Username: "alice", Unit: &unit},
+		gamelogic.Event{Kind: gamelogic.EventPause},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = l.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Append(gamelogic.Event{Kind: gamelogic.EventResume}); !errors.Is(err, ErrClosed) {
+		t.Errorf("Append after Close = %v, want ErrClosed", err)
+	}
+
+	// Reopening numbers on from the last event.
+	l, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	err = l.Append(gamelogic.Event{Kind: gamelogic.EventResume})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events, err := Read(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantKinds := []gamelogic.EventKind{gamelogic.EventSpawn, gamelogic.EventPause, gamelogic.EventResume}
+	if !reflect.DeepEqual(kinds(events), wantKinds) {
+		t.Errorf("kinds = %v, want %v", kinds(events), wantKinds)
+	}
+	if !reflect.DeepEqual(seqs(events), []int{1, 2, 3}) {
+		t.Errorf("seqs = %v, want [1 2 3]", seqs(events))
+	}
+	if events[0].Time.IsZero() {
+		t.Error("event was not timed")
+	}
+	if events[0].Unit == nil || *events[0].Unit != unit {
+		t.Errorf("unit = %v, want %v", events[0].Unit, unit)
+	}
+}
+
+// TestReadSkipsTornLine checks the events around a torn line are read and the
+// line reported, Open appending after it.
+func TestReadSkipsTornLine(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.jsonl")
+	l, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = l.Append(gamelogic.Event{Kind: gamelogic.EventPause})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+
+	// A crash halfway through writing the next event.
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.WriteString(`{"seq":2,"kind":"res`)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = l.Append(gamelogic.Event{Kind: gamelogic.EventResume})
+	l.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events, err := Read(path)
+	var corrupt *CorruptError
+	if !errors.As(err, &corrupt) {
+		t.Fatalf("Read = %v, want a *CorruptError", err)
+	}
+	if corrupt.Path != path || !reflect.DeepEqual(corrupt.Lines, []int{2}) {
+		t.Errorf("skipped lines %v of %s, want [2] of %s", corrupt.Lines, corrupt.Path, path)
+	}
+	if !reflect.DeepEqual(seqs(events), []int{1, 2}) {
+		t.Errorf("seqs = %v, want [1 2]", seqs(events))
+	}
+	wantKinds := []gamelogic.EventKind{gamelogic.EventPause, gamelogic.EventResume}
+	if !reflect.DeepEqual(kinds(events), wantKinds) {
+		t.Errorf("kinds = %v, want %v", kinds(events), wantKinds)
+	}
+}
+
+func TestReadMissing(t *testing.T) {
+	_, err := Read(filepath.Join(t.TempDir(), "missing.jsonl"))
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Read = %v, want os.ErrNotExist", err)
+	}
+}
+
+func TestRebuildRestoredWorld(t *testing.T) {
+	w := gamelogic.NewWorld()
+	_, err := w.Spawn("alice", gamelogic.SpawnIntent{Location: "europe", Rank: gamelogic.RankArtillery})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "history.jsonl")
+	l, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	err = l.Append(gamelogic.Event{Kind: gamelogic.EventBaseline, States: w.States()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events, err := Read(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := gamelogic.Rebuild("alice", events).GetPlayerSnap().Units
+	want := w.State("alice").Units
+	if len(got) != len(want) || got[want[0].ID] != want[0] {
+		t.Errorf("rebuilt units = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,271 @@
+// Package mqttbridge relays Peril's game messages between RabbitMQ and an
+// MQTT broker, so clients without an AMQP library can take part in a game.
+package mqttbridge
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/google/uuid"
+
+	"github.com/gabrieldiem/learn-pub-sub-starter/internal/gamelogic"
+	"github.com/gabrieldiem/learn-pub-sub-starter/internal/pubsub"
+	"github.com/gabrieldiem/learn-pub-sub-starter/internal/routing"
+)
+
+// Sender is stamped on the messages the bridge publishes to RabbitMQ, and
+// tells it which ones not to relay back to MQTT.
+const Sender = "peril-mqtt-bridge"
+
+// QueuePrefix names the transient queues the bridge reads RabbitMQ from.
+const QueuePrefix = "peril_mqtt_bridge"
+
+const (
+	qos           = 1
+	mqttTimeout   = 10 * time.Second
+	quiesceMillis = 250
+)
+
+// Route relays the messages matching a binding pattern on an exchange,
+// decoding them as one of the game's message types in both directions.
+type Route struct {
+	Name     string
+	Exchange string
+	Pattern  string
+	// Retain keeps the last message on the MQTT broker for clients
+	// subscribing later, for state rather than events.
+	Retain bool
+	// ReadOnly routes are only relayed to MQTT, for what only the server
+	// may publish and for intents, whose token and reply queue MQTT has no
+	// way to carry.
+	ReadOnly bool
+
+	subscribe func(b *Bridge, r Route, queueName string) (*pubsub.Subscription, error)
+	publish   func(b *Bridge, key string, payload []byte) error
+}
+
+func route[T any](name, exchange, pattern string, retain bool) Route {
+	return Route{
+		Name:     name,
+		Exchange: exchange,
+		Pattern:  pattern,
+		Retain:   retain,
+		subscribe: func(b *Bridge, r Route, queueName string) (*pubsub.Subscription, error) {
+			return pubsub.Subscribe(
+				b.broker,
+				exchange,
+				queueName,
+				pattern,
+				pubsub.SimpleQueueTransient,
+				func(ctx context.Context, d pubsub.Delivery[T]) pubsub.Acktype {
+					return b.toMQTT(r, d.Envelope, d.Value)
+				},
+				pubsub.WithPrefetch(b.opts.Prefetch),
+			)
+		},
+		publish: func(b *Bridge, key string, payload []byte) error {
+			var val T
+			err := json.Unmarshal(payload, &val)
+			if err != nil {
+				return fmt.Errorf("could not decode %T: %v", val, err)
+			}
+			return pubsub.PublishJSON(b.broker, exchange, key, val, pubsub.WithSender(Sender))
+		},
+	}
+}
+
+func readOnly(r Route) Route {
+	r.ReadOnly = true
+	return r
+}
+
+// Routes are the routing keys of the game, from the moves, wars, pauses and
+// logs the server publishes to the intents players send it and the deltas
+// and war results it answers with. Every one of them is read-only, the
+// server being the only publisher of the first and MQTT having no way to
+// send the second.
+func Routes() []Route {
+	return []Route{
+		readOnly(route[gamelogic.ArmyMove]("army_moves", routing.ExchangePerilTopic, routing.ArmyMovesPrefix+".*", false)),
+		readOnly(route[gamelogic.RecognitionOfWar]("war", routing.ExchangePerilTopic, routing.WarRecognitionsPrefix+".*", false)),
+		readOnly(route[routing.PlayingState]("pause", routing.ExchangePerilDirect, routing.PauseKey, true)),
+		readOnly(route[routing.GameLog]("game_logs", routing.ExchangePerilTopic, routing.GameLogSlug+".*", false)),
+		readOnly(route[gamelogic.SpawnIntent]("spawn", routing.ExchangePerilDirect, routing.SpawnKey, false)),
+		readOnly(route[gamelogic.MoveIntent]("move", routing.ExchangePerilDirect, routing.MoveKey, false)),
+		readOnly(route[routing.GetState]("get_state", routing.ExchangePerilDirect, routing.GetStateKey, false)),
+		readOnly(route[gamelogic.StateDelta]("deltas", routing.ExchangePerilTopic, routing.StateDeltasPrefix+".*", false)),
+		readOnly(route[gamelogic.WarResult]("war_results", routing.ExchangePerilTopic, routing.WarResultsPrefix+".*", false)),
+	}
+}
+
+type Options struct {
+	// Prefix is the topic level the routing keys are mapped under,
+	// TopicPrefix when empty.
+	Prefix   string
+	ClientID string
+	Prefetch int
+}
+
+// Bridge relays messages between a pubsub.Broker and an MQTT broker.
+type Bridge struct {
+	broker pubsub.Broker
+	client mqtt.Client
+	opts   Options
+	routes []Route
+	subs   []*pubsub.Subscription
+
+	// echoes counts the messages the bridge published to MQTT and will
+	// receive back through its own subscriptions, MQTT 3.1.1 having no way
+	// to opt out of them.
+	mu     sync.Mutex
+	echoes map[string]int
+}
+
+// Dial connects to the MQTT broker at url, e.g. tcp://localhost:1883, and
+// starts relaying routes both ways. Subscriptions are made again whenever
+// the MQTT connection comes back.
+func Dial(broker pubsub.Broker, url string, routes []Route, opts Options) (*Bridge, error) {
+	if opts.Prefix == "" {
+		opts.Prefix = TopicPrefix
+	}
+	if opts.ClientID == "" {
+		opts.ClientID = Sender + "-" + uuid.NewString()[:8]
+	}
+	b := &Bridge{
+		broker: broker,
+		opts:   opts,
+		routes: routes,
+		echoes: map[string]int{},
+	}
+
+	clientOpts := mqtt.NewClientOptions().
+		AddBroker(url).
+		SetClientID(opts.ClientID).
+		SetAutoReconnect(true).
+		SetOnConnectHandler(b.subscribeMQTT).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			log.Printf("Lost connection to MQTT (%v), reconnecting…", err)
+		})
+	b.client = mqtt.NewClient(clientOpts)
+	err := wait(b.client.Connect())
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to MQTT: %v", err)
+	}
+
+	for _, r := range routes {
+		sub, err := r.subscribe(b, r, QueuePrefix+"."+r.Name+"."+opts.ClientID)
+		if err != nil {
+			b.Close(context.Background())
+			return nil, fmt.Errorf("could not subscribe to %s: %v", r.Name, err)
+		}
+		b.subs = append(b.subs, sub)
+	}
+	return b, nil
+}
+
+func (b *Bridge) subscribeMQTT(c mqtt.Client) {
+	for _, r := range b.routes {
+		if r.ReadOnly {
+			continue
+		}
+		filter := Topic(b.opts.Prefix, r.Pattern)
+		err := wait(c.Subscribe(filter, qos, func(_ mqtt.Client, m mqtt.Message) {
+			b.fromMQTT(r, m)
+		}))
+		if err != nil {
+			log.Printf("could not subscribe to %s: %v", filter, err)
+		}
+	}
+}
+
+func (b *Bridge) fromMQTT(r Route, m mqtt.Message) {
+	// Retained messages are state left by earlier publishers, already
+	// relayed when they were published.
+	if m.Retained() || b.isEcho(m.Topic(), m.Payload()) {
+		return
+	}
+	key, ok := Key(b.opts.Prefix, m.Topic())
+	if !ok {
+		return
+	}
+	err := r.publish(b, key, m.Payload())
+	if err != nil {
+		log.Printf("could not relay %s to RabbitMQ: %v", m.Topic(), err)
+	}
+}
+
+func (b *Bridge) toMQTT(r Route, env pubsub.Envelope, val any) pubsub.Acktype {
+	if env.Sender == Sender {
+		return pubsub.Ack
+	}
+	payload, err := json.Marshal(val)
+	if err != nil {
+		log.Printf("could not encode %s: %v", env.RoutingKey, err)
+		return pubsub.NackDiscard
+	}
+	topic := Topic(b.opts.Prefix, env.RoutingKey)
+
+	// Only writable routes are subscribed to on MQTT, so only their
+	// messages come back.
+	if !r.ReadOnly {
+		b.mu.Lock()
+		b.echoes[echoKey(topic, payload)]++
+		b.mu.Unlock()
+	}
+	err = wait(b.client.Publish(topic, qos, r.Retain, payload))
+	if err != nil {
+		if !r.ReadOnly {
+			b.isEcho(topic, payload)
+		}
+		log.Printf("could not relay %s to MQTT: %v", env.RoutingKey, err)
+		return pubsub.RetryLater
+	}
+	return pubsub.Ack
+}
+
+// isEcho reports whether the message is one the bridge published itself,
+// forgetting it so an identical message from someone else goes through.
+func (b *Bridge) isEcho(topic string, payload []byte) bool {
+	echo := echoKey(topic, payload)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.echoes[echo] == 0 {
+		return false
+	}
+	b.echoes[echo]--
+	if b.echoes[echo] == 0 {
+		delete(b.echoes, echo)
+	}
+	return true
+}
+
+func echoKey(topic string, payload []byte) string {
+	return topic + "\x00" + string(payload)
+}
+
+// Close stops relaying, letting in-flight RabbitMQ deliveries finish until
+// ctx is done.
+func (b *Bridge) Close(ctx context.Context) error {
+	var errs []error
+	for _, sub := range b.subs {
+		err := sub.Close(ctx)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	b.client.Disconnect(quiesceMillis)
+	return errors.Join(errs...)
+}
+
+func wait(t mqtt.Token) error {
+	if !t.WaitTimeout(mqttTimeout) {
+		return errors.New("timed out")
+	}
+	return t.Error()
+}
@@ -0,0 +1,339 @@
+package mqttbridge
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+
+	"github.com/gabrieldiem/learn-pub-sub-starter/internal/gamelogic"
+	"github.com/gabrieldiem/learn-pub-sub-starter/internal/pubsub"
+	"github.com/gabrieldiem/learn-pub-sub-starter/internal/routing"
+	"github.com/gabrieldiem/learn-pub-sub-starter/internal/topology"
+)
+
+const testTimeout = 5 * time.Second
+
+// quiet is how long to wait before concluding a message is not coming.
+const quiet = 200 * time.Millisecond
+
+type mqttMessage struct {
+	topic    string
+	payload  []byte
+	retained bool
+}
+
+// setup starts an embedded MQTT broker and a bridge relaying routes between
+// it and a memory broker, returning the memory broker and the MQTT broker's
+// URL.
+func setup(t *testing.T, routes []Route) (pubsub.Broker, string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	server, err := ServeEmbedded(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+	url := "tcp://" + addr
+
+	broker := pubsub.NewMemoryBroker()
+	t.Cleanup(func() { broker.Close() })
+	err = topology.Apply(broker, topology.Peril())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bridge, err := Dial(broker, url, routes, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { bridge.Close(context.Background()) })
+	return broker, url
+}
+
+// subscribeMQTT connects a client of its own to the MQTT broker and
+// subscribes it to filter.
+func subscribeMQTT(t *testing.T, url, filter string) (mqtt.Client, <-chan mqttMessage) {
+	t.Helper()
+	client := mqtt.NewClient(mqtt.NewClientOptions().AddBroker(url).SetClientID("test-" + t.Name()))
+	err := wait(client.Connect())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Disconnect(0) })
+	msgs := make(chan mqttMessage, 16)
+	err = wait(client.Subscribe(filter, qos, func(_ mqtt.Client, m mqtt.Message) {
+		msgs <- mqttMessage{m.Topic(), m.Payload(), m.Retained()}
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, msgs
+}
+
+// subscribeRabbit collects the envelopes of the army moves reaching the
+// memory broker.
+func subscribeRabbit(t *testing.T, broker pubsub.Broker) <-chan pubsub.Delivery[gamelogic.ArmyMove] {
+	t.Helper()
+	got := make(chan pubsub.Delivery[gamelogic.ArmyMove], 16)
+	sub, err := pubsub.Subscribe(
+		broker,
+		routing.ExchangePerilTopic,
+		"test_army_moves",
+		routing.ArmyMovesPrefix+".*",
+		pubsub.SimpleQueueTransient,
+		func(ctx context.Context, d pubsub.Delivery[gamelogic.ArmyMove]) pubsub.Acktype {
+			got <- d
+			return pubsub.Ack
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sub.Close(context.Background()) })
+	return got
+}
+
+// writable relays army moves both ways, which the game's own routes no
+// longer do, to test relaying from MQTT.
+var writable = []Route{
+	route[gamelogic.ArmyMove]("army_moves", routing.ExchangePerilTopic, routing.ArmyMovesPrefix+".*", false),
+}
+
+func testMove(username string) gamelogic.ArmyMove {
+	return gamelogic.ArmyMove{
+		Player:     gamelogic.Player{Username: username},
+		Units:      []gamelogic.Unit{{ID: 1, Rank: gamelogic.RankInfantry, Location: "europe"}},
+		ToLocation: "asia",
+	}
+}
+
+func TestBridgeMQTTToRabbit(t *testing.T) {
+	broker, url := setup(t, writable)
+	fromRabbit := subscribeRabbit(t, broker)
+	client, fromMQTT := subscribeMQTT(t, url, "peril/army_moves/+")
+
+	move := testMove("alice")
+	payload, err := json.Marshal(move)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = wait(client.Publish("peril/army_moves/alice", qos, false, payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case d := <-fromRabbit:
+		if d.Envelope.RoutingKey != "army_moves.alice" {
+			t.Errorf("routing key = %q, want army_moves.alice", d.Envelope.RoutingKey)
+		}
+		if d.Envelope.Sender != Sender {
+			t.Errorf("sender = %q, want %q", d.Envelope.Sender, Sender)
+		}
+		if d.Value.Player.Username != "alice" || d.Value.ToLocation != "asia" {
+			t.Errorf("move = %+v, want %+v", d.Value, move)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("move was not relayed to RabbitMQ")
+	}
+
+	// The client sees its own message once, the bridge not sending the
+	// copy it published to RabbitMQ back to MQTT.
+	<-fromMQTT
+	select {
+	case m := <-fromMQTT:
+		t.Fatalf("bridge echoed %s back to MQTT", m.topic)
+	case <-time.After(quiet):
+	}
+	select {
+	case d := <-fromRabbit:
+		t.Fatalf("move relayed twice to RabbitMQ, from %q", d.Envelope.Sender)
+	case <-time.After(quiet):
+	}
+}
+
+func TestBridgeRabbitToMQTT(t *testing.T) {
+	broker, url := setup(t, writable)
+	fromRabbit := subscribeRabbit(t, broker)
+	_, fromMQTT := subscribeMQTT(t, url, "peril/army_moves/+")
+
+	move := testMove("bob")
+	err := pubsub.PublishJSON(broker, routing.ExchangePerilTopic, "army_moves.bob", move, pubsub.WithSender("bob"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case m := <-fromMQTT:
+		if m.topic != "peril/army_moves/bob" {
+			t.Errorf("topic = %q, want peril/army_moves/bob", m.topic)
+		}
+		var got gamelogic.ArmyMove
+		err := json.Unmarshal(m.payload, &got)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Player.Username != "bob" || got.ToLocation != "asia" {
+			t.Errorf("move = %+v, want %+v", got, move)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("move was not relayed to MQTT")
+	}
+
+	// The bridge receives its own MQTT message back and must not publish
+	// it to RabbitMQ a second time.
+	d := <-fromRabbit
+	if d.Envelope.Sender != "bob" {
+		t.Errorf("sender = %q, want bob", d.Envelope.Sender)
+	}
+	select {
+	case d := <-fromRabbit:
+		t.Fatalf("bridge echoed the move back to RabbitMQ, from %q", d.Envelope.Sender)
+	case <-time.After(quiet):
+	}
+}
+
+func TestBridgeRetainsPause(t *testing.T) {
+	broker, url := setup(t, Routes())
+	err := pubsub.PublishJSON(broker, routing.ExchangePerilDirect, routing.PauseKey, routing.PlayingState{IsPaused: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Published to MQTT asynchronously, so wait for it with a live
+	// subscription before checking a late one gets the retained copy.
+	_, live := subscribeMQTT(t, url, "peril/pause")
+	select {
+	case <-live:
+	case <-time.After(testTimeout):
+		t.Fatal("pause was not relayed to MQTT")
+	}
+
+	client := mqtt.NewClient(mqtt.NewClientOptions().AddBroker(url).SetClientID("late"))
+	err = wait(client.Connect())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect(0)
+	late := make(chan mqttMessage, 1)
+	err = wait(client.Subscribe("peril/pause", qos, func(_ mqtt.Client, m mqtt.Message) {
+		late <- mqttMessage{m.Topic(), m.Payload(), m.Retained()}
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case m := <-late:
+		if !m.retained {
+			t.Error("late subscriber got a message that is not retained")
+		}
+		var state routing.PlayingState
+		err := json.Unmarshal(m.payload, &state)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !state.IsPaused {
+			t.Error("retained state is not paused")
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("late subscriber got no retained pause")
+	}
+}
+
+// Deltas only come from the server, so MQTT clients cannot forge them.
+func TestBridgeReadOnlyRoutes(t *testing.T) {
+	broker, url := setup(t, Routes())
+	deltas := make(chan pubsub.Delivery[gamelogic.StateDelta], 16)
+	sub, err := pubsub.Subscribe(
+		broker,
+		routing.ExchangePerilTopic,
+		"test_deltas",
+		routing.StateDeltasPrefix+".*",
+		pubsub.SimpleQueueTransient,
+		func(ctx context.Context, d pubsub.Delivery[gamelogic.StateDelta]) pubsub.Acktype {
+			deltas <- d
+			return pubsub.Ack
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close(context.Background())
+	client, fromMQTT := subscribeMQTT(t, url, "peril/deltas/+")
+
+	forged, err := json.Marshal(gamelogic.StateDelta{Username: "alice", Version: 99})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = wait(client.Publish("peril/deltas/alice", qos, false, forged))
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-fromMQTT
+	select {
+	case d := <-deltas:
+		t.Fatalf("delta from MQTT relayed to RabbitMQ: %+v", d.Value)
+	case <-time.After(quiet):
+	}
+
+	err = pubsub.PublishJSON(broker, routing.ExchangePerilTopic, "deltas.alice",
+		gamelogic.StateDelta{Username: "alice", Version: 1}, pubsub.WithSender("peril-server"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-deltas
+	select {
+	case m := <-fromMQTT:
+		if m.topic != "peril/deltas/alice" {
+			t.Errorf("topic = %q, want peril/deltas/alice", m.topic)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("delta was not relayed to MQTT")
+	}
+}
+
+// Only the server pauses the game, so MQTT clients cannot pause it for
+// everyone else.
+func TestBridgeDoesNotRelayPause(t *testing.T) {
+	broker, url := setup(t, Routes())
+	states := make(chan routing.PlayingState, 16)
+	sub, err := pubsub.Subscribe(
+		broker,
+		routing.ExchangePerilDirect,
+		"test_pause",
+		routing.PauseKey,
+		pubsub.SimpleQueueTransient,
+		func(ctx context.Context, d pubsub.Delivery[routing.PlayingState]) pubsub.Acktype {
+			states <- d.Value
+			return pubsub.Ack
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close(context.Background())
+	client, fromMQTT := subscribeMQTT(t, url, "peril/pause")
+
+	forged, err := json.Marshal(routing.PlayingState{IsPaused: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = wait(client.Publish("peril/pause", qos, false, forged))
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-fromMQTT
+	select {
+	case state := <-states:
+		t.Fatalf("pause from MQTT relayed to RabbitMQ: %+v", state)
+	case <-time.After(quiet):
+	}
+}
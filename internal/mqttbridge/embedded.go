@@ -0,0 +1,35 @@
+package mqttbridge
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+
+	mochi "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+)
+
+// ServeEmbedded starts an in-process MQTT broker listening on addr, open to
+// anyone, for trying the bridge out without running a broker of its own.
+func ServeEmbedded(addr string) (*mochi.Server, error) {
+	server := mochi.New(&mochi.Options{
+		Logger: slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelWarn})),
+	})
+	err := server.AddHook(new(auth.AllowHook), nil)
+	if err != nil {
+		return nil, err
+	}
+	err = server.AddListener(listeners.NewTCP(listeners.Config{
+		ID:      "peril",
+		Address: addr,
+	}))
+	if err != nil {
+		return nil, fmt.Errorf("could not listen on %s: %v", addr, err)
+	}
+	err = server.Serve()
+	if err != nil {
+		return nil, err
+	}
+	return server, nil
+}
@@ -0,0 +1,39 @@
+package mqttbridge
+
+import "strings"
+
+// TopicPrefix is the first level of every topic the bridge uses, keeping
+// Peril's topics apart from anything else on the MQTT broker.
+const TopicPrefix = "peril"
+
+// Topic turns a routing key or binding pattern into an MQTT topic or topic
+// filter under prefix: words become levels, "*" becomes "+" and "#" stays
+// "#". "army_moves.*" is "peril/army_moves/+".
+func Topic(prefix, key string) string {
+	words := strings.Split(key, ".")
+	for i, w := range words {
+		if w == "*" {
+			words[i] = "+"
+		}
+	}
+	if prefix == "" {
+		return strings.Join(words, "/")
+	}
+	return prefix + "/" + strings.Join(words, "/")
+}
+
+// Key turns an MQTT topic under prefix back into a routing key, reporting
+// false when the topic is outside prefix.
+func Key(prefix, topic string) (string, bool) {
+	if prefix != "" {
+		var ok bool
+		topic, ok = strings.CutPrefix(topic, prefix+"/")
+		if !ok {
+			return "", false
+		}
+	}
+	if topic == "" {
+		return "", false
+	}
+	return strings.ReplaceAll(topic, "/", "."), true
+}
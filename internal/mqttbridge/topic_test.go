@@ -0,0 +1,53 @@
+package mqttbridge
+
+import "testing"
+
+func TestTopic(t *testing.T) {
+	tests := []struct {
+		prefix, key, want string
+	}{
+		{"peril", "army_moves.alice", "peril/army_moves/alice"},
+		{"peril", "army_moves.*", "peril/army_moves/+"},
+		{"peril", "game_logs.#", "peril/game_logs/#"},
+		{"peril", "pause", "peril/pause"},
+		{"", "war.bob", "war/bob"},
+		{"games/peril", "war.*", "games/peril/war/+"},
+	}
+	for _, tt := range tests {
+		got := Topic(tt.prefix, tt.key)
+		if got != tt.want {
+			t.Errorf("Topic(%q, %q) = %q, want %q", tt.prefix, tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestKey(t *testing.T) {
+	tests := []struct {
+		prefix, topic string
+		want          string
+		ok            bool
+	}{
+		{"peril", "peril/army_moves/alice", "army_moves.alice", true},
+		{"peril", "peril/pause", "pause", true},
+		{"peril", "other/pause", "", false},
+		{"peril", "perilous/pause", "", false},
+		{"peril", "peril/", "", false},
+		{"", "war/bob", "war.bob", true},
+		{"", "", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := Key(tt.prefix, tt.topic)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("Key(%q, %q) = %q, %v, want %q, %v", tt.prefix, tt.topic, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestKeyReversesTopic(t *testing.T) {
+	for _, key := range []string{"army_moves.alice", "war.bob", "pause", "game_logs.carol"} {
+		got, ok := Key(TopicPrefix, Topic(TopicPrefix, key))
+		if !ok || got != key {
+			t.Errorf("Key(Topic(%q)) = %q, %v", key, got, ok)
+		}
+	}
+}
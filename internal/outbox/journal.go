@@ -0,0 +1,190 @@
+package outbox
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	opCommit     = "commit"
+	opSent       = "sent"
+	opDone       = "done"
+	opRolledBack = "rolled_back"
+)
+
+// record is a line of the journal. A commit carries the transaction's
+// messages, sent how many of them were published, done and rolled_back
+// that the transaction is over.
+type record struct {
+	Op      string  `json:"op"`
+	Tx      uint64  `json:"tx"`
+	Entries []Entry `json:"entries,omitempty"`
+	Sent    int     `json:"sent,omitempty"`
+}
+
+// recovered is a transaction a previous run did not finish.
+type recovered struct {
+	ID      uint64
+	Entries []Entry
+	sent    int
+}
+
+type journal struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+// openJournal reads the journal at path and rewrites it with only the
+// transactions still pending, so it does not grow forever.
+func openJournal(path string) (*journal, []recovered, error) {
+	pending, err := readJournal(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not compact journal: %v", err)
+	}
+	for _, r := range pending {
+		err = writeRecord(tmp, record{Op: opCommit, Tx: r.ID, Entries: r.Entries})
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+			return nil, nil, fmt.Errorf("could not compact journal: %v", err)
+		}
+	}
+	err = tmp.Close()
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return nil, nil, fmt.Errorf("could not compact journal: %v", err)
+	}
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not open journal: %v", err)
+	}
+	return &journal{f: f}, pending, nil
+}
+
+func readJournal(path string) ([]recovered, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not open journal: %v", err)
+	}
+	defer f.Close()
+
+	var order []uint64
+	txs := map[uint64]*recovered{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 16<<20)
+	for line := 1; scanner.Scan(); line++ {
+		var r record
+		dec := json.NewDecoder(bytes.NewReader(scanner.Bytes()))
+		dec.UseNumber()
+		err := dec.Decode(&r)
+		if err != nil {
+			// A crash halfway through a write only leaves the last line
+			// torn, and its transaction was never reported committed.
+			log.Printf("skipping journal line %d: %v", line, err)
+			continue
+		}
+		switch r.Op {
+		case opCommit:
+			for i := range r.Entries {
+				normalizeHeaders(r.Entries[i].Message.Headers)
+			}
+			txs[r.Tx] = &recovered{ID: r.Tx, Entries: r.Entries}
+			order = append(order, r.Tx)
+		case opSent:
+			if tx, ok := txs[r.Tx]; ok && r.Sent <= len(tx.Entries) {
+				tx.sent = r.Sent
+			}
+		case opDone, opRolledBack:
+			delete(txs, r.Tx)
+		}
+	}
+	err = scanner.Err()
+	if err != nil {
+		return nil, fmt.Errorf("could not read journal: %v", err)
+	}
+
+	var pending []recovered
+	for _, id := range order {
+		tx, ok := txs[id]
+		if !ok || tx.sent == len(tx.Entries) {
+			continue
+		}
+		pending = append(pending, recovered{ID: id, Entries: tx.Entries[tx.sent:]})
+	}
+	return pending, nil
+}
+
+// normalizeHeaders turns the numbers JSON gave back into int64, the integer
+// type brokers encode.
+func normalizeHeaders(headers map[string]any) {
+	for k, v := range headers {
+		n, ok := v.(json.Number)
+		if !ok {
+			continue
+		}
+		if i, err := n.Int64(); err == nil {
+			headers[k] = i
+		} else if f, err := n.Float64(); err == nil {
+			headers[k] = f
+		}
+	}
+}
+
+func writeRecord(f *os.File, r record) error {
+	dat, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(dat, '\n'))
+	return err
+}
+
+// commit returns once the transaction is on disk, as it must not be lost
+// once reported committed.
+func (j *journal) commit(id uint64, entries []Entry) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	err := writeRecord(j.f, record{Op: opCommit, Tx: id, Entries: entries})
+	if err != nil {
+		return err
+	}
+	return j.f.Sync()
+}
+
+// sent records that the first n entries of the transaction were published.
+func (j *journal) sent(id uint64, n int) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return writeRecord(j.f, record{Op: opSent, Tx: id, Sent: n})
+}
+
+func (j *journal) settle(id uint64, op string) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return writeRecord(j.f, record{Op: op, Tx: id})
+}
+
+func (j *journal) close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.f.Close()
+}
@@ -0,0 +1,178 @@
+package outbox
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gabrieldiem/learn-pub-sub-starter/internal/pubsub"
+)
+
+func entry(t *testing.T, key string) Entry {
+	t.Helper()
+	msg, err := pubsub.Encode(key, pubsub.WithSchemaVersion(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Entry{Exchange: "ex", Key: key, Message: msg}
+}
+
+func writeJournal(t *testing.T, lines ...string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "outbox.jsonl")
+	var dat []byte
+	for _, line := range lines {
+		dat = append(dat, line...)
+		dat = append(dat, '\n')
+	}
+	err := os.WriteFile(path, dat, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func line(t *testing.T, r record) string {
+	t.Helper()
+	dat, err := json.Marshal(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(dat)
+}
+
+func readRecords(t *testing.T, path string) []record {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var records []record
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var r record
+		err := json.Unmarshal(scanner.Bytes(), &r)
+		if err != nil {
+			t.Fatalf("journal line %q: %v", scanner.Text(), err)
+		}
+		records = append(records, r)
+	}
+	return records
+}
+
+func TestJournalRecovery(t *testing.T) {
+	torn := line(t, record{Op: opCommit, Tx: 5, Entries: []Entry{entry(t, "ok.torn")}})
+	path := writeJournal(t,
+		// Published completely.
+		line(t, record{Op: opCommit, Tx: 1, Entries: []Entry{entry(t, "ok.1")}}),
+		line(t, record{Op: opSent, Tx: 1, Sent: 1}),
+		line(t, record{Op: opDone, Tx: 1}),
+		// Rolled back.
+		line(t, record{Op: opCommit, Tx: 2, Entries: []Entry{entry(t, "ok.2")}}),
+		line(t, record{Op: opRolledBack, Tx: 2}),
+		// Crashed after publishing the first of three.
+		line(t, record{Op: opCommit, Tx: 3, Entries: []Entry{entry(t, "ok.3a"), entry(t, "ok.3b"), entry(t, "ok.3c")}}),
+		line(t, record{Op: opSent, Tx: 3, Sent: 1}),
+		// Never started.
+		line(t, record{Op: opCommit, Tx: 4, Entries: []Entry{entry(t, "ok.4")}}),
+		// Crashed halfway through writing the commit.
+		torn[:len(torn)/2],
+	)
+
+	o, err := New(Options{Journal: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.Close()
+	if n := o.Pending(); n != 2 {
+		t.Fatalf("Pending() = %d, want 2", n)
+	}
+
+	// Compacted to the commits still pending, without what was sent.
+	records := readRecords(t, path)
+	if len(records) != 2 || records[0].Tx != 3 || len(records[0].Entries) != 2 || records[1].Tx != 4 {
+		t.Fatalf("compacted journal = %+v", records)
+	}
+
+	// New transactions are numbered after the recovered ones.
+	tx := o.Begin()
+	err = Add(tx, "ex", "ok.new", "new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tx.id != 5 {
+		t.Errorf("new transaction id = %d, want 5", tx.id)
+	}
+
+	b, c := newBroker(t)
+	relay(t, o, b)
+	err = wait(t, tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"ok.3b", "ok.3c", "ok.4", "ok.new"} {
+		if got := receive(t, c); got != want {
+			t.Errorf("got %s, want %s", got, want)
+		}
+	}
+	expectNone(t, c)
+}
+
+func TestJournalHeadersSurviveRestart(t *testing.T) {
+	path := writeJournal(t, line(t, record{Op: opCommit, Tx: 1, Entries: []Entry{entry(t, "ok.1")}}))
+	o, err := New(Options{Journal: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.Close()
+	got := o.pending[0].entries[0].Message.Headers[pubsub.HeaderSchemaVersion]
+	if got != int64(2) {
+		t.Errorf("schema version = %#v, want int64(2)", got)
+	}
+}
+
+func TestJournalEmptyAfterPublishing(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox.jsonl")
+	o, err := New(Options{Journal: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := newBroker(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		o.Relay(ctx, b)
+	}()
+	var log []string
+	published := commitTx(t, o, "a", &log, "ok.1", "ok.2")
+	rolledBack := commitTx(t, o, "b", &log, "none")
+	wait(t, published)
+	wait(t, rolledBack)
+	cancel()
+	<-done
+	err = o.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	o, err = New(Options{Journal: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.Close()
+	if n := o.Pending(); n != 0 {
+		t.Errorf("Pending() after restart = %d, want 0", n)
+	}
+	if records := readRecords(t, path); len(records) != 0 {
+		t.Errorf("compacted journal = %+v, want it empty", records)
+	}
+}
@@ -0,0 +1,418 @@
+// Package outbox records state changes together with the messages they
+// imply, so a message that cannot be published takes its state change back
+// with it instead of leaving the two diverged.
+//
+// A Tx collects the messages of a change that was already applied and how
+// to undo it. Once committed, the relay publishes its messages in commit
+// order, retrying failures, and rolls the change back when the broker
+// refuses its first message or the retries run out before it went out.
+// Once any message of a transaction was published the change stands.
+package outbox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gabrieldiem/learn-pub-sub-starter/internal/pubsub"
+)
+
+var (
+	ErrRolledBack = errors.New("transaction was rolled back")
+	ErrCommitted  = errors.New("transaction was already committed")
+	ErrClosed     = errors.New("outbox is closed")
+	// ErrIncomplete is returned by Wait when only some of the messages were
+	// published, which keeps the change, as they cannot be taken back.
+	ErrIncomplete = errors.New("transaction was only partly published")
+	ErrAbandoned  = errors.New("transaction was abandoned before it was published")
+)
+
+const defaultConfirmTimeout = 5 * time.Second
+
+type Options struct {
+	// Journal is the file committed transactions are appended to, so the
+	// ones not yet published survive a restart. Empty keeps them in memory
+	// only.
+	Journal string
+	// Retry paces the attempts at publishing a message, MaxAttempts being
+	// how many are made before the transaction is rolled back.
+	Retry          pubsub.RetryPolicy
+	ConfirmTimeout time.Duration
+	// Timeout bounds how long the relay spends on a transaction, zero
+	// leaving it to the retries.
+	Timeout time.Duration
+	// DropUnroutable counts messages no queue was bound for as published
+	// instead of rolling their transaction back, for messages that may go
+	// unheard.
+	DropUnroutable bool
+}
+
+// Entry is a message waiting to be published.
+type Entry struct {
+	Exchange string
+	Key      string
+	Message  pubsub.Message
+}
+
+// Tx is a state change and the messages it implies.
+type Tx struct {
+	ob      *Outbox
+	id      uint64
+	entries []Entry
+	undo    []func()
+	onPub   []func()
+	// sent counts the entries the relay already published.
+	sent      int
+	committed bool
+
+	done chan struct{}
+	err  error
+}
+
+type Outbox struct {
+	opts    Options
+	journal *journal
+
+	mu      sync.Mutex
+	nextID  uint64
+	pending []*Tx
+	// current is the transaction the relay is publishing.
+	current *Tx
+	closed  bool
+	wake    chan struct{}
+}
+
+// New opens the outbox, loading the transactions a previous run committed
+// to the journal but did not get to publish. Their changes cannot be rolled
+// back anymore, so they are published until the retries run out.
+func New(opts Options) (*Outbox, error) {
+	if opts.Retry == (pubsub.RetryPolicy{}) {
+		opts.Retry = pubsub.DefaultRetryPolicy
+	}
+	if opts.ConfirmTimeout == 0 {
+		opts.ConfirmTimeout = defaultConfirmTimeout
+	}
+	o := &Outbox{
+		opts:   opts,
+		nextID: 1,
+		wake:   make(chan struct{}, 1),
+	}
+	if opts.Journal == "" {
+		return o, nil
+	}
+
+	j, recovered, err := openJournal(opts.Journal)
+	if err != nil {
+		return nil, err
+	}
+	o.journal = j
+	for _, r := range recovered {
+		tx := &Tx{
+			ob:        o,
+			id:        r.ID,
+			entries:   r.Entries,
+			committed: true,
+			done:      make(chan struct{}),
+		}
+		o.pending = append(o.pending, tx)
+		if r.ID >= o.nextID {
+			o.nextID = r.ID + 1
+		}
+	}
+	if len(o.pending) > 0 {
+		o.notify()
+	}
+	return o, nil
+}
+
+// Begin starts a transaction for a change the caller is about to make.
+func (o *Outbox) Begin() *Tx {
+	return &Tx{
+		ob:   o,
+		done: make(chan struct{}),
+	}
+}
+
+// OnRollback registers how to undo part of the change. Undo functions run
+// in reverse order of registration.
+func (tx *Tx) OnRollback(undo func()) {
+	tx.undo = append(tx.undo, undo)
+}
+
+// OnPublished registers fn to be run by the relay once the change stands,
+// its messages having been published, or some of them. They run in commit
+// order across transactions.
+func (tx *Tx) OnPublished(fn func()) {
+	tx.onPub = append(tx.onPub, fn)
+}
+
+// Add encodes val the way pubsub.Publish would and adds it to the messages
+// published once tx commits.
+func Add[T any](tx *Tx, exchange, key string, val T, opts ...pubsub.PublishOption) error {
+	if tx.committed {
+		return ErrCommitted
+	}
+	msg, err := pubsub.Encode(val, opts...)
+	if err != nil {
+		return fmt.Errorf("could not encode message: %v", err)
+	}
+	tx.entries = append(tx.entries, Entry{Exchange: exchange, Key: key, Message: msg})
+	return nil
+}
+
+// Rollback undoes the change of a transaction that was not committed.
+func (tx *Tx) Rollback() {
+	if tx.committed {
+		return
+	}
+	tx.committed = true
+	tx.rollback(ErrRolledBack)
+}
+
+func (tx *Tx) rollback(err error) {
+	for i := len(tx.undo) - 1; i >= 0; i-- {
+		tx.undo[i]()
+	}
+	tx.finish(err)
+}
+
+func rolledBack(err error) error {
+	return fmt.Errorf("%w: %w", ErrRolledBack, err)
+}
+
+func (tx *Tx) published(err error) {
+	for _, fn := range tx.onPub {
+		fn()
+	}
+	tx.finish(err)
+}
+
+func (tx *Tx) finish(err error) {
+	tx.err = err
+	close(tx.done)
+}
+
+// Commit records the transaction, writing it to the journal when there is
+// one, and queues its messages for the relay. The change is rolled back if
+// it cannot be recorded.
+func (tx *Tx) Commit() error {
+	if tx.committed {
+		return ErrCommitted
+	}
+	tx.committed = true
+	o := tx.ob
+
+	o.mu.Lock()
+	if o.closed {
+		o.mu.Unlock()
+		tx.rollback(rolledBack(ErrClosed))
+		return ErrClosed
+	}
+	tx.id = o.nextID
+	o.nextID++
+	if o.journal != nil {
+		err := o.journal.commit(tx.id, tx.entries)
+		if err != nil {
+			o.mu.Unlock()
+			err = fmt.Errorf("could not journal transaction: %v", err)
+			tx.rollback(rolledBack(err))
+			return err
+		}
+	}
+	o.pending = append(o.pending, tx)
+	o.mu.Unlock()
+
+	o.notify()
+	return nil
+}
+
+// Wait blocks until the relay published every message of the transaction,
+// returning nil, or rolled it back, returning an error wrapping both
+// ErrRolledBack and the publish error. When only some of the messages were
+// published the error wraps ErrIncomplete instead. It returns ctx's error if
+// ctx is done first, the transaction still being pending.
+func (tx *Tx) Wait(ctx context.Context) error {
+	select {
+	case <-tx.done:
+		return tx.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Abandon rolls back a committed transaction the relay has not started
+// publishing, as when it is stuck behind others the broker does not take,
+// and reports whether it did. Wait then returns an error wrapping both
+// ErrRolledBack and ErrAbandoned.
+func (tx *Tx) Abandon() bool {
+	o := tx.ob
+	o.mu.Lock()
+	i := slices.Index(o.pending, tx)
+	if i < 0 || o.current == tx {
+		o.mu.Unlock()
+		return false
+	}
+	o.pending = slices.Delete(o.pending, i, i+1)
+	o.mu.Unlock()
+
+	o.settle(tx, opRolledBack)
+	tx.rollback(rolledBack(ErrAbandoned))
+	return true
+}
+
+func (o *Outbox) notify() {
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Pending is the number of committed transactions not yet published.
+func (o *Outbox) Pending() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return len(o.pending)
+}
+
+// Relay publishes committed transactions to b in order until ctx is done.
+// A transaction is only started after the previous one was published or
+// rolled back, so messages keep the order their changes were made in. Undo
+// and OnPublished functions are run on the relay's goroutine.
+func (o *Outbox) Relay(ctx context.Context, b pubsub.Broker) error {
+	for {
+		o.mu.Lock()
+		var tx *Tx
+		if len(o.pending) > 0 {
+			tx = o.pending[0]
+		}
+		o.current = tx
+		o.mu.Unlock()
+
+		if tx == nil {
+			select {
+			case <-o.wake:
+				continue
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		txCtx, cancel := o.txContext(ctx)
+		err := o.deliver(txCtx, b, tx)
+		cancel()
+		if ctx.Err() != nil {
+			// Left pending for the next relay, or the next run through the
+			// journal.
+			o.mu.Lock()
+			o.current = nil
+			o.mu.Unlock()
+			return ctx.Err()
+		}
+
+		o.mu.Lock()
+		o.pending = o.pending[1:]
+		o.current = nil
+		o.mu.Unlock()
+		switch {
+		case err == nil:
+			o.settle(tx, opDone)
+			tx.published(nil)
+		case tx.sent > 0:
+			// Consumers already saw part of the change, so it is kept
+			// rather than undone behind their backs.
+			log.Printf("transaction %d: only %d of %d messages published: %v", tx.id, tx.sent, len(tx.entries), err)
+			o.settle(tx, opDone)
+			tx.published(fmt.Errorf("%w: %w", ErrIncomplete, err))
+		default:
+			o.settle(tx, opRolledBack)
+			tx.rollback(rolledBack(err))
+		}
+	}
+}
+
+func (o *Outbox) txContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if o.opts.Timeout == 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, o.opts.Timeout)
+}
+
+func (o *Outbox) deliver(ctx context.Context, b pubsub.Broker, tx *Tx) error {
+	for tx.sent < len(tx.entries) {
+		e := tx.entries[tx.sent]
+		err := o.publish(ctx, b, e)
+		if err != nil {
+			return err
+		}
+		tx.sent++
+		if o.journal != nil {
+			err = o.journal.sent(tx.id, tx.sent)
+			if err != nil {
+				// Already published, so the change stands; a restart
+				// publishes the message again.
+				log.Printf("could not journal transaction %d: %v", tx.id, err)
+			}
+		}
+	}
+	return nil
+}
+
+// publish retries transient failures. Unroutable messages are not retried,
+// as nobody will be listening the next time either.
+func (o *Outbox) publish(ctx context.Context, b pubsub.Broker, e Entry) error {
+	for attempt := 1; ; attempt++ {
+		pubCtx, cancel := context.WithTimeout(ctx, o.opts.ConfirmTimeout)
+		err := b.PublishConfirmed(pubCtx, e.Exchange, e.Key, e.Message)
+		cancel()
+		if err == nil {
+			return nil
+		}
+		var unroutable *pubsub.UnroutableError
+		if errors.As(err, &unroutable) {
+			if o.opts.DropUnroutable {
+				return nil
+			}
+			return err
+		}
+		if attempt >= o.opts.Retry.MaxAttempts {
+			return err
+		}
+
+		t := time.NewTimer(o.opts.Retry.Delay(attempt))
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+func (o *Outbox) settle(tx *Tx, op string) {
+	if o.journal == nil {
+		return
+	}
+	err := o.journal.settle(tx.id, op)
+	if err != nil {
+		// The transaction is published again after a restart, which
+		// consumers have to cope with anyway.
+		log.Printf("could not journal transaction %d: %v", tx.id, err)
+	}
+}
+
+// Close stops accepting transactions and closes the journal. Transactions
+// still pending are published on the next run when journaled, and lost
+// otherwise.
+func (o *Outbox) Close() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.closed = true
+	if o.journal == nil {
+		return nil
+	}
+	return o.journal.close()
+}
@@ -0,0 +1,298 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gabrieldiem/learn-pub-sub-starter/internal/pubsub"
+)
+
+const testTimeout = 2 * time.Second
+
+// newBroker returns a memory broker where keys matching "ok.*" reach queue
+// "q" and any other key is unroutable.
+func newBroker(t *testing.T) (*pubsub.MemoryBroker, pubsub.Consumer) {
+	t.Helper()
+	b := pubsub.NewMemoryBroker()
+	t.Cleanup(func() { b.Close() })
+	err := b.DeclareExchange("ex", pubsub.ExchangeTopic, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = b.DeclareQueue("q", pubsub.QueueOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b.BindQueue("q", "ok.*", "ex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := b.Consume("q", pubsub.ConsumeOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b, c
+}
+
+// relay runs the outbox's relay to b until the test ends.
+func relay(t *testing.T, o *Outbox, b pubsub.Broker) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		o.Relay(ctx, b)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+}
+
+func receive(t *testing.T, c pubsub.Consumer) string {
+	t.Helper()
+	select {
+	case d := <-c.Deliveries():
+		err := d.Ack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d.RoutingKey
+	case <-time.After(testTimeout):
+		t.Fatal("no delivery")
+	}
+	return ""
+}
+
+func expectNone(t *testing.T, c pubsub.Consumer) {
+	t.Helper()
+	select {
+	case d := <-c.Deliveries():
+		t.Fatalf("unexpected delivery %s", d.RoutingKey)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func wait(t *testing.T, tx *Tx) error {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	err := tx.Wait(ctx)
+	if ctx.Err() != nil {
+		t.Fatal("transaction was not settled")
+	}
+	return err
+}
+
+// commitTx commits a transaction publishing to keys, recording in log
+// whether it was published or rolled back.
+func commitTx(t *testing.T, o *Outbox, name string, log *[]string, keys ...string) *Tx {
+	t.Helper()
+	tx := o.Begin()
+	tx.OnRollback(func() { *log = append(*log, "undo "+name) })
+	tx.OnPublished(func() { *log = append(*log, "published "+name) })
+	for _, key := range keys {
+		err := Add(tx, "ex", key, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := tx.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tx
+}
+
+func TestRelayPublishesInCommitOrder(t *testing.T) {
+	b, c := newBroker(t)
+	o, err := New(Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var log []string
+	txs := []*Tx{
+		commitTx(t, o, "a", &log, "ok.1", "ok.2"),
+		commitTx(t, o, "b", &log, "ok.3"),
+		commitTx(t, o, "c", &log, "ok.4"),
+	}
+	relay(t, o, b)
+
+	for _, tx := range txs {
+		err := wait(t, tx)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, want := range []string{"ok.1", "ok.2", "ok.3", "ok.4"} {
+		if got := receive(t, c); got != want {
+			t.Errorf("got %s, want %s", got, want)
+		}
+	}
+	want := []string{"published a", "published b", "published c"}
+	if len(log) != len(want) {
+		t.Fatalf("log = %v, want %v", log, want)
+	}
+	for i := range want {
+		if log[i] != want[i] {
+			t.Fatalf("log = %v, want %v", log, want)
+		}
+	}
+	if n := o.Pending(); n != 0 {
+		t.Errorf("Pending() = %d, want 0", n)
+	}
+}
+
+func TestRelaySettles(t *testing.T) {
+	tests := []struct {
+		name    string
+		keys    []string
+		wantErr error
+		wantLog string
+	}{
+		{"published", []string{"ok.1", "ok.2"}, nil, "published tx"},
+		{"first refused", []string{"none", "ok.1"}, ErrRolledBack, "undo tx"},
+		// The first message already went out, so the change stands.
+		{"partly sent", []string{"ok.1", "none"}, ErrIncomplete, "published tx"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, _ := newBroker(t)
+			o, err := New(Options{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			relay(t, o, b)
+			var log []string
+			tx := commitTx(t, o, "tx", &log, tt.keys...)
+
+			err = wait(t, tx)
+			if tt.wantErr == nil && err != nil || !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Wait() = %v, want %v", err, tt.wantErr)
+			}
+			if len(log) != 1 || log[0] != tt.wantLog {
+				t.Errorf("log = %v, want [%s]", log, tt.wantLog)
+			}
+		})
+	}
+}
+
+func TestRelayDropUnroutable(t *testing.T) {
+	b, c := newBroker(t)
+	o, err := New(Options{DropUnroutable: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	relay(t, o, b)
+	var log []string
+	tx := commitTx(t, o, "tx", &log, "none", "ok.1")
+	err = wait(t, tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := receive(t, c); got != "ok.1" {
+		t.Errorf("got %s, want ok.1", got)
+	}
+}
+
+// failingBroker refuses every publish as if the broker were unreachable.
+type failingBroker struct {
+	pubsub.Broker
+}
+
+func (failingBroker) PublishConfirmed(ctx context.Context, exchange, key string, msg pubsub.Message) error {
+	return errors.New("connection refused")
+}
+
+func TestRelayTimeout(t *testing.T) {
+	o, err := New(Options{
+		Retry:   pubsub.RetryPolicy{BaseDelay: time.Millisecond, MaxDelay: time.Millisecond, MaxAttempts: 1 << 20},
+		Timeout: 50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	relay(t, o, failingBroker{})
+	var log []string
+	tx := commitTx(t, o, "tx", &log, "ok.1")
+	err = wait(t, tx)
+	if !errors.Is(err, ErrRolledBack) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Wait() = %v, want a rollback after the timeout", err)
+	}
+	if len(log) != 1 || log[0] != "undo tx" {
+		t.Errorf("log = %v, want [undo tx]", log)
+	}
+}
+
+// blockingBroker holds every publish until its context is done.
+type blockingBroker struct {
+	pubsub.Broker
+	publishing chan string
+}
+
+func (b blockingBroker) PublishConfirmed(ctx context.Context, exchange, key string, msg pubsub.Message) error {
+	b.publishing <- key
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestAbandon(t *testing.T) {
+	o, err := New(Options{
+		Journal: filepath.Join(t.TempDir(), "outbox.jsonl"),
+		Retry:   pubsub.RetryPolicy{BaseDelay: time.Millisecond, MaxDelay: time.Millisecond, MaxAttempts: 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := blockingBroker{publishing: make(chan string, 1)}
+	relay(t, o, b)
+	var log []string
+	first := commitTx(t, o, "first", &log, "ok.1")
+	select {
+	case <-b.publishing:
+	case <-time.After(testTimeout):
+		t.Fatal("relay did not start publishing")
+	}
+	second := commitTx(t, o, "second", &log, "ok.2")
+
+	if first.Abandon() {
+		t.Error("abandoned the transaction being published")
+	}
+	if !second.Abandon() {
+		t.Fatal("could not abandon the queued transaction")
+	}
+	err = wait(t, second)
+	if !errors.Is(err, ErrRolledBack) || !errors.Is(err, ErrAbandoned) {
+		t.Errorf("Wait() = %v, want an abandoned rollback", err)
+	}
+	if len(log) != 1 || log[0] != "undo second" {
+		t.Errorf("log = %v, want [undo second]", log)
+	}
+	if second.Abandon() {
+		t.Error("abandoned a transaction twice")
+	}
+	if n := o.Pending(); n != 1 {
+		t.Errorf("Pending() = %d, want only the first", n)
+	}
+}
+
+func TestRollbackBeforeCommit(t *testing.T) {
+	o, err := New(Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var log []string
+	tx := o.Begin()
+	tx.OnRollback(func() { log = append(log, "first") })
+	tx.OnRollback(func() { log = append(log, "second") })
+	tx.Rollback()
+	if len(log) != 2 || log[0] != "second" || log[1] != "first" {
+		t.Errorf("undo ran as %v, want them in reverse", log)
+	}
+	if err := tx.Commit(); !errors.Is(err, ErrCommitted) {
+		t.Errorf("Commit() after Rollback = %v, want ErrCommitted", err)
+	}
+}
@@ -0,0 +1,141 @@
+package perilpb
+
+import (
+	"fmt"
+
+	"github.com/gabrieldiem/learn-pub-sub-starter/internal/gamelogic"
+	"github.com/gabrieldiem/learn-pub-sub-starter/internal/pubsub"
+	"github.com/gabrieldiem/learn-pub-sub-starter/internal/routing"
+	"google.golang.org/protobuf/proto"
+)
+
+const ContentType = "application/x-protobuf"
+
+func init() {
+	pubsub.RegisterCodec(Codec{})
+}
+
+// Codec encodes Peril messages as protobuf. Besides generated messages it
+// accepts the gamelogic and routing types, converting them on the way.
+type Codec struct{}
+
+func (Codec) ContentType() string {
+	return ContentType
+}
+
+func (Codec) Marshal(v any) ([]byte, error) {
+	var msg proto.Message
+	switch v := v.(type) {
+	case proto.Message:
+		msg = v
+	case gamelogic.ArmyMove:
+		msg = FromArmyMove(v)
+	case gamelogic.RecognitionOfWar:
+		msg = FromRecognitionOfWar(v)
+	case routing.PlayingState:
+		msg = FromPlayingState(v)
+	case routing.GameLog:
+		msg = FromGameLog(v)
+	case routing.GetPlayingState:
+		msg = FromGetPlayingState(v)
+	case gamelogic.SpawnIntent:
+		msg = FromSpawnIntent(v)
+	case gamelogic.MoveIntent:
+		msg = FromMoveIntent(v)
+	case routing.GetState:
+		msg = FromGetState(v)
+	case routing.Join:
+		msg = FromJoin(v)
+	case routing.Session:
+		msg = FromSession(v)
+	case gamelogic.StateDelta:
+		msg = FromStateDelta(v)
+	case gamelogic.WarResult:
+		msg = FromWarResult(v)
+	default:
+		return nil, fmt.Errorf("cannot encode %T as protobuf", v)
+	}
+	return proto.Marshal(msg)
+}
+
+func (Codec) Unmarshal(data []byte, v any) error {
+	switch v := v.(type) {
+	case proto.Message:
+		return proto.Unmarshal(data, v)
+	case *gamelogic.ArmyMove:
+		msg := &ArmyMove{}
+		if err := proto.Unmarshal(data, msg); err != nil {
+			return err
+		}
+		*v = ToArmyMove(msg)
+	case *gamelogic.RecognitionOfWar:
+		msg := &RecognitionOfWar{}
+		if err := proto.Unmarshal(data, msg); err != nil {
+			return err
+		}
+		*v = ToRecognitionOfWar(msg)
+	case *routing.PlayingState:
+		msg := &PlayingState{}
+		if err := proto.Unmarshal(data, msg); err != nil {
+			return err
+		}
+		*v = ToPlayingState(msg)
+	case *routing.GameLog:
+		msg := &GameLog{}
+		if err := proto.Unmarshal(data, msg); err != nil {
+			return err
+		}
+		*v = ToGameLog(msg)
+	case *routing.GetPlayingState:
+		msg := &GetPlayingState{}
+		if err := proto.Unmarshal(data, msg); err != nil {
+			return err
+		}
+		*v = ToGetPlayingState(msg)
+	case *gamelogic.SpawnIntent:
+		msg := &SpawnIntent{}
+		if err := proto.Unmarshal(data, msg); err != nil {
+			return err
+		}
+		*v = ToSpawnIntent(msg)
+	case *gamelogic.MoveIntent:
+		msg := &MoveIntent{}
+		if err := proto.Unmarshal(data, msg); err != nil {
+			return err
+		}
+		*v = ToMoveIntent(msg)
+	case *routing.GetState:
+		msg := &GetState{}
+		if err := proto.Unmarshal(data, msg); err != nil {
+			return err
+		}
+		*v = ToGetState(msg)
+	case *routing.Join:
+		msg := &Join{}
+		if err := proto.Unmarshal(data, msg); err != nil {
+			return err
+		}
+		*v = ToJoin(msg)
+	case *routing.Session:
+		msg := &Session{}
+		if err := proto.Unmarshal(data, msg); err != nil {
+			return err
+		}
+		*v = ToSession(msg)
+	case *gamelogic.StateDelta:
+		msg := &StateDelta{}
+		if err := proto.Unmarshal(data, msg); err != nil {
+			return err
+		}
+		*v = ToStateDelta(msg)
+	case *gamelogic.WarResult:
+		msg := &WarResult{}
+		if err := proto.Unmarshal(data, msg); err != nil {
+			return err
+		}
+		*v = ToWarResult(msg)
+	default:
+		return fmt.Errorf("cannot decode protobuf into %T", v)
+	}
+	return nil
+}
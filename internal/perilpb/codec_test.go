@@ -0,0 +1,118 @@
+package perilpb
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gabrieldiem/learn-pub-sub-starter/internal/gamelogic"
+	"github.com/gabrieldiem/learn-pub-sub-starter/internal/pubsub"
+	"github.com/gabrieldiem/learn-pub-sub-starter/internal/routing"
+)
+
+func roundTrip[T any](t *testing.T, v T) {
+	t.Helper()
+	dat, err := Codec{}.Marshal(v)
+	if err != nil {
+		t.Fatalf("Marshal(%T): %v", v, err)
+	}
+	var got T
+	err = Codec{}.Unmarshal(dat, &got)
+	if err != nil {
+		t.Fatalf("Unmarshal(%T): %v", v, err)
+	}
+	if !reflect.DeepEqual(got, v) {
+		t.Errorf("%T round-tripped to %+v, want %+v", v, got, v)
+	}
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	units := []gamelogic.Unit{
+		{ID: 1, Rank: gamelogic.RankInfantry, Location: "europe"},
+		{ID: 2, Rank: gamelogic.RankCavalry, Location: "asia"},
+	}
+	alice := gamelogic.Player{Username: "alice", Units: map[int]gamelogic.Unit{1: units[0]}}
+	bob := gamelogic.Player{Username: "bob", Units: map[int]gamelogic.Unit{2: units[1]}}
+	roundTrip(t, gamelogic.ArmyMove{
+		Player:     alice,
+		Units:      units,
+		ToLocation: "asia",
+	})
+	roundTrip(t, gamelogic.RecognitionOfWar{Attacker: alice, Defender: bob})
+	roundTrip(t, routing.PlayingState{IsPaused: true})
+	roundTrip(t, routing.GameLog{CurrentTime: time.Unix(1700000000, 0).UTC(), Message: "hi", Username: "alice"})
+	roundTrip(t, routing.GetPlayingState{})
+	roundTrip(t, gamelogic.SpawnIntent{Location: "europe", Rank: gamelogic.RankInfantry})
+	roundTrip(t, gamelogic.MoveIntent{UnitIDs: []int{1, 2}, ToLocation: "asia"})
+	roundTrip(t, routing.GetState{})
+	roundTrip(t, routing.Join{})
+	roundTrip(t, routing.Session{Token: "abc"})
+	roundTrip(t, gamelogic.StateDelta{Username: "alice", Version: 3, Units: units, Removed: []int{4}, Reset: true})
+	roundTrip(t, gamelogic.WarResult{
+		Attacker:      "alice",
+		Defender:      "bob",
+		Location:      "asia",
+		AttackerUnits: units,
+		DefenderUnits: []gamelogic.Unit{},
+		Winner:        "alice",
+		Loser:         "bob",
+	})
+}
+
+func TestCodecUnknownType(t *testing.T) {
+	_, err := Codec{}.Marshal(struct{}{})
+	if err == nil {
+		t.Error("Marshal of an unknown type succeeded")
+	}
+	var v struct{}
+	err = Codec{}.Unmarshal(nil, &v)
+	if err == nil {
+		t.Error("Unmarshal into an unknown type succeeded")
+	}
+}
+
+// Replies are in the request's content type, so every intent's answer must
+// encode as protobuf too.
+func TestRequestProtobuf(t *testing.T) {
+	b := pubsub.NewMemoryBroker()
+	defer b.Close()
+	err := b.DeclareExchange(routing.ExchangePerilDirect, pubsub.ExchangeDirect, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b.DeclareExchange(routing.ExchangePerilDLX, pubsub.ExchangeFanout, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub, err := pubsub.Serve(b, routing.ExchangePerilDirect, routing.SpawnKey, routing.SpawnKey, pubsub.SimpleQueueTransient,
+		func(ctx context.Context, d pubsub.Delivery[gamelogic.SpawnIntent]) (gamelogic.StateDelta, error) {
+			if d.ContentType != ContentType {
+				t.Errorf("request content type = %s, want %s", d.ContentType, ContentType)
+			}
+			return gamelogic.StateDelta{
+				Username: d.Sender,
+				Version:  1,
+				Units:    []gamelogic.Unit{{ID: 1, Rank: d.Value.Rank, Location: d.Value.Location}},
+				Removed:  []int{},
+			}, nil
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close(context.Background())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	delta, err := pubsub.Request[gamelogic.SpawnIntent, gamelogic.StateDelta](ctx, b,
+		routing.ExchangePerilDirect, routing.SpawnKey,
+		gamelogic.SpawnIntent{Location: "europe", Rank: gamelogic.RankArtillery},
+		pubsub.WithContentType(ContentType), pubsub.WithSender("alice"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if delta.Username != "alice" || len(delta.Units) != 1 || delta.Units[0].Rank != gamelogic.RankArtillery {
+		t.Errorf("reply = %+v", delta)
+	}
+}
@@ -0,0 +1,253 @@
+package perilpb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative peril.proto
+
+import (
+	"github.com/gabrieldiem/learn-pub-sub-starter/internal/gamelogic"
+	"github.com/gabrieldiem/learn-pub-sub-starter/internal/routing"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func FromUnit(u gamelogic.Unit) *Unit {
+	return &Unit{
+		Id:       int64(u.ID),
+		Rank:     string(u.Rank),
+		Location: string(u.Location),
+	}
+}
+
+func ToUnit(u *Unit) gamelogic.Unit {
+	return gamelogic.Unit{
+		ID:       int(u.GetId()),
+		Rank:     gamelogic.UnitRank(u.GetRank()),
+		Location: gamelogic.Location(u.GetLocation()),
+	}
+}
+
+func FromPlayer(p gamelogic.Player) *Player {
+	units := make(map[int64]*Unit, len(p.Units))
+	for id, u := range p.Units {
+		units[int64(id)] = FromUnit(u)
+	}
+	return &Player{
+		Username: p.Username,
+		Units:    units,
+	}
+}
+
+func ToPlayer(p *Player) gamelogic.Player {
+	units := make(map[int]gamelogic.Unit, len(p.GetUnits()))
+	for id, u := range p.GetUnits() {
+		units[int(id)] = ToUnit(u)
+	}
+	return gamelogic.Player{
+		Username: p.GetUsername(),
+		Units:    units,
+	}
+}
+
+func FromArmyMove(mv gamelogic.ArmyMove) *ArmyMove {
+	units := make([]*Unit, 0, len(mv.Units))
+	for _, u := range mv.Units {
+		units = append(units, FromUnit(u))
+	}
+	return &ArmyMove{
+		Player:     FromPlayer(mv.Player),
+		Units:      units,
+		ToLocation: string(mv.ToLocation),
+	}
+}
+
+func ToArmyMove(mv *ArmyMove) gamelogic.ArmyMove {
+	units := make([]gamelogic.Unit, 0, len(mv.GetUnits()))
+	for _, u := range mv.GetUnits() {
+		units = append(units, ToUnit(u))
+	}
+	return gamelogic.ArmyMove{
+		Player:     ToPlayer(mv.GetPlayer()),
+		Units:      units,
+		ToLocation: gamelogic.Location(mv.GetToLocation()),
+	}
+}
+
+func FromRecognitionOfWar(rw gamelogic.RecognitionOfWar) *RecognitionOfWar {
+	return &RecognitionOfWar{
+		Attacker: FromPlayer(rw.Attacker),
+		Defender: FromPlayer(rw.Defender),
+	}
+}
+
+func ToRecognitionOfWar(rw *RecognitionOfWar) gamelogic.RecognitionOfWar {
+	return gamelogic.RecognitionOfWar{
+		Attacker: ToPlayer(rw.GetAttacker()),
+		Defender: ToPlayer(rw.GetDefender()),
+	}
+}
+
+func FromPlayingState(ps routing.PlayingState) *PlayingState {
+	return &PlayingState{
+		IsPaused: ps.IsPaused,
+	}
+}
+
+func ToPlayingState(ps *PlayingState) routing.PlayingState {
+	return routing.PlayingState{
+		IsPaused: ps.GetIsPaused(),
+	}
+}
+
+func FromGameLog(gl routing.GameLog) *GameLog {
+	return &GameLog{
+		CurrentTime: timestamppb.New(gl.CurrentTime),
+		Message:     gl.Message,
+		Username:    gl.Username,
+	}
+}
+
+func ToGameLog(gl *GameLog) routing.GameLog {
+	return routing.GameLog{
+		CurrentTime: gl.GetCurrentTime().AsTime(),
+		Message:     gl.GetMessage(),
+		Username:    gl.GetUsername(),
+	}
+}
+
+func FromGetPlayingState(routing.GetPlayingState) *GetPlayingState {
+	return &GetPlayingState{}
+}
+
+func ToGetPlayingState(*GetPlayingState) routing.GetPlayingState {
+	return routing.GetPlayingState{}
+}
+
+func FromSpawnIntent(in gamelogic.SpawnIntent) *SpawnIntent {
+	return &SpawnIntent{
+		Location: string(in.Location),
+		Rank:     string(in.Rank),
+	}
+}
+
+func ToSpawnIntent(in *SpawnIntent) gamelogic.SpawnIntent {
+	return gamelogic.SpawnIntent{
+		Location: gamelogic.Location(in.GetLocation()),
+		Rank:     gamelogic.UnitRank(in.GetRank()),
+	}
+}
+
+func FromMoveIntent(in gamelogic.MoveIntent) *MoveIntent {
+	return &MoveIntent{
+		UnitIds:    fromIDs(in.UnitIDs),
+		ToLocation: string(in.ToLocation),
+	}
+}
+
+func ToMoveIntent(in *MoveIntent) gamelogic.MoveIntent {
+	return gamelogic.MoveIntent{
+		UnitIDs:    toIDs(in.GetUnitIds()),
+		ToLocation: gamelogic.Location(in.GetToLocation()),
+	}
+}
+
+func FromGetState(routing.GetState) *GetState {
+	return &GetState{}
+}
+
+func ToGetState(*GetState) routing.GetState {
+	return routing.GetState{}
+}
+
+func FromJoin(routing.Join) *Join {
+	return &Join{}
+}
+
+func ToJoin(*Join) routing.Join {
+	return routing.Join{}
+}
+
+func FromSession(s routing.Session) *Session {
+	return &Session{
+		Token: s.Token,
+	}
+}
+
+func ToSession(s *Session) routing.Session {
+	return routing.Session{
+		Token: s.GetToken(),
+	}
+}
+
+func FromStateDelta(d gamelogic.StateDelta) *StateDelta {
+	return &StateDelta{
+		Username: d.Username,
+		Version:  int64(d.Version),
+		Units:    fromUnits(d.Units),
+		Removed:  fromIDs(d.Removed),
+		Reset_:   d.Reset,
+	}
+}
+
+func ToStateDelta(d *StateDelta) gamelogic.StateDelta {
+	return gamelogic.StateDelta{
+		Username: d.GetUsername(),
+		Version:  int(d.GetVersion()),
+		Units:    toUnits(d.GetUnits()),
+		Removed:  toIDs(d.GetRemoved()),
+		Reset:    d.GetReset_(),
+	}
+}
+
+func FromWarResult(w gamelogic.WarResult) *WarResult {
+	return &WarResult{
+		Attacker:      w.Attacker,
+		Defender:      w.Defender,
+		Location:      string(w.Location),
+		AttackerUnits: fromUnits(w.AttackerUnits),
+		DefenderUnits: fromUnits(w.DefenderUnits),
+		Winner:        w.Winner,
+		Loser:         w.Loser,
+	}
+}
+
+func ToWarResult(w *WarResult) gamelogic.WarResult {
+	return gamelogic.WarResult{
+		Attacker:      w.GetAttacker(),
+		Defender:      w.GetDefender(),
+		Location:      gamelogic.Location(w.GetLocation()),
+		AttackerUnits: toUnits(w.GetAttackerUnits()),
+		DefenderUnits: toUnits(w.GetDefenderUnits()),
+		Winner:        w.GetWinner(),
+		Loser:         w.GetLoser(),
+	}
+}
+
+func fromUnits(units []gamelogic.Unit) []*Unit {
+	out := make([]*Unit, 0, len(units))
+	for _, u := range units {
+		out = append(out, FromUnit(u))
+	}
+	return out
+}
+
+func toUnits(units []*Unit) []gamelogic.Unit {
+	out := make([]gamelogic.Unit, 0, len(units))
+	for _, u := range units {
+		out = append(out, ToUnit(u))
+	}
+	return out
+}
+
+func fromIDs(ids []int) []int64 {
+	out := make([]int64, 0, len(ids))
+	for _, id := range ids {
+		out = append(out, int64(id))
+	}
+	return out
+}
+
+func toIDs(ids []int64) []int {
+	out := make([]int, 0, len(ids))
+	for _, id := range ids {
+		out = append(out, int(id))
+	}
+	return out
+}
@@ -0,0 +1,908 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.6
+// 	protoc        (unknown)
+// source: peril.proto
+
+package perilpb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	timestamppb "google.golang.org/protobuf/types/known/timestamppb"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type Unit struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Id            int64                  `protobuf:"varint,1,opt,name=id,proto3" json:"id,omitempty"`
+	Rank          string                 `protobuf:"bytes,2,opt,name=rank,proto3" json:"rank,omitempty"`
+	Location      string                 `protobuf:"bytes,3,opt,name=location,proto3" json:"location,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Unit) Reset() {
+	*x = Unit{}
+	mi := &file_peril_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Unit) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Unit) ProtoMessage() {}
+
+func (x *Unit) ProtoReflect() protoreflect.Message {
+	mi := &file_peril_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Unit.ProtoReflect.Descriptor instead.
+func (*Unit) Descriptor() ([]byte, []int) {
+	return file_peril_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *Unit) GetId() int64 {
+	if x != nil {
+		return x.Id
+	}
+	return 0
+}
+
+func (x *Unit) GetRank() string {
+	if x != nil {
+		return x.Rank
+	}
+	return ""
+}
+
+func (x *Unit) GetLocation() string {
+	if x != nil {
+		return x.Location
+	}
+	return ""
+}
+
+type Player struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Username      string                 `protobuf:"bytes,1,opt,name=username,proto3" json:"username,omitempty"`
+	Units         map[int64]*Unit        `protobuf:"bytes,2,rep,name=units,proto3" json:"units,omitempty" protobuf_key:"varint,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Player) Reset() {
+	*x = Player{}
+	mi := &file_peril_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Player) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Player) ProtoMessage() {}
+
+func (x *Player) ProtoReflect() protoreflect.Message {
+	mi := &file_peril_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Player.ProtoReflect.Descriptor instead.
+func (*Player) Descriptor() ([]byte, []int) {
+	return file_peril_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *Player) GetUsername() string {
+	if x != nil {
+		return x.Username
+	}
+	return ""
+}
+
+func (x *Player) GetUnits() map[int64]*Unit {
+	if x != nil {
+		return x.Units
+	}
+	return nil
+}
+
+type ArmyMove struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Player        *Player                `protobuf:"bytes,1,opt,name=player,proto3" json:"player,omitempty"`
+	Units         []*Unit                `protobuf:"bytes,2,rep,name=units,proto3" json:"units,omitempty"`
+	ToLocation    string                 `protobuf:"bytes,3,opt,name=to_location,json=toLocation,proto3" json:"to_location,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ArmyMove) Reset() {
+	*x = ArmyMove{}
+	mi := &file_peril_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ArmyMove) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ArmyMove) ProtoMessage() {}
+
+func (x *ArmyMove) ProtoReflect() protoreflect.Message {
+	mi := &file_peril_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ArmyMove.ProtoReflect.Descriptor instead.
+func (*ArmyMove) Descriptor() ([]byte, []int) {
+	return file_peril_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *ArmyMove) GetPlayer() *Player {
+	if x != nil {
+		return x.Player
+	}
+	return nil
+}
+
+func (x *ArmyMove) GetUnits() []*Unit {
+	if x != nil {
+		return x.Units
+	}
+	return nil
+}
+
+func (x *ArmyMove) GetToLocation() string {
+	if x != nil {
+		return x.ToLocation
+	}
+	return ""
+}
+
+type RecognitionOfWar struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Attacker      *Player                `protobuf:"bytes,1,opt,name=attacker,proto3" json:"attacker,omitempty"`
+	Defender      *Player                `protobuf:"bytes,2,opt,name=defender,proto3" json:"defender,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *RecognitionOfWar) Reset() {
+	*x = RecognitionOfWar{}
+	mi := &file_peril_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *RecognitionOfWar) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*RecognitionOfWar) ProtoMessage() {}
+
+func (x *RecognitionOfWar) ProtoReflect() protoreflect.Message {
+	mi := &file_peril_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use RecognitionOfWar.ProtoReflect.Descriptor instead.
+func (*RecognitionOfWar) Descriptor() ([]byte, []int) {
+	return file_peril_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *RecognitionOfWar) GetAttacker() *Player {
+	if x != nil {
+		return x.Attacker
+	}
+	return nil
+}
+
+func (x *RecognitionOfWar) GetDefender() *Player {
+	if x != nil {
+		return x.Defender
+	}
+	return nil
+}
+
+type PlayingState struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	IsPaused      bool                   `protobuf:"varint,1,opt,name=is_paused,json=isPaused,proto3" json:"is_paused,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *PlayingState) Reset() {
+	*x = PlayingState{}
+	mi := &file_peril_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *PlayingState) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*PlayingState) ProtoMessage() {}
+
+func (x *PlayingState) ProtoReflect() protoreflect.Message {
+	mi := &file_peril_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use PlayingState.ProtoReflect.Descriptor instead.
+func (*PlayingState) Descriptor() ([]byte, []int) {
+	return file_peril_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *PlayingState) GetIsPaused() bool {
+	if x != nil {
+		return x.IsPaused
+	}
+	return false
+}
+
+type GameLog struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	CurrentTime   *timestamppb.Timestamp `protobuf:"bytes,1,opt,name=current_time,json=currentTime,proto3" json:"current_time,omitempty"`
+	Message       string                 `protobuf:"bytes,2,opt,name=message,proto3" json:"message,omitempty"`
+	Username      string                 `protobuf:"bytes,3,opt,name=username,proto3" json:"username,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *GameLog) Reset() {
+	*x = GameLog{}
+	mi := &file_peril_proto_msgTypes[5]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GameLog) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GameLog) ProtoMessage() {}
+
+func (x *GameLog) ProtoReflect() protoreflect.Message {
+	mi := &file_peril_proto_msgTypes[5]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GameLog.ProtoReflect.Descriptor instead.
+func (*GameLog) Descriptor() ([]byte, []int) {
+	return file_peril_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *GameLog) GetCurrentTime() *timestamppb.Timestamp {
+	if x != nil {
+		return x.CurrentTime
+	}
+	return nil
+}
+
+func (x *GameLog) GetMessage() string {
+	if x != nil {
+		return x.Message
+	}
+	return ""
+}
+
+func (x *GameLog) GetUsername() string {
+	if x != nil {
+		return x.Username
+	}
+	return ""
+}
+
+type GetPlayingState struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *GetPlayingState) Reset() {
+	*x = GetPlayingState{}
+	mi := &file_peril_proto_msgTypes[6]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GetPlayingState) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GetPlayingState) ProtoMessage() {}
+
+func (x *GetPlayingState) ProtoReflect() protoreflect.Message {
+	mi := &file_peril_proto_msgTypes[6]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GetPlayingState.ProtoReflect.Descriptor instead.
+func (*GetPlayingState) Descriptor() ([]byte, []int) {
+	return file_peril_proto_rawDescGZIP(), []int{6}
+}
+
+type SpawnIntent struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Location      string                 `protobuf:"bytes,1,opt,name=location,proto3" json:"location,omitempty"`
+	Rank          string                 `protobuf:"bytes,2,opt,name=rank,proto3" json:"rank,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *SpawnIntent) Reset() {
+	*x = SpawnIntent{}
+	mi := &file_peril_proto_msgTypes[7]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *SpawnIntent) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SpawnIntent) ProtoMessage() {}
+
+func (x *SpawnIntent) ProtoReflect() protoreflect.Message {
+	mi := &file_peril_proto_msgTypes[7]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SpawnIntent.ProtoReflect.Descriptor instead.
+func (*SpawnIntent) Descriptor() ([]byte, []int) {
+	return file_peril_proto_rawDescGZIP(), []int{7}
+}
+
+func (x *SpawnIntent) GetLocation() string {
+	if x != nil {
+		return x.Location
+	}
+	return ""
+}
+
+func (x *SpawnIntent) GetRank() string {
+	if x != nil {
+		return x.Rank
+	}
+	return ""
+}
+
+type MoveIntent struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	UnitIds       []int64                `protobuf:"varint,1,rep,packed,name=unit_ids,json=unitIds,proto3" json:"unit_ids,omitempty"`
+	ToLocation    string                 `protobuf:"bytes,2,opt,name=to_location,json=toLocation,proto3" json:"to_location,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *MoveIntent) Reset() {
+	*x = MoveIntent{}
+	mi := &file_peril_proto_msgTypes[8]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *MoveIntent) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*MoveIntent) ProtoMessage() {}
+
+func (x *MoveIntent) ProtoReflect() protoreflect.Message {
+	mi := &file_peril_proto_msgTypes[8]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use MoveIntent.ProtoReflect.Descriptor instead.
+func (*MoveIntent) Descriptor() ([]byte, []int) {
+	return file_peril_proto_rawDescGZIP(), []int{8}
+}
+
+func (x *MoveIntent) GetUnitIds() []int64 {
+	if x != nil {
+		return x.UnitIds
+	}
+	return nil
+}
+
+func (x *MoveIntent) GetToLocation() string {
+	if x != nil {
+		return x.ToLocation
+	}
+	return ""
+}
+
+type GetState struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *GetState) Reset() {
+	*x = GetState{}
+	mi := &file_peril_proto_msgTypes[9]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GetState) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GetState) ProtoMessage() {}
+
+func (x *GetState) ProtoReflect() protoreflect.Message {
+	mi := &file_peril_proto_msgTypes[9]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GetState.ProtoReflect.Descriptor instead.
+func (*GetState) Descriptor() ([]byte, []int) {
+	return file_peril_proto_rawDescGZIP(), []int{9}
+}
+
+type Join struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Join) Reset() {
+	*x = Join{}
+	mi := &file_peril_proto_msgTypes[10]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Join) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Join) ProtoMessage() {}
+
+func (x *Join) ProtoReflect() protoreflect.Message {
+	mi := &file_peril_proto_msgTypes[10]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Join.ProtoReflect.Descriptor instead.
+func (*Join) Descriptor() ([]byte, []int) {
+	return file_peril_proto_rawDescGZIP(), []int{10}
+}
+
+type Session struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Token         string                 `protobuf:"bytes,1,opt,name=token,proto3" json:"token,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Session) Reset() {
+	*x = Session{}
+	mi := &file_peril_proto_msgTypes[11]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Session) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Session) ProtoMessage() {}
+
+func (x *Session) ProtoReflect() protoreflect.Message {
+	mi := &file_peril_proto_msgTypes[11]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Session.ProtoReflect.Descriptor instead.
+func (*Session) Descriptor() ([]byte, []int) {
+	return file_peril_proto_rawDescGZIP(), []int{11}
+}
+
+func (x *Session) GetToken() string {
+	if x != nil {
+		return x.Token
+	}
+	return ""
+}
+
+type StateDelta struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Username      string                 `protobuf:"bytes,1,opt,name=username,proto3" json:"username,omitempty"`
+	Version       int64                  `protobuf:"varint,2,opt,name=version,proto3" json:"version,omitempty"`
+	Units         []*Unit                `protobuf:"bytes,3,rep,name=units,proto3" json:"units,omitempty"`
+	Removed       []int64                `protobuf:"varint,4,rep,packed,name=removed,proto3" json:"removed,omitempty"`
+	Reset_        bool                   `protobuf:"varint,5,opt,name=reset,proto3" json:"reset,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *StateDelta) Reset() {
+	*x = StateDelta{}
+	mi := &file_peril_proto_msgTypes[12]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *StateDelta) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*StateDelta) ProtoMessage() {}
+
+func (x *StateDelta) ProtoReflect() protoreflect.Message {
+	mi := &file_peril_proto_msgTypes[12]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use StateDelta.ProtoReflect.Descriptor instead.
+func (*StateDelta) Descriptor() ([]byte, []int) {
+	return file_peril_proto_rawDescGZIP(), []int{12}
+}
+
+func (x *StateDelta) GetUsername() string {
+	if x != nil {
+		return x.Username
+	}
+	return ""
+}
+
+func (x *StateDelta) GetVersion() int64 {
+	if x != nil {
+		return x.Version
+	}
+	return 0
+}
+
+func (x *StateDelta) GetUnits() []*Unit {
+	if x != nil {
+		return x.Units
+	}
+	return nil
+}
+
+func (x *StateDelta) GetRemoved() []int64 {
+	if x != nil {
+		return x.Removed
+	}
+	return nil
+}
+
+func (x *StateDelta) GetReset_() bool {
+	if x != nil {
+		return x.Reset_
+	}
+	return false
+}
+
+type WarResult struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Attacker      string                 `protobuf:"bytes,1,opt,name=attacker,proto3" json:"attacker,omitempty"`
+	Defender      string                 `protobuf:"bytes,2,opt,name=defender,proto3" json:"defender,omitempty"`
+	Location      string                 `protobuf:"bytes,3,opt,name=location,proto3" json:"location,omitempty"`
+	AttackerUnits []*Unit                `protobuf:"bytes,4,rep,name=attacker_units,json=attackerUnits,proto3" json:"attacker_units,omitempty"`
+	DefenderUnits []*Unit                `protobuf:"bytes,5,rep,name=defender_units,json=defenderUnits,proto3" json:"defender_units,omitempty"`
+	Winner        string                 `protobuf:"bytes,6,opt,name=winner,proto3" json:"winner,omitempty"`
+	Loser         string                 `protobuf:"bytes,7,opt,name=loser,proto3" json:"loser,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *WarResult) Reset() {
+	*x = WarResult{}
+	mi := &file_peril_proto_msgTypes[13]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *WarResult) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*WarResult) ProtoMessage() {}
+
+func (x *WarResult) ProtoReflect() protoreflect.Message {
+	mi := &file_peril_proto_msgTypes[13]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use WarResult.ProtoReflect.Descriptor instead.
+func (*WarResult) Descriptor() ([]byte, []int) {
+	return file_peril_proto_rawDescGZIP(), []int{13}
+}
+
+func (x *WarResult) GetAttacker() string {
+	if x != nil {
+		return x.Attacker
+	}
+	return ""
+}
+
+func (x *WarResult) GetDefender() string {
+	if x != nil {
+		return x.Defender
+	}
+	return ""
+}
+
+func (x *WarResult) GetLocation() string {
+	if x != nil {
+		return x.Location
+	}
+	return ""
+}
+
+func (x *WarResult) GetAttackerUnits() []*Unit {
+	if x != nil {
+		return x.AttackerUnits
+	}
+	return nil
+}
+
+func (x *WarResult) GetDefenderUnits() []*Unit {
+	if x != nil {
+		return x.DefenderUnits
+	}
+	return nil
+}
+
+func (x *WarResult) GetWinner() string {
+	if x != nil {
+		return x.Winner
+	}
+	return ""
+}
+
+func (x *WarResult) GetLoser() string {
+	if x != nil {
+		return x.Loser
+	}
+	return ""
+}
+
+var File_peril_proto protoreflect.FileDescriptor
+
+const file_peril_proto_rawDesc = "" +
+	"\n" +
+	"\vperil.proto\x12\bperil.v1\x1a\x1fgoogle/protobuf/timestamp.proto\"F\n" +
+	"\x04Unit\x12\x0e\n" +
+	"\x02id\x18\x01 \x01(\x03R\x02id\x12\x12\n" +
+	"\x04rank\x18\x02 \x01(\tR\x04rank\x12\x1a\n" +
+	"\blocation\x18\x03 \x01(\tR\blocation\"\xa1\x01\n" +
+	"\x06Player\x12\x1a\n" +
+	"\busername\x18\x01 \x01(\tR\busername\x121\n" +
+	"\x05units\x18\x02 \x03(\v2\x1b.peril.v1.Player.UnitsEntryR\x05units\x1aH\n" +
+	"\n" +
+	"UnitsEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\x03R\x03key\x12$\n" +
+	"\x05value\x18\x02 \x01(\v2\x0e.peril.v1.UnitR\x05value:\x028\x01\"{\n" +
+	"\bArmyMove\x12(\n" +
+	"\x06player\x18\x01 \x01(\v2\x10.peril.v1.PlayerR\x06player\x12$\n" +
+	"\x05units\x18\x02 \x03(\v2\x0e.peril.v1.UnitR\x05units\x12\x1f\n" +
+	"\vto_location\x18\x03 \x01(\tR\n" +
+	"toLocation\"n\n" +
+	"\x10RecognitionOfWar\x12,\n" +
+	"\battacker\x18\x01 \x01(\v2\x10.peril.v1.PlayerR\battacker\x12,\n" +
+	"\bdefender\x18\x02 \x01(\v2\x10.peril.v1.PlayerR\bdefender\"+\n" +
+	"\fPlayingState\x12\x1b\n" +
+	"\tis_paused\x18\x01 \x01(\bR\bisPaused\"~\n" +
+	"\aGameLog\x12=\n" +
+	"\fcurrent_time\x18\x01 \x01(\v2\x1a.google.protobuf.TimestampR\vcurrentTime\x12\x18\n" +
+	"\amessage\x18\x02 \x01(\tR\amessage\x12\x1a\n" +
+	"\busername\x18\x03 \x01(\tR\busername\"\x11\n" +
+	"\x0fGetPlayingState\"=\n" +
+	"\vSpawnIntent\x12\x1a\n" +
+	"\blocation\x18\x01 \x01(\tR\blocation\x12\x12\n" +
+	"\x04rank\x18\x02 \x01(\tR\x04rank\"H\n" +
+	"\n" +
+	"MoveIntent\x12\x19\n" +
+	"\bunit_ids\x18\x01 \x03(\x03R\aunitIds\x12\x1f\n" +
+	"\vto_location\x18\x02 \x01(\tR\n" +
+	"toLocation\"\n" +
+	"\n" +
+	"\bGetState\"\x06\n" +
+	"\x04Join\"\x1f\n" +
+	"\aSession\x12\x14\n" +
+	"\x05token\x18\x01 \x01(\tR\x05token\"\x98\x01\n" +
+	"\n" +
+	"StateDelta\x12\x1a\n" +
+	"\busername\x18\x01 \x01(\tR\busername\x12\x18\n" +
+	"\aversion\x18\x02 \x01(\x03R\aversion\x12$\n" +
+	"\x05units\x18\x03 \x03(\v2\x0e.peril.v1.UnitR\x05units\x12\x18\n" +
+	"\aremoved\x18\x04 \x03(\x03R\aremoved\x12\x14\n" +
+	"\x05reset\x18\x05 \x01(\bR\x05reset\"\xfb\x01\n" +
+	"\tWarResult\x12\x1a\n" +
+	"\battacker\x18\x01 \x01(\tR\battacker\x12\x1a\n" +
+	"\bdefender\x18\x02 \x01(\tR\bdefender\x12\x1a\n" +
+	"\blocation\x18\x03 \x01(\tR\blocation\x125\n" +
+	"\x0eattacker_units\x18\x04 \x03(\v2\x0e.peril.v1.UnitR\rattackerUnits\x125\n" +
+	"\x0edefender_units\x18\x05 \x03(\v2\x0e.peril.v1.UnitR\rdefenderUnits\x12\x16\n" +
+	"\x06winner\x18\x06 \x01(\tR\x06winner\x12\x14\n" +
+	"\x05loser\x18\a \x01(\tR\x05loserB?Z=github.com/gabrieldiem/learn-pub-sub-starter/internal/perilpbb\x06proto3"
+
+var (
+	file_peril_proto_rawDescOnce sync.Once
+	file_peril_proto_rawDescData []byte
+)
+
+func file_peril_proto_rawDescGZIP() []byte {
+	file_peril_proto_rawDescOnce.Do(func() {
+		file_peril_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_peril_proto_rawDesc), len(file_peril_proto_rawDesc)))
+	})
+	return file_peril_proto_rawDescData
+}
+
+var file_peril_proto_msgTypes = make([]protoimpl.MessageInfo, 15)
+var file_peril_proto_goTypes = []any{
+	(*Unit)(nil),                  // 0: peril.v1.Unit
+	(*Player)(nil),                // 1: peril.v1.Player
+	(*ArmyMove)(nil),              // 2: peril.v1.ArmyMove
+	(*RecognitionOfWar)(nil),      // 3: peril.v1.RecognitionOfWar
+	(*PlayingState)(nil),          // 4: peril.v1.PlayingState
+	(*GameLog)(nil),               // 5: peril.v1.GameLog
+	(*GetPlayingState)(nil),       // 6: peril.v1.GetPlayingState
+	(*SpawnIntent)(nil),           // 7: peril.v1.SpawnIntent
+	(*MoveIntent)(nil),            // 8: peril.v1.MoveIntent
+	(*GetState)(nil),              // 9: peril.v1.GetState
+	(*Join)(nil),                  // 10: peril.v1.Join
+	(*Session)(nil),               // 11: peril.v1.Session
+	(*StateDelta)(nil),            // 12: peril.v1.StateDelta
+	(*WarResult)(nil),             // 13: peril.v1.WarResult
+	nil,                           // 14: peril.v1.Player.UnitsEntry
+	(*timestamppb.Timestamp)(nil), // 15: google.protobuf.Timestamp
+}
+var file_peril_proto_depIdxs = []int32{
+	14, // 0: peril.v1.Player.units:type_name -> peril.v1.Player.UnitsEntry
+	1,  // 1: peril.v1.ArmyMove.player:type_name -> peril.v1.Player
+	0,  // 2: peril.v1.ArmyMove.units:type_name -> peril.v1.Unit
+	1,  // 3: peril.v1.RecognitionOfWar.attacker:type_name -> peril.v1.Player
+	1,  // 4: peril.v1.RecognitionOfWar.defender:type_name -> peril.v1.Player
+	15, // 5: peril.v1.GameLog.current_time:type_name -> google.protobuf.Timestamp
+	0,  // 6: peril.v1.StateDelta.units:type_name -> peril.v1.Unit
+	0,  // 7: peril.v1.WarResult.attacker_units:type_name -> peril.v1.Unit
+	0,  // 8: peril.v1.WarResult.defender_units:type_name -> peril.v1.Unit
+	0,  // 9: peril.v1.Player.UnitsEntry.value:type_name -> peril.v1.Unit
+	10, // [10:10] is the sub-list for method output_type
+	10, // [10:10] is the sub-list for method input_type
+	10, // [10:10] is the sub-list for extension type_name
+	10, // [10:10] is the sub-list for extension extendee
+	0,  // [0:10] is the sub-list for field type_name
+}
+
+func init() { file_peril_proto_init() }
+func file_peril_proto_init() {
+	if File_peril_proto != nil {
+		return
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_peril_proto_rawDesc), len(file_peril_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   15,
+			NumExtensions: 0,
+			NumServices:   0,
+		},
+		GoTypes:           file_peril_proto_goTypes,
+		DependencyIndexes: file_peril_proto_depIdxs,
+		MessageInfos:      file_peril_proto_msgTypes,
+	}.Build()
+	File_peril_proto = out.File
+	file_peril_proto_goTypes = nil
+	file_peril_proto_depIdxs = nil
+}
@@ -0,0 +1,744 @@
+package pubsub
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+type AMQPOptions struct {
+	// Vhost overrides the one in the URL when set. Heartbeat defaults to 10
+	// seconds. TLS is used for amqps:// URLs.
+	Vhost     string
+	Heartbeat time.Duration
+	TLS       *tls.Config
+
+	// ExternalAuth authenticates with the client certificate in TLS through
+	// the EXTERNAL mechanism. Otherwise Username and Password, when set,
+	// replace the credentials in the URL.
+	ExternalAuth bool
+	Username     string
+	Password     string
+
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// OnDisconnect is called when the connection to the broker is lost, and
+	// OnReconnect once it has been restored along with the declared topology.
+	OnDisconnect func(err error)
+	OnReconnect  func()
+}
+
+// AMQPBroker is a Broker backed by a RabbitMQ connection. It records every
+// exchange, queue and binding it declares so that they can be restored after
+// the connection drops, and resumes consumers on the new connection.
+type AMQPBroker struct {
+	url  string
+	opts AMQPOptions
+
+	mu     sync.Mutex
+	conn   *amqp.Connection
+	ready  chan struct{}
+	closed bool
+	done   chan struct{}
+
+	exchanges []exchangeDecl
+	queues    []*queueDecl
+	bindings  []bindingDecl
+
+	pubMu     sync.Mutex
+	publishCh *amqp.Channel
+
+	confirmMu sync.Mutex
+	confirmCh *amqp.Channel
+	returns   chan amqp.Return
+}
+
+type exchangeDecl struct {
+	name    string
+	kind    string
+	durable bool
+}
+
+type queueDecl struct {
+	requested string
+	// name is the one handed to the caller, current the one the broker
+	// knows the queue by. They differ for server-named queues once the
+	// connection has been re-established.
+	name    string
+	current string
+	opts    QueueOptions
+}
+
+type bindingDecl struct {
+	queue    string
+	key      string
+	exchange string
+}
+
+func DialAMQP(url string, opts AMQPOptions) (*AMQPBroker, error) {
+	if opts.MinBackoff == 0 {
+		opts.MinBackoff = 500 * time.Millisecond
+	}
+	if opts.MaxBackoff == 0 {
+		opts.MaxBackoff = 30 * time.Second
+	}
+
+	b := &AMQPBroker{
+		url:   url,
+		opts:  opts,
+		ready: make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	conn, err := b.dial()
+	if err != nil {
+		return nil, err
+	}
+	b.connected(conn)
+	return b, nil
+}
+
+func (b *AMQPBroker) dial() (*amqp.Connection, error) {
+	var sasl []amqp.Authentication
+	if b.opts.ExternalAuth {
+		sasl = []amqp.Authentication{&amqp.ExternalAuth{}}
+	} else if b.opts.Username != "" || b.opts.Password != "" {
+		auth := &amqp.PlainAuth{Username: b.opts.Username, Password: b.opts.Password}
+		// Keep whichever of the two was only given in the URL.
+		if uri, err := amqp.ParseURI(b.url); err == nil {
+			if auth.Username == "" {
+				auth.Username = uri.Username
+			}
+			if auth.Password == "" {
+				auth.Password = uri.Password
+			}
+		}
+		sasl = []amqp.Authentication{auth}
+	}
+	return amqp.DialConfig(b.url, amqp.Config{
+		SASL:            sasl,
+		Vhost:           b.opts.Vhost,
+		Heartbeat:       b.opts.Heartbeat,
+		TLSClientConfig: b.opts.TLS,
+		Locale:          "en_US",
+	})
+}
+
+func (b *AMQPBroker) connected(conn *amqp.Connection) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.conn = conn
+	close(b.ready)
+	go b.watch(conn.NotifyClose(make(chan *amqp.Error, 1)))
+}
+
+func (b *AMQPBroker) watch(closes <-chan *amqp.Error) {
+	amqpErr, ok := <-closes
+
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return
+	}
+	b.ready = make(chan struct{})
+	b.mu.Unlock()
+
+	var err error = errors.New("connection closed")
+	if ok && amqpErr != nil {
+		err = amqpErr
+	}
+	if b.opts.OnDisconnect != nil {
+		b.opts.OnDisconnect(err)
+	}
+	b.reconnect()
+}
+
+func (b *AMQPBroker) reconnect() {
+	backoff := b.opts.MinBackoff
+	for {
+		select {
+		case <-time.After(backoff):
+		case <-b.done:
+			return
+		}
+		backoff = min(backoff*2, b.opts.MaxBackoff)
+
+		conn, err := b.dial()
+		if err != nil {
+			continue
+		}
+		if err := b.restore(conn); err != nil {
+			conn.Close()
+			continue
+		}
+		b.connected(conn)
+		if b.opts.OnReconnect != nil {
+			b.opts.OnReconnect()
+		}
+		return
+	}
+}
+
+func (b *AMQPBroker) restore(conn *amqp.Connection) error {
+	ch, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, ex := range b.exchanges {
+		if err := declareExchange(ch, ex.name, ex.kind, ex.durable); err != nil {
+			return err
+		}
+	}
+	for _, q := range b.queues {
+		queue, err := declareQueue(ch, q.requested, q.opts)
+		if err != nil {
+			return err
+		}
+		q.current = queue.Name
+	}
+	for _, binding := range b.bindings {
+		if err := bindQueue(ch, b.resolveLocked(binding.queue), binding.key, binding.exchange); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *AMQPBroker) resolveLocked(queueName string) string {
+	for _, q := range b.queues {
+		if q.name == queueName {
+			return q.current
+		}
+	}
+	return queueName
+}
+
+// connection waits until the broker is connected.
+func (b *AMQPBroker) connection(ctx context.Context) (*amqp.Connection, error) {
+	for {
+		b.mu.Lock()
+		if b.closed {
+			b.mu.Unlock()
+			return nil, ErrBrokerClosed
+		}
+		ready := b.ready
+		conn := b.conn
+		b.mu.Unlock()
+
+		select {
+		case <-ready:
+			if !conn.IsClosed() {
+				return conn, nil
+			}
+			// The close notification has not been handled yet.
+			select {
+			case <-time.After(10 * time.Millisecond):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-b.done:
+			return nil, ErrBrokerClosed
+		}
+	}
+}
+
+func (b *AMQPBroker) withChannel(fn func(ch *amqp.Channel) error) error {
+	conn, err := b.connection(context.Background())
+	if err != nil {
+		return err
+	}
+	ch, err := conn.Channel()
+	if err != nil {
+		return fmt.Errorf("could not create channel: %v", err)
+	}
+	defer ch.Close()
+	return fn(ch)
+}
+
+func (b *AMQPBroker) DeclareExchange(name, kind string, durable bool) error {
+	err := b.withChannel(func(ch *amqp.Channel) error {
+		return declareExchange(ch, name, kind, durable)
+	})
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, ex := range b.exchanges {
+		if ex.name == name {
+			return nil
+		}
+	}
+	b.exchanges = append(b.exchanges, exchangeDecl{name: name, kind: kind, durable: durable})
+	return nil
+}
+
+func (b *AMQPBroker) DeclareQueue(name string, opts QueueOptions) (string, error) {
+	var queue amqp.Queue
+	err := b.withChannel(func(ch *amqp.Channel) error {
+		var err error
+		queue, err = declareQueue(ch, name, opts)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, q := range b.queues {
+		if q.current == queue.Name {
+			return q.name, nil
+		}
+	}
+	b.queues = append(b.queues, &queueDecl{
+		requested: name,
+		name:      queue.Name,
+		current:   queue.Name,
+		opts:      opts,
+	})
+	return queue.Name, nil
+}
+
+func (b *AMQPBroker) BindQueue(queueName, key, exchange string) error {
+	b.mu.Lock()
+	current := b.resolveLocked(queueName)
+	b.mu.Unlock()
+
+	err := b.withChannel(func(ch *amqp.Channel) error {
+		return bindQueue(ch, current, key, exchange)
+	})
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	binding := bindingDecl{queue: queueName, key: key, exchange: exchange}
+	for _, existing := range b.bindings {
+		if existing == binding {
+			return nil
+		}
+	}
+	b.bindings = append(b.bindings, binding)
+	return nil
+}
+
+func declareExchange(ch *amqp.Channel, name, kind string, durable bool) error {
+	return ch.ExchangeDeclare(
+		name,    // name
+		kind,    // type
+		durable, // durable
+		false,   // auto-deleted
+		false,   // internal
+		false,   // no-wait
+		nil,     // args
+	)
+}
+
+func declareQueue(ch *amqp.Channel, name string, opts QueueOptions) (amqp.Queue, error) {
+	return ch.QueueDeclare(
+		name,            // name
+		opts.Durable,    // durable
+		opts.AutoDelete, // delete when unused
+		opts.Exclusive,  // exclusive
+		false,           // no-wait
+		toTable(opts.Args),
+	)
+}
+
+func bindQueue(ch *amqp.Channel, queueName, key, exchange string) error {
+	return ch.QueueBind(
+		queueName, // queue name
+		key,       // routing key
+		exchange,  // exchange
+		false,     // no-wait
+		nil,       // args
+	)
+}
+
+// publishChannel returns the channel used for publishing, opening a new one
+// when the previous channel or connection went away. Callers hold pubMu.
+func (b *AMQPBroker) publishChannel(ctx context.Context) (*amqp.Channel, error) {
+	if b.publishCh != nil && !b.publishCh.IsClosed() {
+		return b.publishCh, nil
+	}
+	conn, err := b.connection(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ch, err := conn.Channel()
+	if err != nil {
+		return nil, fmt.Errorf("could not create channel: %v", err)
+	}
+	b.publishCh = ch
+	return ch, nil
+}
+
+func (b *AMQPBroker) Publish(ctx context.Context, exchange, key string, msg Message) error {
+	b.pubMu.Lock()
+	defer b.pubMu.Unlock()
+	ch, err := b.publishChannel(ctx)
+	if err != nil {
+		return err
+	}
+	return ch.PublishWithContext(ctx, exchange, key, false, false, toPublishing(msg))
+}
+
+// confirmChannel is the publishChannel counterpart for confirmed publishes.
+// Callers hold confirmMu.
+func (b *AMQPBroker) confirmChannel(ctx context.Context) (*amqp.Channel, error) {
+	if b.confirmCh != nil && !b.confirmCh.IsClosed() {
+		return b.confirmCh, nil
+	}
+	conn, err := b.connection(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ch, err := conn.Channel()
+	if err != nil {
+		return nil, fmt.Errorf("could not create channel: %v", err)
+	}
+	if err := ch.Confirm(false); err != nil {
+		ch.Close()
+		return nil, fmt.Errorf("could not enable confirm mode: %v", err)
+	}
+	b.confirmCh = ch
+	b.returns = ch.NotifyReturn(make(chan amqp.Return, 1))
+	return ch, nil
+}
+
+func (b *AMQPBroker) PublishConfirmed(ctx context.Context, exchange, key string, msg Message) error {
+	// Publishes are serialized so that a returned message can only belong to
+	// the publish currently waiting for its confirmation.
+	b.confirmMu.Lock()
+	defer b.confirmMu.Unlock()
+	ch, err := b.confirmChannel(ctx)
+	if err != nil {
+		return err
+	}
+
+	dc, err := ch.PublishWithDeferredConfirmWithContext(ctx, exchange, key, true, false, toPublishing(msg))
+	if err != nil {
+		return err
+	}
+
+	err = awaitConfirm(ctx, dc, b.returns)
+	var unroutable *UnroutableError
+	if err != nil && !errors.Is(err, ErrPublishNacked) && !errors.As(err, &unroutable) {
+		// A late return or confirmation would be attributed to the next
+		// publish, so start over on a fresh channel.
+		ch.Close()
+	}
+	return err
+}
+
+// confirmation is the part of amqp.DeferredConfirmation awaitConfirm uses.
+type confirmation interface {
+	WaitContext(ctx context.Context) (bool, error)
+}
+
+// awaitConfirm waits for the confirmation of a mandatory publish, and reports
+// it unroutable if the broker returned it first.
+func awaitConfirm(ctx context.Context, dc confirmation, returns <-chan amqp.Return) error {
+	acked, err := dc.WaitContext(ctx)
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			return ErrConfirmTimeout
+		}
+		return err
+	}
+	if !acked {
+		return ErrPublishNacked
+	}
+
+	// RabbitMQ sends basic.return before the basic.ack of the same message.
+	select {
+	case ret := <-returns:
+		return &UnroutableError{
+			Exchange:  ret.Exchange,
+			Key:       ret.RoutingKey,
+			ReplyCode: int(ret.ReplyCode),
+			ReplyText: ret.ReplyText,
+		}
+	default:
+		return nil
+	}
+}
+
+func (b *AMQPBroker) Consume(queueName string, opts ConsumeOptions) (Consumer, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	ch, msgs, err := b.consume(ctx, queueName, opts)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	c := &amqpConsumer{
+		broker:     b,
+		queue:      queueName,
+		opts:       opts,
+		deliveries: make(chan RawDelivery),
+		ctx:        ctx,
+		cancel:     cancel,
+		ch:         ch,
+	}
+	go c.run(msgs)
+	return c, nil
+}
+
+func (b *AMQPBroker) consume(ctx context.Context, queueName string, opts ConsumeOptions) (*amqp.Channel, <-chan amqp.Delivery, error) {
+	conn, err := b.connection(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	ch, err := conn.Channel()
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not create channel: %v", err)
+	}
+	if opts.Prefetch > 0 {
+		err = ch.Qos(opts.Prefetch, 0, false)
+		if err != nil {
+			ch.Close()
+			return nil, nil, fmt.Errorf("could not set prefetch: %v", err)
+		}
+	}
+
+	b.mu.Lock()
+	current := b.resolveLocked(queueName)
+	b.mu.Unlock()
+
+	msgs, err := ch.Consume(
+		current, // queue
+		"",      // consumer
+		false,   // auto-ack
+		false,   // exclusive
+		false,   // no-local
+		false,   // no-wait
+		nil,     // args
+	)
+	if err != nil {
+		ch.Close()
+		return nil, nil, err
+	}
+	return ch, msgs, nil
+}
+
+func (b *AMQPBroker) Close() error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return nil
+	}
+	b.closed = true
+	close(b.done)
+	conn := b.conn
+	b.mu.Unlock()
+	forgetRetryDelays(b)
+	return conn.Close()
+}
+
+type amqpConsumer struct {
+	broker     *AMQPBroker
+	queue      string
+	opts       ConsumeOptions
+	deliveries chan RawDelivery
+	ctx        context.Context
+	cancel     context.CancelFunc
+
+	mu sync.Mutex
+	ch *amqp.Channel
+}
+
+// run forwards deliveries until the consumer is closed, consuming again on a
+// fresh channel whenever the previous one goes away.
+func (c *amqpConsumer) run(msgs <-chan amqp.Delivery) {
+	defer close(c.deliveries)
+	for {
+		for msg := range msgs {
+			select {
+			case c.deliveries <- fromAMQPDelivery(msg):
+			case <-c.ctx.Done():
+				return
+			}
+		}
+
+		next, ok := c.resume()
+		if !ok {
+			return
+		}
+		msgs = next
+	}
+}
+
+func (c *amqpConsumer) resume() (<-chan amqp.Delivery, bool) {
+	backoff := c.broker.opts.MinBackoff
+	for {
+		ch, msgs, err := c.broker.consume(c.ctx, c.queue, c.opts)
+		if err == nil {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			if c.ctx.Err() != nil {
+				ch.Close()
+				return nil, false
+			}
+			c.ch = ch
+			return msgs, true
+		}
+		if errors.Is(err, ErrBrokerClosed) {
+			return nil, false
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-c.ctx.Done():
+			return nil, false
+		}
+		backoff = min(backoff*2, c.broker.opts.MaxBackoff)
+	}
+}
+
+func (c *amqpConsumer) Deliveries() <-chan RawDelivery {
+	return c.deliveries
+}
+
+func (c *amqpConsumer) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cancel()
+	if c.ch.IsClosed() {
+		return nil
+	}
+	return c.ch.Close()
+}
+
+func toPublishing(msg Message) amqp.Publishing {
+	return amqp.Publishing{
+		ContentType:   msg.ContentType,
+		MessageId:     msg.MessageID,
+		CorrelationId: msg.CorrelationID,
+		ReplyTo:       msg.ReplyTo,
+		Timestamp:     msg.Timestamp,
+		Expiration:    expirationOf(msg.Expiration),
+		AppId:         msg.AppID,
+		Type:          msg.Type,
+		Headers:       toTable(msg.Headers),
+		Body:          msg.Body,
+	}
+}
+
+func fromAMQPDelivery(msg amqp.Delivery) RawDelivery {
+	return RawDelivery{
+		Message: Message{
+			ContentType:   msg.ContentType,
+			MessageID:     msg.MessageId,
+			CorrelationID: msg.CorrelationId,
+			ReplyTo:       msg.ReplyTo,
+			Timestamp:     msg.Timestamp,
+			Expiration:    parseExpiration(msg.Expiration),
+			AppID:         msg.AppId,
+			Type:          msg.Type,
+			Headers:       fromTable(msg.Headers),
+			Body:          msg.Body,
+		},
+		Exchange:    msg.Exchange,
+		RoutingKey:  msg.RoutingKey,
+		Redelivered: msg.Redelivered,
+		acker:       amqpAcker{msg},
+	}
+}
+
+// expirationOf and parseExpiration convert between durations and the
+// expiration property of AMQP and STOMP, in milliseconds.
+func expirationOf(d time.Duration) string {
+	if d <= 0 {
+		return ""
+	}
+	// A message that may not wait at all would never be delivered.
+	return strconv.FormatInt(max(d.Milliseconds(), 1), 10)
+}
+
+func parseExpiration(s string) time.Duration {
+	ms, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+// toTable and fromTable convert nested header values between the plain maps
+// used by Message and the amqp.Table type the client library requires.
+func toTable(m map[string]any) amqp.Table {
+	if m == nil {
+		return nil
+	}
+	t := make(amqp.Table, len(m))
+	for k, v := range m {
+		t[k] = toTableValue(v)
+	}
+	return t
+}
+
+func toTableValue(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		return toTable(v)
+	case []any:
+		out := make([]any, len(v))
+		for i, item := range v {
+			out[i] = toTableValue(item)
+		}
+		return out
+	}
+	return v
+}
+
+func fromTable(t amqp.Table) map[string]any {
+	if t == nil {
+		return nil
+	}
+	m := make(map[string]any, len(t))
+	for k, v := range t {
+		m[k] = fromTableValue(v)
+	}
+	return m
+}
+
+func fromTableValue(v any) any {
+	switch v := v.(type) {
+	case amqp.Table:
+		return fromTable(v)
+	case []any:
+		out := make([]any, len(v))
+		for i, item := range v {
+			out[i] = fromTableValue(item)
+		}
+		return out
+	}
+	return v
+}
+
+type amqpAcker struct {
+	msg amqp.Delivery
+}
+
+func (a amqpAcker) ack() error {
+	return a.msg.Ack(false)
+}
+
+func (a amqpAcker) nack(requeue bool) error {
+	return a.msg.Nack(false, requeue)
+}
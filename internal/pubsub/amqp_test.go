@@ -0,0 +1,164 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// fakeConfirmation answers WaitContext with acked, or blocks until ctx is
+// done when block is set.
+type fakeConfirmation struct {
+	acked bool
+	err   error
+	block bool
+}
+
+func (c fakeConfirmation) WaitContext(ctx context.Context) (bool, error) {
+	if c.block {
+		<-ctx.Done()
+		return false, ctx.Err()
+	}
+	return c.acked, c.err
+}
+
+func TestAwaitConfirm(t *testing.T) {
+	returned := amqp.Return{Exchange: "ex", RoutingKey: "nobody", ReplyCode: 312, ReplyText: "NO_ROUTE"}
+	tests := []struct {
+		name     string
+		dc       fakeConfirmation
+		returned bool
+		want     error
+	}{
+		{"acked", fakeConfirmation{acked: true}, false, nil},
+		{"nacked", fakeConfirmation{acked: false}, false, ErrPublishNacked},
+		{"returned", fakeConfirmation{acked: true}, true, &UnroutableError{Exchange: "ex", Key: "nobody", ReplyCode: 312, ReplyText: "NO_ROUTE"}},
+		{"timed out", fakeConfirmation{block: true}, false, ErrConfirmTimeout},
+		{"channel closed", fakeConfirmation{err: amqp.ErrClosed}, false, amqp.ErrClosed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			returns := make(chan amqp.Return, 1)
+			if tt.returned {
+				returns <- returned
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+			defer cancel()
+
+			err := awaitConfirm(ctx, tt.dc, returns)
+			var unroutable *UnroutableError
+			if errors.As(tt.want, &unroutable) {
+				if !reflect.DeepEqual(err, tt.want) {
+					t.Errorf("awaitConfirm = %#v, want %#v", err, tt.want)
+				}
+				return
+			}
+			if !errors.Is(err, tt.want) {
+				t.Errorf("awaitConfirm = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestAMQPMessageConversion(t *testing.T) {
+	at := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	msg := Message{
+		ContentType:   ContentTypeJSON,
+		MessageID:     "m1",
+		CorrelationID: "c1",
+		ReplyTo:       "amq.rabbitmq.reply-to",
+		Timestamp:     at,
+		AppID:         "alice",
+		Type:          "routing.GameLog",
+		Headers: map[string]any{
+			HeaderRetryAttempt: int64(2),
+			"x-death": []any{map[string]any{
+				"count":        int64(1),
+				"routing-keys": []any{"war.alice"},
+			}},
+		},
+		Body:       []byte(`{}`),
+		Expiration: 1500 * time.Millisecond,
+	}
+
+	p := toPublishing(msg)
+	if p.Expiration != "1500" {
+		t.Errorf("expiration = %q, want 1500", p.Expiration)
+	}
+	deaths, _ := p.Headers["x-death"].([]any)
+	if len(deaths) != 1 {
+		t.Fatalf("x-death = %#v", p.Headers["x-death"])
+	}
+	if _, ok := deaths[0].(amqp.Table); !ok {
+		t.Errorf("x-death entry is a %T, want an amqp.Table the client can encode", deaths[0])
+	}
+	if err := p.Headers.Validate(); err != nil {
+		t.Errorf("headers are not a valid table: %v", err)
+	}
+
+	got := fromAMQPDelivery(amqp.Delivery{
+		ContentType:   p.ContentType,
+		MessageId:     p.MessageId,
+		CorrelationId: p.CorrelationId,
+		ReplyTo:       p.ReplyTo,
+		Timestamp:     p.Timestamp,
+		Expiration:    p.Expiration,
+		AppId:         p.AppId,
+		Type:          p.Type,
+		Headers:       p.Headers,
+		Body:          p.Body,
+		Exchange:      "ex",
+		RoutingKey:    "war.alice",
+		Redelivered:   true,
+	})
+	if !reflect.DeepEqual(got.Message, msg) {
+		t.Errorf("converted back to %+v, want %+v", got.Message, msg)
+	}
+	if got.Exchange != "ex" || got.RoutingKey != "war.alice" || !got.Redelivered {
+		t.Errorf("delivered from %s %s (redelivered %v)", got.Exchange, got.RoutingKey, got.Redelivered)
+	}
+}
+
+func TestExpiration(t *testing.T) {
+	tests := []struct {
+		d    time.Duration
+		want string
+	}{
+		{0, ""},
+		{-time.Second, ""},
+		{time.Microsecond, "1"},
+		{time.Second, "1000"},
+	}
+	for _, tt := range tests {
+		if got := expirationOf(tt.d); got != tt.want {
+			t.Errorf("expirationOf(%v) = %q, want %q", tt.d, got, tt.want)
+		}
+	}
+	if got := parseExpiration("250"); got != 250*time.Millisecond {
+		t.Errorf("parseExpiration(250) = %v, want 250ms", got)
+	}
+	if got := parseExpiration("soon"); got != 0 {
+		t.Errorf("parseExpiration(soon) = %v, want 0", got)
+	}
+}
+
+func TestResolveServerNamedQueue(t *testing.T) {
+	b := &AMQPBroker{queues: []*queueDecl{
+		{requested: "", name: "amq.gen-first", current: "amq.gen-second"},
+		{requested: "war", name: "war", current: "war"},
+	}}
+	tests := map[string]string{
+		"amq.gen-first": "amq.gen-second",
+		"war":           "war",
+		"undeclared":    "undeclared",
+	}
+	for name, want := range tests {
+		if got := b.resolveLocked(name); got != want {
+			t.Errorf("resolveLocked(%s) = %s, want %s", name, got, want)
+		}
+	}
+}
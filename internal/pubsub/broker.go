@@ -0,0 +1,105 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	ExchangeDirect = "direct"
+	ExchangeTopic  = "topic"
+	ExchangeFanout = "fanout"
+)
+
+var (
+	ErrUnknownDeliveryTag = errors.New("unknown delivery tag")
+	ErrPublishNacked      = errors.New("publish was nacked by the broker")
+	ErrConfirmTimeout     = errors.New("timed out waiting for publish confirmation")
+)
+
+// UnroutableError is returned by confirmed publishes that the broker could
+// not route to any queue.
+type UnroutableError struct {
+	Exchange  string
+	Key       string
+	ReplyCode int
+	ReplyText string
+}
+
+func (e *UnroutableError) Error() string {
+	return fmt.Sprintf("message to exchange %q with key %q was returned: %d %s", e.Exchange, e.Key, e.ReplyCode, e.ReplyText)
+}
+
+// Broker is the transport used by the publish and subscribe helpers.
+// AMQPBroker talks to RabbitMQ, MemoryBroker runs entirely in process.
+type Broker interface {
+	DeclareExchange(name, kind string, durable bool) error
+	// DeclareQueue returns the queue name, which is generated by the broker
+	// when name is empty.
+	DeclareQueue(name string, opts QueueOptions) (string, error)
+	BindQueue(queueName, key, exchange string) error
+	Publish(ctx context.Context, exchange, key string, msg Message) error
+	// PublishConfirmed publishes a mandatory message and waits for the broker
+	// to acknowledge it, returning an *UnroutableError if it was returned.
+	PublishConfirmed(ctx context.Context, exchange, key string, msg Message) error
+	Consume(queueName string, opts ConsumeOptions) (Consumer, error)
+	Close() error
+}
+
+type QueueOptions struct {
+	Durable    bool
+	AutoDelete bool
+	Exclusive  bool
+	Args       map[string]any
+}
+
+type ConsumeOptions struct {
+	// Prefetch limits how many deliveries may be unacknowledged at once,
+	// zero meaning no limit.
+	Prefetch int
+}
+
+type Message struct {
+	ContentType   string
+	MessageID     string
+	CorrelationID string
+	ReplyTo       string
+	Timestamp     time.Time
+	AppID         string
+	Type          string
+	Headers       map[string]any
+	Body          []byte
+	// Expiration is how long the message may wait in a queue before the
+	// broker drops it, zero meaning for ever.
+	Expiration time.Duration
+}
+
+type RawDelivery struct {
+	Message
+	Exchange    string
+	RoutingKey  string
+	Redelivered bool
+
+	acker acker
+}
+
+type acker interface {
+	ack() error
+	nack(requeue bool) error
+}
+
+func (d RawDelivery) Ack() error {
+	return d.acker.ack()
+}
+
+func (d RawDelivery) Nack(requeue bool) error {
+	return d.acker.nack(requeue)
+}
+
+type Consumer interface {
+	Deliveries() <-chan RawDelivery
+	// Close stops the consumer. Unacknowledged deliveries are requeued.
+	Close() error
+}
@@ -0,0 +1,121 @@
+package pubsub
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"sync"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+const (
+	ContentTypeJSON    = "application/json"
+	ContentTypeGob     = "application/gob"
+	ContentTypeMsgPack = "application/msgpack"
+	ContentTypeCBOR    = "application/cbor"
+)
+
+// Codec turns values into message bodies of a single content type and back.
+type Codec interface {
+	ContentType() string
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte, v any) error
+}
+
+var codecs = struct {
+	sync.RWMutex
+	byType map[string]Codec
+}{byType: map[string]Codec{}}
+
+func init() {
+	RegisterCodec(jsonCodec{})
+	RegisterCodec(gobCodec{})
+	RegisterCodec(msgpackCodec{})
+	RegisterCodec(newCBORCodec())
+}
+
+// RegisterCodec makes a codec available to Publish and Subscribe, replacing
+// any codec previously registered for the same content type.
+func RegisterCodec(c Codec) {
+	codecs.Lock()
+	defer codecs.Unlock()
+	codecs.byType[c.ContentType()] = c
+}
+
+// CodecFor looks up the codec for a content type, ignoring parameters such
+// as charset.
+func CodecFor(contentType string) (Codec, error) {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, fmt.Errorf("invalid content type %q: %v", contentType, err)
+	}
+	codecs.RLock()
+	defer codecs.RUnlock()
+	c, ok := codecs.byType[mediaType]
+	if !ok {
+		return nil, fmt.Errorf("no codec registered for content type %q", mediaType)
+	}
+	return c, nil
+}
+
+func decodeAs[T any](contentType string, data []byte) (T, error) {
+	var target T
+	c, err := CodecFor(contentType)
+	if err != nil {
+		return target, err
+	}
+	err = c.Unmarshal(data, &target)
+	return target, err
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) ContentType() string                { return ContentTypeJSON }
+func (jsonCodec) Marshal(v any) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v any) error { return json.Unmarshal(data, v) }
+
+type gobCodec struct{}
+
+func (gobCodec) ContentType() string { return ContentTypeGob }
+
+func (gobCodec) Marshal(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := gob.NewEncoder(&buf)
+	err := enc.Encode(v)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(data []byte, v any) error {
+	dec := gob.NewDecoder(bytes.NewBuffer(data))
+	return dec.Decode(v)
+}
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) ContentType() string                { return ContentTypeMsgPack }
+func (msgpackCodec) Marshal(v any) ([]byte, error)      { return msgpack.Marshal(v) }
+func (msgpackCodec) Unmarshal(data []byte, v any) error { return msgpack.Unmarshal(data, v) }
+
+type cborCodec struct {
+	enc cbor.EncMode
+}
+
+func newCBORCodec() cborCodec {
+	// Keep sub-second precision on timestamps such as GameLog.CurrentTime.
+	enc, err := cbor.EncOptions{Time: cbor.TimeRFC3339Nano}.EncMode()
+	if err != nil {
+		panic(err)
+	}
+	return cborCodec{enc: enc}
+}
+
+func (cborCodec) ContentType() string                { return ContentTypeCBOR }
+func (c cborCodec) Marshal(v any) ([]byte, error)    { return c.enc.Marshal(v) }
+func (cborCodec) Unmarshal(data []byte, v any) error { return cbor.Unmarshal(data, v) }
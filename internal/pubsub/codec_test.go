@@ -0,0 +1,144 @@
+package pubsub
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gabrieldiem/learn-pub-sub-starter/internal/gamelogic"
+	"github.com/gabrieldiem/learn-pub-sub-starter/internal/routing"
+)
+
+var contentTypes = []string{ContentTypeJSON, ContentTypeGob, ContentTypeMsgPack, ContentTypeCBOR}
+
+// roundTrip marshals and unmarshals val, returning what came back.
+func roundTrip[T any](t *testing.T, contentType string, val T) T {
+	t.Helper()
+	c, err := CodecFor(contentType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dat, err := c.Marshal(val)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	got, err := decodeAs[T](contentType, dat)
+	if err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	return got
+}
+
+func TestCodecsRoundTrip(t *testing.T) {
+	log := routing.GameLog{
+		CurrentTime: time.Date(2024, 5, 1, 12, 0, 0, 123456789, time.UTC),
+		Message:     "alice won a war against bob",
+		Username:    "alice",
+	}
+	move := gamelogic.ArmyMove{
+		Player: gamelogic.Player{
+			Username: "bob",
+			Units:    map[int]gamelogic.Unit{7: {ID: 7, Rank: gamelogic.RankCavalry, Location: "asia"}},
+		},
+		Units:      []gamelogic.Unit{{ID: 7, Rank: gamelogic.RankCavalry, Location: "europe"}},
+		ToLocation: "europe",
+	}
+	for _, contentType := range contentTypes {
+		t.Run(contentType, func(t *testing.T) {
+			// Some codecs hand times back in the local time zone.
+			gotLog := roundTrip(t, contentType, log)
+			if !gotLog.CurrentTime.Equal(log.CurrentTime) || gotLog.Message != log.Message || gotLog.Username != log.Username {
+				t.Errorf("round trip gave %+v, want %+v", gotLog, log)
+			}
+			if got := roundTrip(t, contentType, move); !reflect.DeepEqual(got, move) {
+				t.Errorf("round trip gave %+v, want %+v", got, move)
+			}
+			state := routing.PlayingState{IsPaused: true}
+			if got := roundTrip(t, contentType, state); got != state {
+				t.Errorf("round trip gave %+v, want %+v", got, state)
+			}
+		})
+	}
+}
+
+func TestCodecFor(t *testing.T) {
+	tests := []struct {
+		contentType string
+		want        string
+		wantErr     bool
+	}{
+		{"application/json", ContentTypeJSON, false},
+		{"application/json; charset=utf-8", ContentTypeJSON, false},
+		{"application/CBOR", ContentTypeCBOR, false},
+		{"application/xml", "", true},
+		{"", "", true},
+	}
+	for _, tt := range tests {
+		c, err := CodecFor(tt.contentType)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("CodecFor(%q) = %s, want an error", tt.contentType, c.ContentType())
+			}
+			continue
+		}
+		if err != nil || c.ContentType() != tt.want {
+			t.Errorf("CodecFor(%q) = %v, %v, want %s", tt.contentType, c, err, tt.want)
+		}
+	}
+}
+
+// TestSubscribeDecodesByContentType publishes with every codec to a single
+// subscription, which decodes each message with the codec its content type
+// names and those without one as WithDefaultContentType says.
+func TestSubscribeDecodesByContentType(t *testing.T) {
+	b := NewMemoryBroker()
+	defer b.Close()
+	declare(t, b, "ex", ExchangeTopic, nil)
+
+	got := make(chan string, len(contentTypes)+1)
+	sub, err := Subscribe(b, "ex", "logs", "logs.*", SimpleQueueTransient,
+		func(ctx context.Context, d Delivery[routing.GameLog]) Acktype {
+			got <- d.Value.Message
+			return Ack
+		},
+		WithDefaultContentType(ContentTypeGob),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close(context.Background())
+
+	want := []string{}
+	for _, contentType := range contentTypes {
+		err := Publish(b, "ex", "logs.alice", routing.GameLog{Message: "in " + contentType}, WithContentType(contentType))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, "in "+contentType)
+	}
+	gob, err := CodecFor(ContentTypeGob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := gob.Marshal(routing.GameLog{Message: "untyped"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b.Publish(context.Background(), "ex", "logs.alice", Message{Body: body})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = append(want, "untyped")
+
+	for _, w := range want {
+		select {
+		case g := <-got:
+			if g != w {
+				t.Errorf("handled %q, want %q", g, w)
+			}
+		case <-time.After(testTimeout):
+			t.Fatalf("no delivery, want %q", w)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package pubsub
+
+import (
+	"fmt"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Death is one entry of the x-death header RabbitMQ adds to dead-lettered
+// messages.
+type Death struct {
+	Queue       string
+	Reason      string
+	Count       int64
+	Time        time.Time
+	Exchange    string
+	RoutingKeys []string
+}
+
+// DeclareDeadLetterQueue declares a fanout dead-letter exchange and a durable
+// queue collecting everything routed to it.
+func DeclareDeadLetterQueue(b Broker, exchange, queueName string) error {
+	err := b.DeclareExchange(exchange, ExchangeFanout, true)
+	if err != nil {
+		return fmt.Errorf("could not declare dead-letter exchange: %v", err)
+	}
+	queue, err := b.DeclareQueue(queueName, QueueOptions{Durable: true})
+	if err != nil {
+		return fmt.Errorf("could not declare dead-letter queue: %v", err)
+	}
+	err = b.BindQueue(queue, "", exchange)
+	if err != nil {
+		return fmt.Errorf("could not bind dead-letter queue: %v", err)
+	}
+	return nil
+}
+
+// Deaths parses the x-death header, most recent death first. Entries may be
+// plain maps or amqp.Tables, and counts any integer type, as they come out of
+// the different brokers and client libraries.
+func Deaths(headers map[string]any) []Death {
+	entries := headerList(headers["x-death"])
+	deaths := make([]Death, 0, len(entries))
+	for _, e := range entries {
+		entry, ok := headerTable(e)
+		if !ok {
+			continue
+		}
+		d := Death{}
+		d.Queue, _ = entry["queue"].(string)
+		d.Reason, _ = entry["reason"].(string)
+		d.Count, _ = deathCount(entry["count"])
+		d.Time, _ = entry["time"].(time.Time)
+		d.Exchange, _ = entry["exchange"].(string)
+		for _, k := range headerList(entry["routing-keys"]) {
+			if key, ok := k.(string); ok {
+				d.RoutingKeys = append(d.RoutingKeys, key)
+			}
+		}
+		deaths = append(deaths, d)
+	}
+	return deaths
+}
+
+func headerList(v any) []any {
+	switch v := v.(type) {
+	case []any:
+		return v
+	case []string:
+		out := make([]any, len(v))
+		for i, s := range v {
+			out[i] = s
+		}
+		return out
+	case []map[string]any:
+		out := make([]any, len(v))
+		for i, m := range v {
+			out[i] = m
+		}
+		return out
+	case []amqp.Table:
+		out := make([]any, len(v))
+		for i, t := range v {
+			out[i] = t
+		}
+		return out
+	}
+	return nil
+}
+
+func headerTable(v any) (map[string]any, bool) {
+	switch v := v.(type) {
+	case map[string]any:
+		return v, true
+	case amqp.Table:
+		return v, true
+	}
+	return nil, false
+}
+
+func deathCount(v any) (int64, bool) {
+	switch v := v.(type) {
+	case int:
+		return int64(v), true
+	case int8:
+		return int64(v), true
+	case int16:
+		return int64(v), true
+	case int32:
+		return int64(v), true
+	case int64:
+		return v, true
+	case uint8:
+		return int64(v), true
+	case uint16:
+		return int64(v), true
+	case uint32:
+		return int64(v), true
+	}
+	return 0, false
+}
+
+// OriginalDestination returns the exchange and routing key a dead-lettered
+// message was first published to.
+func OriginalDestination(headers map[string]any) (exchange, key string, ok bool) {
+	if exchange, ok := headers[HeaderOriginalExchange].(string); ok {
+		key, _ := headers[HeaderOriginalRoutingKey].(string)
+		return exchange, key, true
+	}
+	deaths := Deaths(headers)
+	if len(deaths) == 0 {
+		return "", "", false
+	}
+	first := deaths[len(deaths)-1]
+	if len(first.RoutingKeys) == 0 {
+		return "", "", false
+	}
+	return first.Exchange, first.RoutingKeys[0], true
+}
@@ -0,0 +1,116 @@
+package pubsub
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestDeaths(t *testing.T) {
+	at := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		headers map[string]any
+		want    []Death
+	}{
+		{"no header", nil, []Death{}},
+		{"not a list", map[string]any{"x-death": "rejected"}, []Death{}},
+		{
+			// What the AMQP client hands over once converted by fromTable.
+			"plain maps",
+			map[string]any{"x-death": []any{map[string]any{
+				"count":        int64(1),
+				"reason":       "rejected",
+				"queue":        "army_moves.alice",
+				"time":         at,
+				"exchange":     "peril_topic",
+				"routing-keys": []any{"army_moves.alice"},
+			}}},
+			[]Death{{Queue: "army_moves.alice", Reason: "rejected", Count: 1, Time: at, Exchange: "peril_topic", RoutingKeys: []string{"army_moves.alice"}}},
+		},
+		{
+			// Straight out of an amqp.Delivery, counts being int32 on some
+			// RabbitMQ versions.
+			"amqp tables",
+			map[string]any{"x-death": []any{amqp.Table{
+				"count":        int32(3),
+				"reason":       "expired",
+				"queue":        "peril_retry_1000",
+				"time":         at,
+				"exchange":     "",
+				"routing-keys": []any{"peril_retry_1000"},
+			}}},
+			[]Death{{Queue: "peril_retry_1000", Reason: "expired", Count: 3, Time: at, RoutingKeys: []string{"peril_retry_1000"}}},
+		},
+		{
+			"nested in a table",
+			amqp.Table{"x-death": []any{amqp.Table{"count": int64(2), "queue": "q", "routing-keys": []string{"a", "b"}}}},
+			[]Death{{Queue: "q", Count: 2, RoutingKeys: []string{"a", "b"}}},
+		},
+		{
+			"several deaths, most recent first",
+			map[string]any{"x-death": []any{
+				map[string]any{"count": int64(1), "reason": "rejected", "queue": "war", "exchange": "peril_topic", "routing-keys": []any{"war.alice"}},
+				amqp.Table{"count": int32(2), "reason": "expired", "queue": "peril_retry_500", "exchange": "", "routing-keys": []any{"peril_retry_500"}},
+				"garbage",
+			}},
+			[]Death{
+				{Queue: "war", Reason: "rejected", Count: 1, Exchange: "peril_topic", RoutingKeys: []string{"war.alice"}},
+				{Queue: "peril_retry_500", Reason: "expired", Count: 2, RoutingKeys: []string{"peril_retry_500"}},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Deaths(tt.headers)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Deaths = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOriginalDestination(t *testing.T) {
+	tests := []struct {
+		name         string
+		headers      map[string]any
+		wantExchange string
+		wantKey      string
+		wantOK       bool
+	}{
+		{"no header", nil, "", "", false},
+		{
+			"retried",
+			map[string]any{
+				HeaderOriginalExchange:   "peril_topic",
+				HeaderOriginalRoutingKey: "war.alice",
+				"x-death":                []any{amqp.Table{"count": int32(1), "exchange": "", "routing-keys": []any{"peril_retry_500"}}},
+			},
+			"peril_topic", "war.alice", true,
+		},
+		{
+			"oldest death",
+			map[string]any{"x-death": []any{
+				amqp.Table{"count": int64(1), "exchange": "peril_dlx", "routing-keys": []any{"replayed"}},
+				amqp.Table{"count": int32(4), "exchange": "peril_direct", "routing-keys": []any{"pause", "cc"}},
+			}},
+			"peril_direct", "pause", true,
+		},
+		{
+			"death without routing keys",
+			map[string]any{"x-death": []any{map[string]any{"count": int64(1), "exchange": "peril_direct"}}},
+			"", "", false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			exchange, key, ok := OriginalDestination(tt.headers)
+			if exchange != tt.wantExchange || key != tt.wantKey || ok != tt.wantOK {
+				t.Errorf("OriginalDestination = %q, %q, %v, want %q, %q, %v",
+					exchange, key, ok, tt.wantExchange, tt.wantKey, tt.wantOK)
+			}
+		})
+	}
+}
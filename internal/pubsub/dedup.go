@@ -0,0 +1,227 @@
+package pubsub
+
+import (
+	"bufio"
+	"container/list"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// SeenStore remembers the IDs of messages that were handled, so that a
+// redelivered copy can be recognized.
+type SeenStore interface {
+	Contains(id string) (bool, error)
+	Add(id string) error
+}
+
+// Deduplicate acknowledges messages whose ID is in store without handling
+// them again, and adds the ID of every message the handler acknowledges.
+// An ID is reserved while its message is being handled, so a copy reaching
+// another worker meanwhile is acknowledged too. Messages handled otherwise
+// release it and may come back to be handled again, as may messages without
+// an ID.
+func Deduplicate(store SeenStore) Middleware {
+	var mu sync.Mutex
+	handling := map[string]bool{}
+	return func(next MessageHandler) MessageHandler {
+		return func(ctx context.Context, env Envelope) Acktype {
+			id := env.MessageID
+			if id == "" {
+				return next(ctx, env)
+			}
+			mu.Lock()
+			seen, err := store.Contains(id)
+			if err != nil {
+				fmt.Printf("could not check whether %s was seen: %v\n", id, err)
+			}
+			if seen || handling[id] {
+				mu.Unlock()
+				return Ack
+			}
+			handling[id] = true
+			mu.Unlock()
+
+			// Released even if next panics, for a later copy to be handled.
+			ack := NackRequeue
+			defer func() {
+				mu.Lock()
+				defer mu.Unlock()
+				delete(handling, id)
+				if ack != Ack {
+					return
+				}
+				err := store.Add(id)
+				if err != nil {
+					fmt.Printf("could not remember %s was seen: %v\n", id, err)
+				}
+			}()
+			ack = next(ctx, env)
+			return ack
+		}
+	}
+}
+
+// LRUSeenStore keeps the most recently seen IDs in memory, forgetting the
+// least recently seen one once full.
+type LRUSeenStore struct {
+	mu    sync.Mutex
+	size  int
+	order *list.List
+	ids   map[string]*list.Element
+}
+
+func NewLRUSeenStore(size int) *LRUSeenStore {
+	return &LRUSeenStore{
+		size:  max(size, 1),
+		order: list.New(),
+		ids:   map[string]*list.Element{},
+	}
+}
+
+func (s *LRUSeenStore) Contains(id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.ids[id]
+	if ok {
+		s.order.MoveToFront(e)
+	}
+	return ok, nil
+}
+
+func (s *LRUSeenStore) Add(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.add(id)
+	return nil
+}
+
+func (s *LRUSeenStore) add(id string) {
+	if e, ok := s.ids[id]; ok {
+		s.order.MoveToFront(e)
+		return
+	}
+	s.ids[id] = s.order.PushFront(id)
+	if s.order.Len() > s.size {
+		oldest := s.order.Back()
+		s.order.Remove(oldest)
+		delete(s.ids, oldest.Value.(string))
+	}
+}
+
+// snapshot lists the IDs from least to most recently seen.
+func (s *LRUSeenStore) snapshot() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ids := make([]string, 0, s.order.Len())
+	for e := s.order.Back(); e != nil; e = e.Prev() {
+		ids = append(ids, e.Value.(string))
+	}
+	return ids
+}
+
+// FileSeenStore is an LRUSeenStore that also appends every ID to a file, so
+// that messages handled before a restart are still recognized after it.
+type FileSeenStore struct {
+	mu    sync.Mutex
+	lru   *LRUSeenStore
+	path  string
+	f     *os.File
+	lines int
+}
+
+// OpenFileSeenStore loads the last size IDs from the file at path, creating
+// it if needed. The file is rewritten with only those once it holds twice
+// as many.
+func OpenFileSeenStore(path string, size int) (*FileSeenStore, error) {
+	s := &FileSeenStore{
+		lru:  NewLRUSeenStore(size),
+		path: path,
+	}
+	f, err := os.Open(path)
+	if err == nil {
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			if id := scanner.Text(); id != "" {
+				s.lru.add(id)
+				s.lines++
+			}
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("could not read seen messages: %v", err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("could not open seen messages: %v", err)
+	}
+
+	err = s.compact()
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *FileSeenStore) Contains(id string) (bool, error) {
+	return s.lru.Contains(id)
+}
+
+func (s *FileSeenStore) Add(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lru.Add(id)
+	_, err := fmt.Fprintln(s.f, id)
+	if err != nil {
+		return err
+	}
+	s.lines++
+	if s.lines > 2*s.lru.size {
+		return s.compact()
+	}
+	return nil
+}
+
+// compact replaces the file with the IDs still remembered.
+func (s *FileSeenStore) compact() error {
+	ids := s.lru.snapshot()
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return fmt.Errorf("could not compact seen messages: %v", err)
+	}
+	w := bufio.NewWriter(tmp)
+	for _, id := range ids {
+		fmt.Fprintln(w, id)
+	}
+	err = w.Flush()
+	if err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), s.path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("could not compact seen messages: %v", err)
+	}
+
+	if s.f != nil {
+		s.f.Close()
+	}
+	s.f, err = os.OpenFile(s.path, os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("could not open seen messages: %v", err)
+	}
+	s.lines = len(ids)
+	return nil
+}
+
+func (s *FileSeenStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.f.Close()
+}
@@ -0,0 +1,185 @@
+package pubsub
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func contains(t *testing.T, s SeenStore, id string) bool {
+	t.Helper()
+	ok, err := s.Contains(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ok
+}
+
+func TestLRUSeenStoreEviction(t *testing.T) {
+	s := NewLRUSeenStore(2)
+	s.Add("a")
+	s.Add("b")
+	// Seeing a again makes b the least recently seen.
+	if !contains(t, s, "a") {
+		t.Fatal("a was forgotten")
+	}
+	s.Add("c")
+	if got := strings.Join(s.snapshot(), ","); got != "a,c" {
+		t.Errorf("snapshot() = %s, want a,c", got)
+	}
+	for id, want := range map[string]bool{"a": true, "b": false, "c": true} {
+		if got := contains(t, s, id); got != want {
+			t.Errorf("Contains(%s) = %v, want %v", id, got, want)
+		}
+	}
+}
+
+func TestFileSeenStoreReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "seen")
+	s, err := OpenFileSeenStore(path, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"a", "b", "c", "d"} {
+		err := s.Add(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = s.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = OpenFileSeenStore(path, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for id, want := range map[string]bool{"a": false, "b": true, "c": true, "d": true} {
+		if got := contains(t, s, id); got != want {
+			t.Errorf("after reload Contains(%s) = %v, want %v", id, got, want)
+		}
+	}
+}
+
+func TestFileSeenStoreCompaction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "seen")
+	s, err := OpenFileSeenStore(path, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	lines := func() []string {
+		dat, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.Fields(string(dat))
+	}
+
+	for _, id := range []string{"a", "b", "c", "d"} {
+		s.Add(id)
+	}
+	// Up to twice the size is appended before compacting.
+	if got := lines(); len(got) != 4 {
+		t.Fatalf("file holds %v before compaction", got)
+	}
+	s.Add("e")
+	if got := strings.Join(lines(), ","); got != "d,e" {
+		t.Errorf("file holds %s after compaction, want d,e", got)
+	}
+	// Still appended to after compaction.
+	s.Add("f")
+	if got := strings.Join(lines(), ","); got != "d,e,f" {
+		t.Errorf("file holds %s, want d,e,f", got)
+	}
+}
+
+func TestDeduplicate(t *testing.T) {
+	store := NewLRUSeenStore(10)
+	var calls atomic.Int32
+	result := NackRequeue
+	handler := Deduplicate(store)(func(ctx context.Context, env Envelope) Acktype {
+		calls.Add(1)
+		return result
+	})
+	env := Envelope{MessageID: "m1"}
+
+	// Failures leave the message to be handled again.
+	if ack := handler(context.Background(), env); ack != NackRequeue {
+		t.Fatalf("first delivery = %v, want NackRequeue", ack)
+	}
+	result = Ack
+	if ack := handler(context.Background(), env); ack != Ack {
+		t.Fatalf("second delivery = %v, want Ack", ack)
+	}
+	if ack := handler(context.Background(), env); ack != Ack {
+		t.Fatalf("third delivery = %v, want Ack", ack)
+	}
+	if n := calls.Load(); n != 2 {
+		t.Errorf("handler called %d times, want 2", n)
+	}
+
+	// Messages without an ID are never deduplicated.
+	handler(context.Background(), Envelope{})
+	handler(context.Background(), Envelope{})
+	if n := calls.Load(); n != 4 {
+		t.Errorf("handler called %d times, want 4", n)
+	}
+}
+
+func TestDeduplicateConcurrentCopies(t *testing.T) {
+	store := NewLRUSeenStore(10)
+	var calls atomic.Int32
+	release := make(chan struct{})
+	handler := Deduplicate(store)(func(ctx context.Context, env Envelope) Acktype {
+		calls.Add(1)
+		<-release
+		return Ack
+	})
+
+	const workers = 10
+	var wg sync.WaitGroup
+	acks := make(chan Acktype, workers)
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			acks <- handler(context.Background(), Envelope{MessageID: "m1"})
+		}()
+	}
+	// The copies not handled are acknowledged without waiting.
+	for range workers - 1 {
+		if ack := <-acks; ack != Ack {
+			t.Errorf("copy settled with %v, want Ack", ack)
+		}
+	}
+	close(release)
+	wg.Wait()
+	if n := calls.Load(); n != 1 {
+		t.Errorf("handler called %d times, want 1", n)
+	}
+}
+
+func TestDeduplicateReleasesOnPanic(t *testing.T) {
+	store := NewLRUSeenStore(10)
+	panics := true
+	handler := Recover()(Deduplicate(store)(func(ctx context.Context, env Envelope) Acktype {
+		if panics {
+			panic("boom")
+		}
+		return Ack
+	}))
+	env := Envelope{MessageID: "m1"}
+	handler(context.Background(), env)
+	panics = false
+	handler(context.Background(), env)
+	if !contains(t, store, "m1") {
+		t.Error("message was not handled after the panic")
+	}
+}
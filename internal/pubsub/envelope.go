@@ -0,0 +1,132 @@
+package pubsub
+
+import (
+	"reflect"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	HeaderCausationID   = "x-causation-id"
+	HeaderSchemaVersion = "x-schema-version"
+	HeaderRetryAttempt  = "x-retry-attempt"
+	HeaderDecodeError   = "x-decode-error"
+
+	// Set on messages that are moved around by the subscription itself,
+	// such as retries and quarantined messages, to remember where they were
+	// originally published.
+	HeaderOriginalExchange   = "x-original-exchange"
+	HeaderOriginalRoutingKey = "x-original-routing-key"
+	HeaderOriginalQueue      = "x-original-queue"
+)
+
+const DefaultSchemaVersion = 1
+
+// Envelope is the metadata stamped on every message by Publish.
+type Envelope struct {
+	MessageID string
+	// CorrelationID is shared by every message descending from the same
+	// original message, CausationID is the MessageID of the direct parent.
+	CorrelationID string
+	CausationID   string
+	Sender        string
+	// ReplyTo is the queue a request made with Request expects its reply
+	// on.
+	ReplyTo       string
+	ContentType   string
+	Type          string
+	SchemaVersion int
+	Timestamp     time.Time
+	// Expiration is how long after Timestamp the message stops being of
+	// use, zero meaning never.
+	Expiration time.Duration
+	// Attempt counts how many times the message was retried with
+	// RetryLater.
+	Attempt int
+
+	Exchange    string
+	RoutingKey  string
+	Redelivered bool
+	Headers     map[string]any
+}
+
+type Delivery[T any] struct {
+	Envelope
+	Value T
+}
+
+func envelopeOf(msg RawDelivery) Envelope {
+	env := Envelope{
+		MessageID:     msg.MessageID,
+		CorrelationID: msg.CorrelationID,
+		Sender:        msg.AppID,
+		ReplyTo:       msg.ReplyTo,
+		ContentType:   msg.ContentType,
+		Type:          msg.Type,
+		Timestamp:     msg.Timestamp,
+		Expiration:    msg.Expiration,
+		Exchange:      msg.Exchange,
+		RoutingKey:    msg.RoutingKey,
+		Redelivered:   msg.Redelivered,
+		Headers:       msg.Headers,
+	}
+	env.CausationID, _ = msg.Headers[HeaderCausationID].(string)
+	env.SchemaVersion = headerInt(msg.Headers, HeaderSchemaVersion)
+	env.Attempt = headerInt(msg.Headers, HeaderRetryAttempt)
+	if exchange, ok := msg.Headers[HeaderOriginalExchange].(string); ok {
+		env.Exchange = exchange
+		env.RoutingKey, _ = msg.Headers[HeaderOriginalRoutingKey].(string)
+	}
+	return env
+}
+
+func headerInt(headers map[string]any, key string) int {
+	switch v := headers[key].(type) {
+	case int:
+		return v
+	case int32:
+		return int(v)
+	case int64:
+		return int(v)
+	case string:
+		// Transports such as STOMP carry every header as a string.
+		n, _ := strconv.Atoi(v)
+		return n
+	}
+	return 0
+}
+
+// Expired reports whether the message outlived its Expiration.
+func (e Envelope) Expired() bool {
+	return e.Expiration > 0 && time.Since(e.Timestamp) > e.Expiration
+}
+
+// stamp fills in the envelope of an outgoing message.
+func stamp(msg *Message, typeName string, cfg publishConfig) {
+	msg.MessageID = uuid.NewString()
+	msg.Timestamp = time.Now()
+	msg.Type = typeName
+	msg.AppID = cfg.sender
+
+	msg.CorrelationID = cfg.correlationID
+	if msg.CorrelationID == "" {
+		msg.CorrelationID = msg.MessageID
+	}
+
+	if msg.Headers == nil {
+		msg.Headers = map[string]any{}
+	}
+	for k, v := range cfg.headers {
+		msg.Headers[k] = v
+	}
+	msg.Headers[HeaderSchemaVersion] = cfg.schemaVersion
+	if cfg.causationID != "" {
+		msg.Headers[HeaderCausationID] = cfg.causationID
+	}
+}
+
+func typeName[T any]() string {
+	return reflect.TypeOf((*T)(nil)).Elem().String()
+}
@@ -0,0 +1,538 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var ErrBrokerClosed = errors.New("broker closed")
+
+// MemoryBroker is an in-process Broker following RabbitMQ's direct, topic and
+// fanout routing rules, including dead-lettering of rejected and expired
+// messages.
+type MemoryBroker struct {
+	mu        sync.RWMutex
+	exchanges map[string]*memExchange
+	queues    map[string]*memQueue
+	nextID    int
+	closed    bool
+}
+
+type memExchange struct {
+	kind     string
+	durable  bool
+	bindings []memBinding
+}
+
+type memBinding struct {
+	key   string
+	queue string
+}
+
+func NewMemoryBroker() *MemoryBroker {
+	return &MemoryBroker{
+		exchanges: map[string]*memExchange{},
+		queues:    map[string]*memQueue{},
+	}
+}
+
+func (b *MemoryBroker) DeclareExchange(name, kind string, durable bool) error {
+	if name == "" {
+		return errors.New("cannot redeclare the default exchange")
+	}
+	switch kind {
+	case ExchangeDirect, ExchangeTopic, ExchangeFanout:
+	default:
+		return fmt.Errorf("unsupported exchange type: %s", kind)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return ErrBrokerClosed
+	}
+	if ex, ok := b.exchanges[name]; ok {
+		if ex.kind != kind || ex.durable != durable {
+			return fmt.Errorf("inequivalent arguments for exchange %s", name)
+		}
+		return nil
+	}
+	b.exchanges[name] = &memExchange{kind: kind, durable: durable}
+	return nil
+}
+
+func (b *MemoryBroker) DeclareQueue(name string, opts QueueOptions) (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return "", ErrBrokerClosed
+	}
+	if name == "" {
+		b.nextID++
+		name = fmt.Sprintf("amq.gen-%d", b.nextID)
+	}
+	if q, ok := b.queues[name]; ok {
+		if q.opts.Durable != opts.Durable || q.opts.AutoDelete != opts.AutoDelete || q.opts.Exclusive != opts.Exclusive {
+			return "", fmt.Errorf("inequivalent arguments for queue %s", name)
+		}
+		return name, nil
+	}
+	b.queues[name] = newMemQueue(b, name, opts)
+	return name, nil
+}
+
+func (b *MemoryBroker) BindQueue(queueName, key, exchange string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return ErrBrokerClosed
+	}
+	ex, ok := b.exchanges[exchange]
+	if !ok {
+		return fmt.Errorf("no exchange %s", exchange)
+	}
+	if _, ok := b.queues[queueName]; !ok {
+		return fmt.Errorf("no queue %s", queueName)
+	}
+	for _, binding := range ex.bindings {
+		if binding.queue == queueName && binding.key == key {
+			return nil
+		}
+	}
+	ex.bindings = append(ex.bindings, memBinding{key: key, queue: queueName})
+	return nil
+}
+
+func (b *MemoryBroker) Publish(ctx context.Context, exchange, key string, msg Message) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	queues, err := b.route(exchange, key)
+	if err != nil {
+		return err
+	}
+	for _, q := range queues {
+		q.enqueue(memMessage{
+			Message:    copyMessage(msg),
+			exchange:   exchange,
+			routingKey: key,
+		})
+	}
+	return nil
+}
+
+func (b *MemoryBroker) PublishConfirmed(ctx context.Context, exchange, key string, msg Message) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	queues, err := b.route(exchange, key)
+	if err != nil {
+		return err
+	}
+	if len(queues) == 0 {
+		return &UnroutableError{Exchange: exchange, Key: key, ReplyCode: 312, ReplyText: "NO_ROUTE"}
+	}
+	return b.Publish(ctx, exchange, key, msg)
+}
+
+func (b *MemoryBroker) route(exchange, key string) ([]*memQueue, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if b.closed {
+		return nil, ErrBrokerClosed
+	}
+
+	if exchange == "" {
+		if q, ok := b.queues[key]; ok {
+			return []*memQueue{q}, nil
+		}
+		return nil, nil
+	}
+
+	ex, ok := b.exchanges[exchange]
+	if !ok {
+		return nil, fmt.Errorf("no exchange %s", exchange)
+	}
+	seen := map[string]struct{}{}
+	queues := []*memQueue{}
+	for _, binding := range ex.bindings {
+		if _, ok := seen[binding.queue]; ok {
+			continue
+		}
+		matched := false
+		switch ex.kind {
+		case ExchangeDirect:
+			matched = binding.key == key
+		case ExchangeTopic:
+			matched = MatchTopic(binding.key, key)
+		case ExchangeFanout:
+			matched = true
+		}
+		if !matched {
+			continue
+		}
+		if q, ok := b.queues[binding.queue]; ok {
+			seen[binding.queue] = struct{}{}
+			queues = append(queues, q)
+		}
+	}
+	return queues, nil
+}
+
+func (b *MemoryBroker) Consume(queueName string, opts ConsumeOptions) (Consumer, error) {
+	b.mu.RLock()
+	q, ok := b.queues[queueName]
+	closed := b.closed
+	b.mu.RUnlock()
+	if closed {
+		return nil, ErrBrokerClosed
+	}
+	if !ok {
+		return nil, fmt.Errorf("no queue %s", queueName)
+	}
+	return q.consume(opts), nil
+}
+
+func (b *MemoryBroker) deleteQueue(name string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.queues, name)
+	for _, ex := range b.exchanges {
+		bindings := ex.bindings[:0]
+		for _, binding := range ex.bindings {
+			if binding.queue != name {
+				bindings = append(bindings, binding)
+			}
+		}
+		ex.bindings = bindings
+	}
+}
+
+func (b *MemoryBroker) Close() error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return nil
+	}
+	b.closed = true
+	queues := make([]*memQueue, 0, len(b.queues))
+	for _, q := range b.queues {
+		queues = append(queues, q)
+	}
+	b.mu.Unlock()
+
+	for _, q := range queues {
+		q.closeConsumers()
+	}
+	forgetRetryDelays(b)
+	return nil
+}
+
+type memMessage struct {
+	Message
+	exchange    string
+	routingKey  string
+	redelivered bool
+	expires     time.Time
+}
+
+type memQueue struct {
+	broker *MemoryBroker
+	name   string
+	opts   QueueOptions
+
+	mu        sync.Mutex
+	msgs      []memMessage
+	consumers map[*memConsumer]struct{}
+	changed   chan struct{}
+}
+
+func newMemQueue(b *MemoryBroker, name string, opts QueueOptions) *memQueue {
+	return &memQueue{
+		broker:    b,
+		name:      name,
+		opts:      opts,
+		consumers: map[*memConsumer]struct{}{},
+		changed:   make(chan struct{}),
+	}
+}
+
+func (q *memQueue) notifyLocked() {
+	close(q.changed)
+	q.changed = make(chan struct{})
+}
+
+func (q *memQueue) enqueue(m memMessage) {
+	ttl := q.messageTTL()
+	if m.Expiration > 0 && (ttl == 0 || m.Expiration < ttl) {
+		ttl = m.Expiration
+	}
+	if ttl > 0 {
+		m.expires = time.Now().Add(ttl)
+		time.AfterFunc(ttl, q.expire)
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.msgs = append(q.msgs, m)
+	q.notifyLocked()
+}
+
+func (q *memQueue) messageTTL() time.Duration {
+	var ms int64
+	switch v := q.opts.Args["x-message-ttl"].(type) {
+	case int:
+		ms = int64(v)
+	case int32:
+		ms = int64(v)
+	case int64:
+		ms = v
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+// expire dead-letters the expired messages at the head of the queue. As in
+// RabbitMQ, messages behind one that has not expired yet wait their turn.
+func (q *memQueue) expire() {
+	now := time.Now()
+	q.mu.Lock()
+	var expired []memMessage
+	for len(q.msgs) > 0 && !q.msgs[0].expires.IsZero() && !q.msgs[0].expires.After(now) {
+		expired = append(expired, q.msgs[0])
+		q.msgs = q.msgs[1:]
+	}
+	q.mu.Unlock()
+
+	for _, m := range expired {
+		q.deadLetter(m, "expired")
+	}
+}
+
+func (q *memQueue) requeueLocked(msgs ...memMessage) {
+	for i := range msgs {
+		msgs[i].redelivered = true
+	}
+	q.msgs = append(msgs, q.msgs...)
+	q.notifyLocked()
+}
+
+func (q *memQueue) deadLetter(m memMessage, reason string) {
+	dlx, ok := q.opts.Args["x-dead-letter-exchange"].(string)
+	if !ok {
+		return
+	}
+	key := m.routingKey
+	if dlk, ok := q.opts.Args["x-dead-letter-routing-key"].(string); ok {
+		key = dlk
+	}
+	msg := m.Message
+	// As in RabbitMQ, dead-lettered messages no longer expire.
+	msg.Expiration = 0
+	msg.Headers = withXDeath(msg.Headers, q.name, reason, m.exchange, m.routingKey)
+	// Like RabbitMQ, messages dead-lettered to a missing exchange are dropped.
+	_ = q.broker.Publish(context.Background(), dlx, key, msg)
+}
+
+func withXDeath(headers map[string]any, queue, reason, exchange, key string) map[string]any {
+	out := make(map[string]any, len(headers)+1)
+	for k, v := range headers {
+		out[k] = v
+	}
+
+	deaths := headerList(out["x-death"])
+	count := int64(1)
+	rest := make([]any, 0, len(deaths))
+	for _, d := range deaths {
+		entry, ok := headerTable(d)
+		if ok && entry["queue"] == queue && entry["reason"] == reason {
+			if c, ok := deathCount(entry["count"]); ok {
+				count = c + 1
+			}
+			continue
+		}
+		rest = append(rest, d)
+	}
+
+	if _, ok := out["x-first-death-queue"]; !ok {
+		out["x-first-death-queue"] = queue
+		out["x-first-death-reason"] = reason
+		out["x-first-death-exchange"] = exchange
+	}
+
+	entry := map[string]any{
+		"count":        count,
+		"reason":       reason,
+		"queue":        queue,
+		"time":         time.Now(),
+		"exchange":     exchange,
+		"routing-keys": []any{key},
+	}
+	out["x-death"] = append([]any{entry}, rest...)
+	return out
+}
+
+func (q *memQueue) consume(opts ConsumeOptions) *memConsumer {
+	c := &memConsumer{
+		queue:      q,
+		prefetch:   opts.Prefetch,
+		deliveries: make(chan RawDelivery),
+		done:       make(chan struct{}),
+		stopped:    make(chan struct{}),
+		unacked:    map[uint64]memMessage{},
+	}
+	q.mu.Lock()
+	q.consumers[c] = struct{}{}
+	q.mu.Unlock()
+	go c.run()
+	return c
+}
+
+func (q *memQueue) closeConsumers() {
+	q.mu.Lock()
+	consumers := make([]*memConsumer, 0, len(q.consumers))
+	for c := range q.consumers {
+		consumers = append(consumers, c)
+	}
+	q.mu.Unlock()
+	for _, c := range consumers {
+		c.Close()
+	}
+}
+
+type memConsumer struct {
+	queue      *memQueue
+	prefetch   int
+	deliveries chan RawDelivery
+	done       chan struct{}
+	stopped    chan struct{}
+	closeOnce  sync.Once
+
+	// guarded by queue.mu
+	unacked map[uint64]memMessage
+	nextTag uint64
+	closed  bool
+}
+
+func (c *memConsumer) run() {
+	defer close(c.stopped)
+	q := c.queue
+	for {
+		q.mu.Lock()
+		if len(q.msgs) == 0 || (c.prefetch > 0 && len(c.unacked) >= c.prefetch) {
+			changed := q.changed
+			q.mu.Unlock()
+			select {
+			case <-changed:
+				continue
+			case <-c.done:
+				return
+			}
+		}
+
+		m := q.msgs[0]
+		q.msgs = q.msgs[1:]
+		c.nextTag++
+		tag := c.nextTag
+		c.unacked[tag] = m
+		q.mu.Unlock()
+
+		d := RawDelivery{
+			Message:     copyMessage(m.Message),
+			Exchange:    m.exchange,
+			RoutingKey:  m.routingKey,
+			Redelivered: m.redelivered,
+			acker:       memAcker{consumer: c, tag: tag},
+		}
+		select {
+		case c.deliveries <- d:
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *memConsumer) settle(tag uint64, requeue, ack bool) error {
+	q := c.queue
+	q.mu.Lock()
+	m, ok := c.unacked[tag]
+	if !ok || c.closed {
+		q.mu.Unlock()
+		return ErrUnknownDeliveryTag
+	}
+	delete(c.unacked, tag)
+	if !ack && requeue {
+		q.requeueLocked(m)
+	} else {
+		q.notifyLocked()
+	}
+	q.mu.Unlock()
+
+	if !ack && !requeue {
+		q.deadLetter(m, "rejected")
+	}
+	return nil
+}
+
+func (c *memConsumer) Deliveries() <-chan RawDelivery {
+	return c.deliveries
+}
+
+func (c *memConsumer) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		<-c.stopped
+
+		q := c.queue
+		q.mu.Lock()
+		c.closed = true
+		pending := make([]memMessage, 0, len(c.unacked))
+		for tag := uint64(1); tag <= c.nextTag; tag++ {
+			if m, ok := c.unacked[tag]; ok {
+				pending = append(pending, m)
+			}
+		}
+		c.unacked = nil
+		if len(pending) > 0 {
+			q.requeueLocked(pending...)
+		}
+		delete(q.consumers, c)
+		remaining := len(q.consumers)
+		q.mu.Unlock()
+
+		close(c.deliveries)
+		if q.opts.AutoDelete && remaining == 0 {
+			q.broker.deleteQueue(q.name)
+		}
+	})
+	return nil
+}
+
+type memAcker struct {
+	consumer *memConsumer
+	tag      uint64
+}
+
+func (a memAcker) ack() error {
+	return a.consumer.settle(a.tag, false, true)
+}
+
+func (a memAcker) nack(requeue bool) error {
+	return a.consumer.settle(a.tag, requeue, false)
+}
+
+func copyMessage(msg Message) Message {
+	out := msg
+	if msg.Headers != nil {
+		out.Headers = make(map[string]any, len(msg.Headers))
+		for k, v := range msg.Headers {
+			out.Headers[k] = v
+		}
+	}
+	if msg.Body != nil {
+		out.Body = append([]byte(nil), msg.Body...)
+	}
+	return out
+}
@@ -0,0 +1,466 @@
+package pubsub
+
+import (
+	"context"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/gabrieldiem/learn-pub-sub-starter/internal/routing"
+)
+
+const testTimeout = 2 * time.Second
+
+func declare(t *testing.T, b Broker, exchange, kind string, bindings map[string]string) {
+	t.Helper()
+	err := b.DeclareExchange(exchange, kind, false)
+	if err != nil {
+		t.Fatalf("DeclareExchange(%s): %v", exchange, err)
+	}
+	for queue, key := range bindings {
+		_, err := b.DeclareQueue(queue, QueueOptions{})
+		if err != nil {
+			t.Fatalf("DeclareQueue(%s): %v", queue, err)
+		}
+		err = b.BindQueue(queue, key, exchange)
+		if err != nil {
+			t.Fatalf("BindQueue(%s, %s): %v", queue, key, err)
+		}
+	}
+}
+
+func receive(t *testing.T, c Consumer) RawDelivery {
+	t.Helper()
+	select {
+	case d, ok := <-c.Deliveries():
+		if !ok {
+			t.Fatal("consumer closed")
+		}
+		return d
+	case <-time.After(testTimeout):
+		t.Fatal("no delivery")
+	}
+	return RawDelivery{}
+}
+
+func expectNone(t *testing.T, c Consumer) {
+	t.Helper()
+	select {
+	case d := <-c.Deliveries():
+		t.Fatalf("unexpected delivery %q", d.Body)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestMemoryBrokerRouting(t *testing.T) {
+	tests := []struct {
+		name     string
+		kind     string
+		bindings map[string]string
+		key      string
+		want     []string
+	}{
+		{"direct match", ExchangeDirect, map[string]string{"a": "pause", "b": "other"}, "pause", []string{"a"}},
+		{"direct no match", ExchangeDirect, map[string]string{"a": "pause"}, "resume", nil},
+		{"topic star", ExchangeTopic, map[string]string{"a": "army_moves.*", "b": "war.*"}, "army_moves.alice", []string{"a"}},
+		{"topic hash", ExchangeTopic, map[string]string{"a": "#", "b": "game_logs.#", "c": "war.*"}, "game_logs.alice", []string{"a", "b"}},
+		{"fanout", ExchangeFanout, map[string]string{"a": "", "b": "ignored"}, "anything", []string{"a", "b"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := NewMemoryBroker()
+			defer b.Close()
+			declare(t, b, "ex", tt.kind, tt.bindings)
+
+			queues, err := b.route("ex", tt.key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := []string{}
+			for _, q := range queues {
+				got = append(got, q.name)
+			}
+			sort.Strings(got)
+			if len(got) != len(tt.want) {
+				t.Fatalf("routed to %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("routed to %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestMemoryBrokerPublishConfirmedUnroutable(t *testing.T) {
+	b := NewMemoryBroker()
+	defer b.Close()
+	declare(t, b, "ex", ExchangeDirect, map[string]string{"a": "pause"})
+
+	err := b.PublishConfirmed(context.Background(), "ex", "nobody", Message{Body: []byte("x")})
+	if _, ok := err.(*UnroutableError); !ok {
+		t.Fatalf("got %v, want an *UnroutableError", err)
+	}
+	err = b.PublishConfirmed(context.Background(), "ex", "pause", Message{Body: []byte("x")})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMemoryBrokerNackDeadLetters(t *testing.T) {
+	b := NewMemoryBroker()
+	defer b.Close()
+	err := DeclareDeadLetterQueue(b, "dlx", "dlq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b.DeclareExchange("ex", ExchangeTopic, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = b.DeclareQueue("moves", QueueOptions{Args: map[string]any{"x-dead-letter-exchange": "dlx"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b.BindQueue("moves", "army_moves.*", "ex")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	consumer, err := b.Consume("moves", ConsumeOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer consumer.Close()
+	dlq, err := b.Consume("dlq", ConsumeOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dlq.Close()
+
+	for round := int64(1); round <= 2; round++ {
+		key := "army_moves.alice"
+		if round == 2 {
+			key = "army_moves.bob"
+		}
+		err = b.Publish(context.Background(), "ex", key, Message{Body: []byte("move")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		d := receive(t, consumer)
+		err = d.Nack(false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		dead := receive(t, dlq)
+		deaths := Deaths(dead.Headers)
+		if len(deaths) != 1 {
+			t.Fatalf("got %d deaths, want 1", len(deaths))
+		}
+		death := deaths[0]
+		if death.Queue != "moves" || death.Reason != "rejected" || death.Count != 1 || death.Exchange != "ex" {
+			t.Errorf("got death %+v", death)
+		}
+		exchange, origKey, ok := OriginalDestination(dead.Headers)
+		if !ok || exchange != "ex" || origKey != key {
+			t.Errorf("OriginalDestination = %s, %s, %v; want ex, %s", exchange, origKey, ok, key)
+		}
+		dead.Ack()
+	}
+}
+
+func TestMemoryBrokerRequeue(t *testing.T) {
+	b := NewMemoryBroker()
+	defer b.Close()
+	declare(t, b, "ex", ExchangeDirect, map[string]string{"q": "k"})
+
+	consumer, err := b.Consume("q", ConsumeOptions{Prefetch: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer consumer.Close()
+	for _, body := range []string{"first", "second"} {
+		err = b.Publish(context.Background(), "ex", "k", Message{Body: []byte(body)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	d := receive(t, consumer)
+	if string(d.Body) != "first" || d.Redelivered {
+		t.Fatalf("got %q redelivered=%v, want first delivery of first", d.Body, d.Redelivered)
+	}
+	// Prefetch holds the second message back until the first is settled.
+	expectNone(t, consumer)
+	err = d.Nack(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d = receive(t, consumer)
+	if string(d.Body) != "first" || !d.Redelivered {
+		t.Fatalf("got %q redelivered=%v, want first redelivered", d.Body, d.Redelivered)
+	}
+	d.Ack()
+	d = receive(t, consumer)
+	if string(d.Body) != "second" {
+		t.Fatalf("got %q, want second", d.Body)
+	}
+	d.Ack()
+	if err := d.Ack(); err != ErrUnknownDeliveryTag {
+		t.Errorf("second ack returned %v, want ErrUnknownDeliveryTag", err)
+	}
+}
+
+func TestMemoryBrokerCloseRequeuesUnacked(t *testing.T) {
+	b := NewMemoryBroker()
+	defer b.Close()
+	declare(t, b, "ex", ExchangeDirect, map[string]string{"q": "k"})
+	err := b.Publish(context.Background(), "ex", "k", Message{Body: []byte("x")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := b.Consume("q", ConsumeOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	receive(t, first)
+	first.Close()
+
+	second, err := b.Consume("q", ConsumeOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	if d := receive(t, second); !d.Redelivered {
+		t.Error("message not marked redelivered")
+	}
+}
+
+func TestMemoryBrokerTTLExpiry(t *testing.T) {
+	b := NewMemoryBroker()
+	defer b.Close()
+	err := DeclareDeadLetterQueue(b, "dlx", "dlq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b.DeclareExchange("ex", ExchangeDirect, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = b.DeclareQueue("delay", QueueOptions{Args: map[string]any{
+		"x-message-ttl":          int64(20),
+		"x-dead-letter-exchange": "dlx",
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b.BindQueue("delay", "k", "ex")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dlq, err := b.Consume("dlq", ConsumeOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dlq.Close()
+	start := time.Now()
+	err = b.Publish(context.Background(), "ex", "k", Message{Body: []byte("late")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := receive(t, dlq)
+	if took := time.Since(start); took < 20*time.Millisecond {
+		t.Errorf("expired after %v, before the ttl", took)
+	}
+	deaths := Deaths(d.Headers)
+	if len(deaths) != 1 || deaths[0].Reason != "expired" || deaths[0].Queue != "delay" {
+		t.Errorf("got deaths %+v", deaths)
+	}
+}
+
+func TestMemoryBrokerMessageExpiration(t *testing.T) {
+	b := NewMemoryBroker()
+	defer b.Close()
+	err := DeclareDeadLetterQueue(b, "dlx", "dlq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = b.DeclareQueue("intents", QueueOptions{Args: map[string]any{
+		"x-message-ttl":          int64(time.Minute / time.Millisecond),
+		"x-dead-letter-exchange": "dlx",
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dlq, err := b.Consume("dlq", ConsumeOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dlq.Close()
+	// The shorter of the message's expiration and the queue's ttl wins.
+	err = b.Publish(context.Background(), "", "intents", Message{Body: []byte("late"), Expiration: 20 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := receive(t, dlq)
+	deaths := Deaths(d.Headers)
+	if len(deaths) != 1 || deaths[0].Reason != "expired" || deaths[0].Queue != "intents" {
+		t.Errorf("got deaths %+v", deaths)
+	}
+	if d.Expiration != 0 {
+		t.Errorf("dead-lettered message expires after %v, want never", d.Expiration)
+	}
+}
+
+// TestMemoryBrokerRetryLater runs a message through the retry delay queues
+// back to its subscription, then to the dead-letter queue once out of
+// attempts.
+func TestMemoryBrokerRetryLater(t *testing.T) {
+	b := NewMemoryBroker()
+	defer b.Close()
+	err := DeclareDeadLetterQueue(b, routing.ExchangePerilDLX, routing.QueuePerilDLQ)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b.DeclareExchange("ex", ExchangeTopic, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dlq, err := b.Consume(routing.QueuePerilDLQ, ConsumeOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dlq.Close()
+
+	attempts := make(chan int, 10)
+	sub, err := Subscribe(b, "ex", "logs", "logs.*", SimpleQueueTransient,
+		func(ctx context.Context, d Delivery[string]) Acktype {
+			attempts <- 1
+			return RetryLater
+		},
+		WithRetryPolicy(RetryPolicy{BaseDelay: 5 * time.Millisecond, MaxDelay: 10 * time.Millisecond, MaxAttempts: 3}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close(context.Background())
+
+	err = PublishJSON(b, "ex", "logs.alice", "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := receive(t, dlq)
+	if len(attempts) != 3 {
+		t.Errorf("handled %d times, want 3", len(attempts))
+	}
+	exchange, key, ok := OriginalDestination(d.Headers)
+	if !ok || exchange != "ex" || key != "logs.alice" {
+		t.Errorf("OriginalDestination = %s, %s, %v", exchange, key, ok)
+	}
+}
+
+// TestMemoryBrokerDecodeFailures checks where each DecodeFailurePolicy sends
+// a message the subscription can not decode.
+func TestMemoryBrokerDecodeFailures(t *testing.T) {
+	tests := []struct {
+		name   string
+		queue  string
+		policy DecodeFailurePolicy
+		// where the message ends up, if anywhere
+		want string
+	}{
+		{"dead-letter", "poison_dead_letter", DecodeFailureDeadLetter, routing.QueuePerilDLQ},
+		{"discard", "poison_discard", DecodeFailureDiscard, ""},
+		{"quarantine", "poison_quarantine", DecodeFailureQuarantine, DefaultQuarantineQueue},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := NewMemoryBroker()
+			defer b.Close()
+			err := DeclareDeadLetterQueue(b, routing.ExchangePerilDLX, routing.QueuePerilDLQ)
+			if err != nil {
+				t.Fatal(err)
+			}
+			declare(t, b, "ex", ExchangeTopic, nil)
+
+			sub, err := Subscribe(b, "ex", tt.queue, "logs.*", SimpleQueueTransient,
+				func(ctx context.Context, d Delivery[int]) Acktype {
+					t.Errorf("handled undecodable message as %d", d.Value)
+					return Ack
+				},
+				WithDecodeFailurePolicy(tt.policy),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer sub.Close(context.Background())
+			dlq, err := b.Consume(routing.QueuePerilDLQ, ConsumeOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer dlq.Close()
+			var quarantined Consumer
+			if tt.policy == DecodeFailureQuarantine {
+				quarantined, err = b.Consume(DefaultQuarantineQueue, ConsumeOptions{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer quarantined.Close()
+			}
+
+			before := DecodeFailures(tt.queue)
+			err = b.Publish(context.Background(), "ex", "logs.alice", Message{
+				ContentType: ContentTypeJSON,
+				Body:        []byte(`"not a number"`),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			switch tt.want {
+			case routing.QueuePerilDLQ:
+				receive(t, dlq)
+			case DefaultQuarantineQueue:
+				d := receive(t, quarantined)
+				wantHeaders := map[string]any{
+					HeaderOriginalExchange:   "ex",
+					HeaderOriginalRoutingKey: "logs.alice",
+					HeaderOriginalQueue:      tt.queue,
+				}
+				for k, v := range wantHeaders {
+					if d.Headers[k] != v {
+						t.Errorf("header %s = %v, want %v", k, d.Headers[k], v)
+					}
+				}
+				if msg, _ := d.Headers[HeaderDecodeError].(string); msg == "" {
+					t.Errorf("header %s = %v, want the decoding error", HeaderDecodeError, d.Headers[HeaderDecodeError])
+				}
+				if string(d.Body) != `"not a number"` {
+					t.Errorf("quarantined %q, want the original body", d.Body)
+				}
+				expectNone(t, dlq)
+			default:
+				deadline := time.Now().Add(testTimeout)
+				for DecodeFailures(tt.queue) == before && time.Now().Before(deadline) {
+					time.Sleep(time.Millisecond)
+				}
+				expectNone(t, dlq)
+			}
+
+			if got := DecodeFailures(tt.queue); got != before+1 {
+				t.Errorf("DecodeFailures(%s) = %d, want %d", tt.queue, got, before+1)
+			}
+			if got := DecodeFailureCounts()[tt.queue]; got != before+1 {
+				t.Errorf("DecodeFailureCounts()[%s] = %d, want %d", tt.queue, got, before+1)
+			}
+		})
+	}
+}
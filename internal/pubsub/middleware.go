@@ -0,0 +1,122 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// MessageHandler is a handler seen from a middleware: the decoded value is
+// out of reach, only the envelope and the ack decision are.
+type MessageHandler func(ctx context.Context, env Envelope) Acktype
+
+// Middleware wraps every handler of a subscription. The context it passes
+// next must derive from the one it was given, which carries the decoded
+// value down to the handler.
+type Middleware func(next MessageHandler) MessageHandler
+
+var globalMiddlewares = struct {
+	sync.RWMutex
+	chain []Middleware
+}{}
+
+// Use installs middlewares on every subscription started afterwards, those
+// already running keeping the chain they started with. They run outside the
+// ones given with WithMiddleware, the first one outermost.
+func Use(mws ...Middleware) {
+	globalMiddlewares.Lock()
+	defer globalMiddlewares.Unlock()
+	globalMiddlewares.chain = append(globalMiddlewares.chain, mws...)
+}
+
+// chain wraps h in the global middlewares installed so far followed by the
+// subscription's own.
+func chain(h MessageHandler, local []Middleware) MessageHandler {
+	globalMiddlewares.RLock()
+	mws := append(append([]Middleware{}, globalMiddlewares.chain...), local...)
+	globalMiddlewares.RUnlock()
+
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](h)
+	}
+	return h
+}
+
+// Recover turns a panicking handler into a NackDiscard so that a single bad
+// message cannot take the whole process down.
+func Recover() Middleware {
+	return func(next MessageHandler) MessageHandler {
+		return func(ctx context.Context, env Envelope) (ack Acktype) {
+			defer func() {
+				if r := recover(); r != nil {
+					fmt.Printf("handler panicked on message %s: %v\n%s", env.MessageID, r, debug.Stack())
+					ack = NackDiscard
+				}
+			}()
+			return next(ctx, env)
+		}
+	}
+}
+
+// LogAcks logs the ack decision taken for every message.
+func LogAcks(logger *slog.Logger) Middleware {
+	return func(next MessageHandler) MessageHandler {
+		return func(ctx context.Context, env Envelope) Acktype {
+			ack := next(ctx, env)
+			logger.InfoContext(ctx, "message handled",
+				"ack", ack.String(),
+				"type", env.Type,
+				"message_id", env.MessageID,
+				"routing_key", env.RoutingKey,
+				"attempt", env.Attempt,
+			)
+			return ack
+		}
+	}
+}
+
+// MeasureLatency reports how long the handler took for every message.
+func MeasureLatency(observe func(env Envelope, ack Acktype, took time.Duration)) Middleware {
+	return func(next MessageHandler) MessageHandler {
+		return func(ctx context.Context, env Envelope) Acktype {
+			start := time.Now()
+			ack := next(ctx, env)
+			observe(env, ack, time.Since(start))
+			return ack
+		}
+	}
+}
+
+// Timeout cancels the handler's context after d. A handler still running by
+// then is waited for, and the message requeued whatever it decided, so it
+// may be handled more than once: handlers have to honour their context, or
+// be idempotent.
+func Timeout(d time.Duration) Middleware {
+	return func(next MessageHandler) MessageHandler {
+		return func(ctx context.Context, env Envelope) Acktype {
+			ctx, cancel := context.WithTimeout(ctx, d)
+			defer cancel()
+			ack := next(ctx, env)
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				fmt.Printf("handler for message %s timed out after %v\n", env.MessageID, d)
+				return NackRequeue
+			}
+			return ack
+		}
+	}
+}
+
+// Finally calls fn once the handler is done with a message, e.g. to print
+// the prompt again after the handler's output.
+func Finally(fn func()) Middleware {
+	return func(next MessageHandler) MessageHandler {
+		return func(ctx context.Context, env Envelope) Acktype {
+			defer fn()
+			return next(ctx, env)
+		}
+	}
+}
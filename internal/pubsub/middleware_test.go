@@ -0,0 +1,188 @@
+package pubsub
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// useForTest installs middlewares with Use until the test ends.
+func useForTest(t *testing.T, mws ...Middleware) {
+	globalMiddlewares.Lock()
+	saved := globalMiddlewares.chain
+	globalMiddlewares.Unlock()
+	t.Cleanup(func() {
+		globalMiddlewares.Lock()
+		globalMiddlewares.chain = saved
+		globalMiddlewares.Unlock()
+	})
+	Use(mws...)
+}
+
+func acking(ack Acktype) MessageHandler {
+	return func(ctx context.Context, env Envelope) Acktype {
+		return ack
+	}
+}
+
+func TestRecover(t *testing.T) {
+	h := Recover()(func(ctx context.Context, env Envelope) Acktype {
+		panic("boom")
+	})
+	if ack := h(context.Background(), Envelope{MessageID: "m1"}); ack != NackDiscard {
+		t.Errorf("panicking handler settled with %v, want NackDiscard", ack)
+	}
+	if ack := Recover()(acking(RetryLater))(context.Background(), Envelope{}); ack != RetryLater {
+		t.Errorf("handler settled with %v, want its own RetryLater", ack)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler MessageHandler
+		want    Acktype
+	}{
+		{"in time", acking(Ack), Ack},
+		{"in time with its own decision", acking(NackDiscard), NackDiscard},
+		{"honouring the deadline", func(ctx context.Context, env Envelope) Acktype {
+			<-ctx.Done()
+			return Ack
+		}, NackRequeue},
+		{"ignoring the deadline", func(ctx context.Context, env Envelope) Acktype {
+			time.Sleep(30 * time.Millisecond)
+			return Ack
+		}, NackRequeue},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			returned := false
+			h := Timeout(10 * time.Millisecond)(func(ctx context.Context, env Envelope) Acktype {
+				defer func() { returned = true }()
+				return tt.handler(ctx, env)
+			})
+			ack := h(context.Background(), Envelope{})
+			if !returned {
+				t.Error("Timeout returned while the handler was still running")
+			}
+			if ack != tt.want {
+				t.Errorf("settled with %v, want %v", ack, tt.want)
+			}
+		})
+	}
+}
+
+func TestLogAcks(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buf, nil))
+	h := LogAcks(logger)(acking(RetryLater))
+	ack := h(context.Background(), Envelope{MessageID: "m1", Type: "string", RoutingKey: "logs.alice", Attempt: 2})
+	if ack != RetryLater {
+		t.Errorf("settled with %v, want RetryLater", ack)
+	}
+
+	var got map[string]any
+	err := json.Unmarshal(buf.Bytes(), &got)
+	if err != nil {
+		t.Fatalf("could not decode %q: %v", buf.String(), err)
+	}
+	want := map[string]any{
+		"msg":         "message handled",
+		"ack":         "RetryLater",
+		"type":        "string",
+		"message_id":  "m1",
+		"routing_key": "logs.alice",
+		"attempt":     float64(2),
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("logged %s = %v, want %v", k, got[k], v)
+		}
+	}
+}
+
+func TestMeasureLatency(t *testing.T) {
+	var observed []Acktype
+	var took time.Duration
+	h := MeasureLatency(func(env Envelope, ack Acktype, d time.Duration) {
+		if env.MessageID != "m1" {
+			t.Errorf("observed message %q, want m1", env.MessageID)
+		}
+		observed = append(observed, ack)
+		took = d
+	})(func(ctx context.Context, env Envelope) Acktype {
+		time.Sleep(10 * time.Millisecond)
+		return NackRequeue
+	})
+	h(context.Background(), Envelope{MessageID: "m1"})
+	if !reflect.DeepEqual(observed, []Acktype{NackRequeue}) {
+		t.Errorf("observed %v, want [NackRequeue]", observed)
+	}
+	if took < 10*time.Millisecond {
+		t.Errorf("took %v, want at least the handler's 10ms", took)
+	}
+}
+
+// TestMiddlewareChain checks the order middlewares run in and that Use
+// leaves running subscriptions alone.
+func TestMiddlewareChain(t *testing.T) {
+	b := NewMemoryBroker()
+	defer b.Close()
+	declare(t, b, "ex", ExchangeDirect, nil)
+
+	calls := make(chan string, 10)
+	named := func(name string) Middleware {
+		return func(next MessageHandler) MessageHandler {
+			return func(ctx context.Context, env Envelope) Acktype {
+				calls <- name
+				return next(ctx, env)
+			}
+		}
+	}
+	subscribe := func(queue string) {
+		t.Helper()
+		sub, err := Subscribe(b, "ex", queue, queue, SimpleQueueTransient,
+			func(ctx context.Context, d Delivery[string]) Acktype {
+				calls <- "handler " + d.Value
+				return Ack
+			},
+			WithMiddleware(named("local")),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { sub.Close(context.Background()) })
+	}
+	handled := func(queue string, want ...string) {
+		t.Helper()
+		err := PublishJSON(b, "ex", queue, queue)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for range want {
+			select {
+			case c := <-calls:
+				got = append(got, c)
+			case <-time.After(testTimeout):
+				t.Fatalf("got %v, want %v", got, want)
+			}
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	}
+
+	useForTest(t, named("first"), named("second"))
+	subscribe("before")
+	handled("before", "first", "second", "local", "handler before")
+
+	Use(named("later"))
+	handled("before", "first", "second", "local", "handler before")
+	subscribe("after")
+	handled("after", "first", "second", "later", "local", "handler after")
+}
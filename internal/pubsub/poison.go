@@ -0,0 +1,80 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+type DecodeFailurePolicy int
+
+const (
+	// DecodeFailureDeadLetter rejects the message so that it is routed to
+	// the queue's dead-letter exchange.
+	DecodeFailureDeadLetter DecodeFailurePolicy = iota
+	// DecodeFailureDiscard acks and drops the message.
+	DecodeFailureDiscard
+	// DecodeFailureQuarantine moves the message to a quarantine queue, with
+	// the decoding error in the x-decode-error header.
+	DecodeFailureQuarantine
+)
+
+const DefaultQuarantineQueue = "peril_quarantine"
+
+var decodeFailures = struct {
+	sync.Mutex
+	counts map[string]uint64
+}{counts: map[string]uint64{}}
+
+// DecodeFailures returns how many messages from queueName could not be
+// decoded since the process started.
+func DecodeFailures(queueName string) uint64 {
+	decodeFailures.Lock()
+	defer decodeFailures.Unlock()
+	return decodeFailures.counts[queueName]
+}
+
+// DecodeFailureCounts returns the decode failure counters of every queue.
+func DecodeFailureCounts() map[string]uint64 {
+	decodeFailures.Lock()
+	defer decodeFailures.Unlock()
+	counts := make(map[string]uint64, len(decodeFailures.counts))
+	for queue, count := range decodeFailures.counts {
+		counts[queue] = count
+	}
+	return counts
+}
+
+func handleDecodeFailure(b Broker, cfg subscribeConfig, queueName string, msg RawDelivery, decodeErr error) {
+	decodeFailures.Lock()
+	decodeFailures.counts[queueName]++
+	decodeFailures.Unlock()
+
+	fmt.Printf("could not unmarshal message from %s: %v\n", queueName, decodeErr)
+
+	switch cfg.decodeFailurePolicy {
+	case DecodeFailureDiscard:
+		msg.Ack()
+		return
+	case DecodeFailureQuarantine:
+		err := quarantine(b, cfg.quarantineQueue, queueName, msg, decodeErr)
+		if err == nil {
+			msg.Ack()
+			return
+		}
+		fmt.Printf("could not quarantine message: %v\n", err)
+	}
+	msg.Nack(false)
+}
+
+func quarantine(b Broker, quarantineQueue, queueName string, msg RawDelivery, decodeErr error) error {
+	parked := copyMessage(msg.Message)
+	if parked.Headers == nil {
+		parked.Headers = map[string]any{}
+	}
+	parked.Headers[HeaderDecodeError] = decodeErr.Error()
+	parked.Headers[HeaderOriginalExchange] = msg.Exchange
+	parked.Headers[HeaderOriginalRoutingKey] = msg.RoutingKey
+	parked.Headers[HeaderOriginalQueue] = queueName
+	return b.Publish(context.Background(), "", quarantineQueue, parked)
+}
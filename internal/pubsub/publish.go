@@ -0,0 +1,108 @@
+package pubsub
+
+import (
+	"context"
+	"time"
+)
+
+type PublishOption func(*publishConfig)
+
+type publishConfig struct {
+	contentType    string
+	confirm        bool
+	confirmTimeout time.Duration
+
+	sender        string
+	correlationID string
+	causationID   string
+	schemaVersion int
+	headers       map[string]any
+}
+
+func newPublishConfig(opts []PublishOption) publishConfig {
+	cfg := publishConfig{
+		contentType:   ContentTypeJSON,
+		schemaVersion: DefaultSchemaVersion,
+	}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	return cfg
+}
+
+func WithContentType(contentType string) PublishOption {
+	return func(cfg *publishConfig) {
+		cfg.contentType = contentType
+	}
+}
+
+// WithConfirm makes the publish wait up to timeout for the broker to accept
+// the message. Unroutable messages are reported as an *UnroutableError.
+func WithConfirm(timeout time.Duration) PublishOption {
+	return func(cfg *publishConfig) {
+		cfg.confirm = true
+		cfg.confirmTimeout = timeout
+	}
+}
+
+// WithSender records who published the message, usually the username.
+func WithSender(sender string) PublishOption {
+	return func(cfg *publishConfig) {
+		cfg.sender = sender
+	}
+}
+
+func WithCorrelationID(id string) PublishOption {
+	return func(cfg *publishConfig) {
+		cfg.correlationID = id
+	}
+}
+
+func WithCausationID(id string) PublishOption {
+	return func(cfg *publishConfig) {
+		cfg.causationID = id
+	}
+}
+
+// WithHeader sets a header of the message, for metadata of the
+// application's own.
+func WithHeader(key string, value any) PublishOption {
+	return func(cfg *publishConfig) {
+		if cfg.headers == nil {
+			cfg.headers = map[string]any{}
+		}
+		cfg.headers[key] = value
+	}
+}
+
+func WithSchemaVersion(version int) PublishOption {
+	return func(cfg *publishConfig) {
+		cfg.schemaVersion = version
+	}
+}
+
+// CausedBy marks the message as a consequence of the one described by env,
+// continuing its correlation.
+func CausedBy(env Envelope) PublishOption {
+	return func(cfg *publishConfig) {
+		cfg.correlationID = env.CorrelationID
+		if cfg.correlationID == "" {
+			cfg.correlationID = env.MessageID
+		}
+		cfg.causationID = env.MessageID
+	}
+}
+
+func publish(b Broker, exchange, key string, msg Message, cfg publishConfig) error {
+	if !cfg.confirm {
+		return b.Publish(context.Background(), exchange, key, msg)
+	}
+
+	ctx := context.Background()
+	if cfg.confirmTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.confirmTimeout)
+		defer cancel()
+	}
+	return b.PublishConfirmed(ctx, exchange, key, msg)
+}
@@ -1,56 +1,52 @@
 package pubsub
 
 import (
-	"bytes"
 	"context"
-	"encoding/gob"
-	"encoding/json"
 	"fmt"
 
-	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/gabrieldiem/learn-pub-sub-starter/internal/routing"
 )
 
-func PublishJSON[T any](ch *amqp.Channel, exchange, key string, val T) error {
-	dat, err := json.Marshal(val)
+// Publish encodes val with the codec for the content type chosen with
+// WithContentType, JSON by default.
+func Publish[T any](b Broker, exchange, key string, val T, opts ...PublishOption) error {
+	cfg := newPublishConfig(opts)
+	msg, err := encode(val, cfg)
 	if err != nil {
 		return err
 	}
-	return ch.PublishWithContext(context.Background(), exchange, key, false, false, amqp.Publishing{
-		ContentType: "application/json",
-		Body:        dat,
-	})
+	return publish(b, exchange, key, msg, cfg)
 }
 
-func encode[T any](val T) ([]byte, error) {
-	var buf bytes.Buffer
-	enc := gob.NewEncoder(&buf)
-	err := enc.Encode(val)
-	if err != nil {
-		return nil, err
-	}
-	return buf.Bytes(), nil
+// Encode builds the message Publish would send, for publishing it later
+// with Broker.Publish or Broker.PublishConfirmed.
+func Encode[T any](val T, opts ...PublishOption) (Message, error) {
+	return encode(val, newPublishConfig(opts))
 }
 
-func decode[T any](data []byte) (T, error) {
-	var val T
-	buf := bytes.NewBuffer(data)
-	dec := gob.NewDecoder(buf)
-	err := dec.Decode(&val)
+func encode[T any](val T, cfg publishConfig) (Message, error) {
+	c, err := CodecFor(cfg.contentType)
 	if err != nil {
-		return val, err
+		return Message{}, err
 	}
-	return val, nil
-}
-
-func PublishGob[T any](ch *amqp.Channel, exchange, key string, val T) error {
-	dat, err := encode(val)
+	dat, err := c.Marshal(val)
 	if err != nil {
-		return err
+		return Message{}, err
 	}
-	return ch.PublishWithContext(context.Background(), exchange, key, false, false, amqp.Publishing{
-		ContentType: "application/gob",
+	msg := Message{
+		ContentType: c.ContentType(),
 		Body:        dat,
-	})
+	}
+	stamp(&msg, typeName[T](), cfg)
+	return msg, nil
+}
+
+func PublishJSON[T any](b Broker, exchange, key string, val T, opts ...PublishOption) error {
+	return Publish(b, exchange, key, val, append(opts, WithContentType(ContentTypeJSON))...)
+}
+
+func PublishGob[T any](b Broker, exchange, key string, val T, opts ...PublishOption) error {
+	return Publish(b, exchange, key, val, append(opts, WithContentType(ContentTypeGob))...)
 }
 
 type Acktype int
@@ -66,154 +62,137 @@ const (
 	Ack Acktype = iota
 	NackDiscard
 	NackRequeue
+	// RetryLater redelivers the message after a delay growing with every
+	// attempt, and dead-letters it once the subscription's RetryPolicy
+	// gives up.
+	RetryLater
 )
 
-func SubscribeJSON[T any](
-	conn *amqp.Connection,
+func (a Acktype) String() string {
+	switch a {
+	case Ack:
+		return "Ack"
+	case NackDiscard:
+		return "NackDiscard"
+	case NackRequeue:
+		return "NackRequeue"
+	case RetryLater:
+		return "RetryLater"
+	}
+	return fmt.Sprintf("Acktype(%d)", int(a))
+}
+
+// decodedKey holds a delivery's decoded value in the context handed down the
+// middleware chain.
+type decodedKey struct{}
+
+// Subscribe decodes each delivery with the codec registered for its content
+// type. Deliveries without one are decoded as WithDefaultContentType says,
+// JSON unless told otherwise.
+func Subscribe[T any](
+	b Broker,
 	exchange,
 	queueName,
 	key string,
 	queueType SimpleQueueType,
-	handler func(T) Acktype,
-) error {
-	ch, queue, err := DeclareAndBind(conn, exchange, queueName, key, queueType)
+	handler Handler[T],
+	opts ...SubscribeOption,
+) (*Subscription, error) {
+	cfg := newSubscribeConfig(opts)
+	err := cfg.prepare(b)
 	if err != nil {
-		return fmt.Errorf("could not declare and bind queue: %v", err)
+		return nil, err
 	}
 
-	msgs, err := ch.Consume(
-		queue.Name, // queue
-		"",         // consumer
-		false,      // auto-ack
-		false,      // exclusive
-		false,      // no-local
-		false,      // no-wait
-		nil,        // args
-	)
+	queue, err := DeclareAndBind(b, exchange, queueName, key, queueType)
 	if err != nil {
-		return fmt.Errorf("could not consume messages: %v", err)
+		return nil, fmt.Errorf("could not declare and bind queue: %v", err)
 	}
 
-	unmarshaller := func(data []byte) (T, error) {
-		var target T
-		err := json.Unmarshal(data, &target)
-		return target, err
+	consumer, err := b.Consume(queue, ConsumeOptions{Prefetch: cfg.prefetch})
+	if err != nil {
+		return nil, fmt.Errorf("could not consume messages: %v", err)
 	}
 
-	go func() {
-		defer ch.Close()
-		for msg := range msgs {
-			target, err := unmarshaller(msg.Body)
-			if err != nil {
-				fmt.Printf("could not unmarshal message: %v\n", err)
-				continue
-			}
-			switch handler(target) {
-			case Ack:
-				msg.Ack(false)
-				fmt.Println("Ack")
-			case NackDiscard:
-				msg.Nack(false, false)
-				fmt.Println("NackDiscard")
-			case NackRequeue:
-				msg.Nack(false, true)
-				fmt.Println("NackRequeue")
-			}
+	// Built once, so that middlewares installed later with Use leave the
+	// subscription alone. The decoded value is passed down the chain in the
+	// context.
+	h := chain(func(ctx context.Context, env Envelope) Acktype {
+		target, _ := ctx.Value(decodedKey{}).(T)
+		return handler(ctx, Delivery[T]{Envelope: env, Value: target})
+	}, cfg.middlewares)
+
+	sub := newSubscription(queue, consumer)
+	go sub.run(cfg.workers, cfg.orderingKey, func(ctx context.Context, msg RawDelivery) {
+		contentType := msg.ContentType
+		if contentType == "" {
+			contentType = cfg.defaultContentType
 		}
-	}()
-	return nil
+		target, err := decodeAs[T](contentType, msg.Body)
+		if err != nil {
+			handleDecodeFailure(b, cfg, queue, msg, err)
+			return
+		}
+		ctx = context.WithValue(ctx, decodedKey{}, target)
+		settle(b, cfg, queue, msg, h(ctx, envelopeOf(msg)))
+	})
+	return sub, nil
 }
 
-func SubscribeGob[T any](
-	conn *amqp.Connection,
+func SubscribeJSON[T any](
+	b Broker,
 	exchange,
 	queueName,
 	key string,
 	queueType SimpleQueueType,
 	handler func(T) Acktype,
-) error {
-	ch, queue, err := DeclareAndBind(conn, exchange, queueName, key, queueType)
-	if err != nil {
-		return fmt.Errorf("could not declare and bind queue: %v", err)
-	}
+	opts ...SubscribeOption,
+) (*Subscription, error) {
+	opts = append([]SubscribeOption{WithDefaultContentType(ContentTypeJSON)}, opts...)
+	return Subscribe(b, exchange, queueName, key, queueType, valueHandler(handler), opts...)
+}
 
-	msgs, err := ch.Consume(
-		queue.Name, // queue
-		"",         // consumer
-		false,      // auto-ack
-		false,      // exclusive
-		false,      // no-local
-		false,      // no-wait
-		nil,        // args
-	)
-	if err != nil {
-		return fmt.Errorf("could not consume messages: %v", err)
-	}
+func SubscribeGob[T any](
+	b Broker,
+	exchange,
+	queueName,
+	key string,
+	queueType SimpleQueueType,
+	handler func(T) Acktype,
+	opts ...SubscribeOption,
+) (*Subscription, error) {
+	opts = append([]SubscribeOption{WithDefaultContentType(ContentTypeGob)}, opts...)
+	return Subscribe(b, exchange, queueName, key, queueType, valueHandler(handler), opts...)
+}
 
-	unmarshaller := func(data []byte) (T, error) {
-		target, err := decode[T](data)
-		return target, err
+func valueHandler[T any](handler func(T) Acktype) Handler[T] {
+	return func(_ context.Context, d Delivery[T]) Acktype {
+		return handler(d.Value)
 	}
-
-	go func() {
-		defer ch.Close()
-		for msg := range msgs {
-			target, err := unmarshaller(msg.Body)
-			if err != nil {
-				fmt.Printf("could not unmarshal message: %v\n", err)
-				continue
-			}
-			switch handler(target) {
-			case Ack:
-				msg.Ack(false)
-				fmt.Println("Ack")
-			case NackDiscard:
-				msg.Nack(false, false)
-				fmt.Println("NackDiscard")
-			case NackRequeue:
-				msg.Nack(false, true)
-				fmt.Println("NackRequeue")
-			}
-		}
-	}()
-	return nil
 }
 
 func DeclareAndBind(
-	conn *amqp.Connection,
+	b Broker,
 	exchange,
 	queueName,
 	key string,
 	queueType SimpleQueueType,
-) (*amqp.Channel, amqp.Queue, error) {
-	ch, err := conn.Channel()
-	if err != nil {
-		return nil, amqp.Queue{}, fmt.Errorf("could not create channel: %v", err)
-	}
-
-	queue, err := ch.QueueDeclare(
-		queueName,                       // name
-		queueType == SimpleQueueDurable, // durable
-		queueType != SimpleQueueDurable, // delete when unused
-		queueType != SimpleQueueDurable, // exclusive
-		false,                           // no-wait
-		amqp.Table{
-			"x-dead-letter-exchange": "peril_dlx",
+) (string, error) {
+	queue, err := b.DeclareQueue(queueName, QueueOptions{
+		Durable:    queueType == SimpleQueueDurable,
+		AutoDelete: queueType != SimpleQueueDurable,
+		Exclusive:  queueType != SimpleQueueDurable,
+		Args: map[string]any{
+			"x-dead-letter-exchange": routing.ExchangePerilDLX,
 		},
-	)
+	})
 	if err != nil {
-		return nil, amqp.Queue{}, fmt.Errorf("could not declare queue: %v", err)
+		return "", fmt.Errorf("could not declare queue: %v", err)
 	}
 
-	err = ch.QueueBind(
-		queue.Name, // queue name
-		key,        // routing key
-		exchange,   // exchange
-		false,      // no-wait
-		nil,        // args
-	)
+	err = b.BindQueue(queue, key, exchange)
 	if err != nil {
-		return nil, amqp.Queue{}, fmt.Errorf("could not bind queue: %v", err)
+		return "", fmt.Errorf("could not bind queue: %v", err)
 	}
-	return ch, queue, nil
+	return queue, nil
 }
@@ -0,0 +1,163 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// RetryQueuePrefix names the delay queues RetryLater parks messages in, one
+// per delay, e.g. peril_retry_4000ms.
+const RetryQueuePrefix = "peril_retry"
+
+const retryPublishTimeout = 5 * time.Second
+
+// RetryPolicy decides how long a message handled with RetryLater waits before
+// being redelivered, and when to give up on it.
+type RetryPolicy struct {
+	// BaseDelay is the wait before the first retry, doubled on every
+	// following one up to MaxDelay.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// MaxAttempts is how many times the handler sees the message, the first
+	// delivery included, before it is dead-lettered.
+	MaxAttempts int
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	BaseDelay:   time.Second,
+	MaxDelay:    30 * time.Second,
+	MaxAttempts: 5,
+}
+
+// Delay returns how long to wait before the given retry, counting from 1.
+func (p RetryPolicy) Delay(retry int) time.Duration {
+	delay := p.BaseDelay
+	for i := 1; i < retry && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, p.MaxDelay)
+}
+
+// Declaring the delay topology is idempotent, but remember what was already
+// declared to save a round trip per retry. Brokers forget theirs when closed.
+var retryTopology = struct {
+	sync.Mutex
+	declared map[retryDelayKey]struct{}
+}{declared: map[retryDelayKey]struct{}{}}
+
+type retryDelayKey struct {
+	broker Broker
+	delay  time.Duration
+}
+
+// forgetRetryDelays drops what was declared on b, so that a closed broker is
+// not kept around by the cache.
+func forgetRetryDelays(b Broker) {
+	retryTopology.Lock()
+	defer retryTopology.Unlock()
+	for key := range retryTopology.declared {
+		if key.broker == b {
+			delete(retryTopology.declared, key)
+		}
+	}
+}
+
+func retryQueueName(delay time.Duration) string {
+	return fmt.Sprintf("%s_%dms", RetryQueuePrefix, delay.Milliseconds())
+}
+
+// declareRetryDelay declares a fanout exchange and a queue of the same name
+// whose messages expire after delay. Expired messages are dead-lettered to
+// the default exchange, which routes them back to the queue named by their
+// routing key.
+func declareRetryDelay(b Broker, delay time.Duration) (string, error) {
+	name := retryQueueName(delay)
+	key := retryDelayKey{broker: b, delay: delay}
+
+	retryTopology.Lock()
+	defer retryTopology.Unlock()
+	if _, ok := retryTopology.declared[key]; ok {
+		return name, nil
+	}
+
+	err := b.DeclareExchange(name, ExchangeFanout, true)
+	if err != nil {
+		return "", fmt.Errorf("could not declare retry exchange: %v", err)
+	}
+	_, err = b.DeclareQueue(name, QueueOptions{
+		Durable: true,
+		Args: map[string]any{
+			"x-message-ttl":          delay.Milliseconds(),
+			"x-dead-letter-exchange": "",
+		},
+	})
+	if err != nil {
+		return "", fmt.Errorf("could not declare retry queue: %v", err)
+	}
+	err = b.BindQueue(name, "", name)
+	if err != nil {
+		return "", fmt.Errorf("could not bind retry queue: %v", err)
+	}
+	retryTopology.declared[key] = struct{}{}
+	return name, nil
+}
+
+// exchangeDeclarer is implemented by brokers that may not be able to declare
+// the delay exchanges, such as STOMPBroker.
+type exchangeDeclarer interface {
+	declaresExchanges() bool
+}
+
+// retryLater parks the message in the delay queue for its next attempt, or
+// dead-letters it once the policy runs out of attempts. Brokers that cannot
+// declare the delay exchanges requeue it right away once instead.
+func retryLater(b Broker, policy RetryPolicy, queueName string, msg RawDelivery) {
+	if d, ok := b.(exchangeDeclarer); ok && !d.declaresExchanges() {
+		if msg.Redelivered || policy.MaxAttempts <= 1 {
+			fmt.Printf("giving up on redelivered message from %s\n", queueName)
+			msg.Nack(false)
+			return
+		}
+		msg.Nack(true)
+		return
+	}
+
+	retry := headerInt(msg.Headers, HeaderRetryAttempt) + 1
+	if retry >= policy.MaxAttempts {
+		fmt.Printf("giving up on message from %s after %d attempts\n", queueName, retry)
+		msg.Nack(false)
+		return
+	}
+
+	delay := policy.Delay(retry)
+	delayExchange, err := declareRetryDelay(b, delay)
+	if err != nil {
+		fmt.Printf("could not schedule retry: %v\n", err)
+		msg.Nack(true)
+		return
+	}
+
+	parked := copyMessage(msg.Message)
+	if parked.Headers == nil {
+		parked.Headers = map[string]any{}
+	}
+	parked.Headers[HeaderRetryAttempt] = retry
+	if _, ok := parked.Headers[HeaderOriginalExchange]; !ok {
+		parked.Headers[HeaderOriginalExchange] = msg.Exchange
+		parked.Headers[HeaderOriginalRoutingKey] = msg.RoutingKey
+	}
+
+	// The routing key survives the trip through the delay queue and brings
+	// the message back to this subscription's queue only.
+	ctx, cancel := context.WithTimeout(context.Background(), retryPublishTimeout)
+	defer cancel()
+	err = b.PublishConfirmed(ctx, delayExchange, queueName, parked)
+	if err != nil {
+		fmt.Printf("could not schedule retry: %v\n", err)
+		msg.Nack(true)
+		return
+	}
+	msg.Ack()
+}
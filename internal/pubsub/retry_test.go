@@ -0,0 +1,167 @@
+package pubsub
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/gabrieldiem/learn-pub-sub-starter/internal/routing"
+)
+
+func TestRetryPolicyDelay(t *testing.T) {
+	policy := RetryPolicy{BaseDelay: time.Second, MaxDelay: 10 * time.Second, MaxAttempts: 10}
+	tests := []struct {
+		retry int
+		want  time.Duration
+	}{
+		{0, time.Second},
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{4, 8 * time.Second},
+		{5, 10 * time.Second},
+		{50, 10 * time.Second},
+	}
+	for _, tt := range tests {
+		got := policy.Delay(tt.retry)
+		if got != tt.want {
+			t.Errorf("Delay(%d) = %v, want %v", tt.retry, got, tt.want)
+		}
+	}
+
+	capped := RetryPolicy{BaseDelay: 30 * time.Second, MaxDelay: 5 * time.Second}
+	if got := capped.Delay(1); got != 5*time.Second {
+		t.Errorf("Delay(1) with a base above the max = %v, want 5s", got)
+	}
+}
+
+func TestRetryLaterAttemptCutoff(t *testing.T) {
+	tests := []struct {
+		maxAttempts int
+		want        int
+	}{
+		{1, 1},
+		{2, 2},
+		{4, 4},
+	}
+	for _, tt := range tests {
+		b := NewMemoryBroker()
+		err := DeclareDeadLetterQueue(b, routing.ExchangePerilDLX, routing.QueuePerilDLQ)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = b.DeclareExchange("ex", ExchangeDirect, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dlq, err := b.Consume(routing.QueuePerilDLQ, ConsumeOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		handled := make(chan int, 10)
+		sub, err := Subscribe(b, "ex", "q", "k", SimpleQueueTransient,
+			func(ctx context.Context, d Delivery[string]) Acktype {
+				handled <- d.Envelope.Attempt
+				return RetryLater
+			},
+			WithRetryPolicy(RetryPolicy{BaseDelay: time.Millisecond, MaxDelay: 4 * time.Millisecond, MaxAttempts: tt.maxAttempts}),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = PublishJSON(b, "ex", "k", "x")
+		if err != nil {
+			t.Fatal(err)
+		}
+		receive(t, dlq)
+		if len(handled) != tt.want {
+			t.Errorf("MaxAttempts %d: handled %d times, want %d", tt.maxAttempts, len(handled), tt.want)
+		}
+		for i := 0; len(handled) > 0; i++ {
+			if retry := <-handled; retry != i {
+				t.Errorf("MaxAttempts %d: attempt %d carried retry header %d", tt.maxAttempts, i+1, retry)
+			}
+		}
+		sub.Close(context.Background())
+		dlq.Close()
+		b.Close()
+	}
+}
+
+// settlement records how a delivery was settled.
+type settlement struct {
+	acks, requeues, rejects int
+}
+
+func (s *settlement) ack() error {
+	s.acks++
+	return nil
+}
+
+func (s *settlement) nack(requeue bool) error {
+	if requeue {
+		s.requeues++
+	} else {
+		s.rejects++
+	}
+	return nil
+}
+
+func TestRetryLaterWithoutDelayExchanges(t *testing.T) {
+	tests := []struct {
+		name        string
+		redelivered bool
+		want        settlement
+	}{
+		{"first delivery", false, settlement{requeues: 1}},
+		{"redelivered", true, settlement{rejects: 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &settlement{}
+			// STOMPBroker never gets as far as its connection.
+			retryLater(&STOMPBroker{}, DefaultRetryPolicy, "q", RawDelivery{Redelivered: tt.redelivered, acker: s})
+			if *s != tt.want {
+				t.Errorf("settled %+v, want %+v", *s, tt.want)
+			}
+		})
+	}
+}
+
+func declaredRetryDelays(b Broker) int {
+	retryTopology.Lock()
+	defer retryTopology.Unlock()
+	n := 0
+	for key := range retryTopology.declared {
+		if key.broker == b {
+			n++
+		}
+	}
+	return n
+}
+
+func TestRetryDelaysForgottenOnClose(t *testing.T) {
+	b := NewMemoryBroker()
+	other := NewMemoryBroker()
+	defer other.Close()
+	for _, broker := range []Broker{b, other} {
+		for _, delay := range []time.Duration{time.Second, 2 * time.Second} {
+			_, err := declareRetryDelay(broker, delay)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if n := declaredRetryDelays(b); n != 2 {
+		t.Fatalf("%d delays remembered, want 2", n)
+	}
+
+	b.Close()
+	if n := declaredRetryDelays(b); n != 0 {
+		t.Errorf("%d delays remembered after Close, want 0", n)
+	}
+	if n := declaredRetryDelays(other); n != 2 {
+		t.Errorf("%d delays remembered for the other broker, want 2", n)
+	}
+}
@@ -0,0 +1,229 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ReplyQueuePrefix names the exclusive queues Request receives replies on.
+const ReplyQueuePrefix = "peril_reply"
+
+// HeaderRPCError carries the error a Serve handler answered with.
+const HeaderRPCError = "x-rpc-error"
+
+var ErrReplyQueueClosed = errors.New("reply queue closed")
+
+// RemoteError is the error returned by the handler serving a request.
+type RemoteError struct {
+	Key     string
+	Message string
+}
+
+func (e *RemoteError) Error() string {
+	return fmt.Sprintf("request to %s failed: %s", e.Key, e.Message)
+}
+
+// Request publishes req to key on exchange and waits until ctx is done for the
+// reply of whoever Serves it.
+func Request[Req, Resp any](ctx context.Context, b Broker, exchange, key string, req Req, opts ...PublishOption) (Resp, error) {
+	var zero Resp
+	cfg := newPublishConfig(opts)
+	c, err := CodecFor(cfg.contentType)
+	if err != nil {
+		return zero, err
+	}
+	dat, err := c.Marshal(req)
+	if err != nil {
+		return zero, err
+	}
+
+	replies, err := replyListenerFor(b)
+	if err != nil {
+		return zero, fmt.Errorf("could not listen for replies: %v", err)
+	}
+
+	msg := Message{
+		ContentType: c.ContentType(),
+		ReplyTo:     replies.queue,
+		Body:        dat,
+	}
+	stamp(&msg, typeName[Req](), cfg)
+	// Nobody waits for the reply past the deadline, so the request is not
+	// worth serving after it either.
+	if deadline, ok := ctx.Deadline(); ok {
+		msg.Expiration = time.Until(deadline)
+	}
+	reply := replies.expect(msg.MessageID)
+	defer replies.forget(msg.MessageID)
+
+	// Confirmed so that nobody serving key fails right away rather than on
+	// timeout.
+	err = b.PublishConfirmed(ctx, exchange, key, msg)
+	if err != nil {
+		return zero, err
+	}
+
+	select {
+	case d, ok := <-reply:
+		if !ok {
+			return zero, ErrReplyQueueClosed
+		}
+		if remoteErr, ok := d.Headers[HeaderRPCError].(string); ok {
+			return zero, &RemoteError{Key: key, Message: remoteErr}
+		}
+		return decodeAs[Resp](d.ContentType, d.Body)
+	case <-ctx.Done():
+		return zero, fmt.Errorf("no reply to %s: %w", key, ctx.Err())
+	}
+}
+
+// Serve answers the requests sent with Request to key on exchange with what
+// handler returns. A handler error is sent back and returned by Request as a
+// *RemoteError. Requests whose requester stopped waiting are dropped
+// unanswered.
+func Serve[Req, Resp any](
+	b Broker,
+	exchange,
+	queueName,
+	key string,
+	queueType SimpleQueueType,
+	handler func(ctx context.Context, d Delivery[Req]) (Resp, error),
+	opts ...SubscribeOption,
+) (*Subscription, error) {
+	return Subscribe(b, exchange, queueName, key, queueType, func(ctx context.Context, d Delivery[Req]) Acktype {
+		if d.ReplyTo == "" {
+			fmt.Printf("request %s has nowhere to reply to\n", d.MessageID)
+			return NackDiscard
+		}
+		if d.Expired() {
+			fmt.Printf("request %s expired before it was served\n", d.MessageID)
+			return Ack
+		}
+		resp, handlerErr := handler(ctx, d)
+		err := reply(b, d.Envelope, resp, handlerErr)
+		if err != nil {
+			// The requester is most likely gone, answering again won't help.
+			fmt.Printf("could not reply to request %s: %v\n", d.MessageID, err)
+		}
+		return Ack
+	}, opts...)
+}
+
+func reply[Resp any](b Broker, req Envelope, resp Resp, handlerErr error) error {
+	cfg := newPublishConfig([]PublishOption{
+		WithCorrelationID(req.MessageID),
+		WithCausationID(req.MessageID),
+	})
+	if req.ContentType != "" {
+		cfg.contentType = req.ContentType
+	}
+	c, err := CodecFor(cfg.contentType)
+	if err != nil {
+		return err
+	}
+
+	msg := Message{ContentType: c.ContentType()}
+	if handlerErr == nil {
+		msg.Body, err = c.Marshal(resp)
+		if err != nil {
+			// Request decodes by the reply's content type, so a codec that
+			// only knows the request's type can still be answered.
+			c, _ = CodecFor(ContentTypeJSON)
+			msg.ContentType = c.ContentType()
+			msg.Body, err = c.Marshal(resp)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	stamp(&msg, typeName[Resp](), cfg)
+	if handlerErr != nil {
+		msg.Headers[HeaderRPCError] = handlerErr.Error()
+	}
+	return b.Publish(context.Background(), "", req.ReplyTo, msg)
+}
+
+// replyListener consumes the reply queue shared by every Request made
+// through a broker and hands replies to the request waiting for them.
+type replyListener struct {
+	queue string
+
+	mu      sync.Mutex
+	pending map[string]chan RawDelivery
+}
+
+var replyListeners = struct {
+	sync.Mutex
+	byBroker map[Broker]*replyListener
+}{byBroker: map[Broker]*replyListener{}}
+
+func replyListenerFor(b Broker) (*replyListener, error) {
+	replyListeners.Lock()
+	defer replyListeners.Unlock()
+	if l, ok := replyListeners.byBroker[b]; ok {
+		return l, nil
+	}
+
+	// Named here rather than by the server so that the name still holds
+	// after the broker redeclares it on reconnect.
+	queue, err := b.DeclareQueue(ReplyQueuePrefix+"."+uuid.NewString(), QueueOptions{
+		AutoDelete: true,
+		Exclusive:  true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	consumer, err := b.Consume(queue, ConsumeOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	l := &replyListener{queue: queue, pending: map[string]chan RawDelivery{}}
+	replyListeners.byBroker[b] = l
+	go l.run(b, consumer)
+	return l, nil
+}
+
+func (l *replyListener) run(b Broker, consumer Consumer) {
+	for d := range consumer.Deliveries() {
+		d.Ack()
+		l.mu.Lock()
+		reply, ok := l.pending[d.CorrelationID]
+		delete(l.pending, d.CorrelationID)
+		l.mu.Unlock()
+		// Replies arriving after their request gave up are dropped.
+		if ok {
+			reply <- d
+		}
+	}
+
+	replyListeners.Lock()
+	delete(replyListeners.byBroker, b)
+	replyListeners.Unlock()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for id, reply := range l.pending {
+		close(reply)
+		delete(l.pending, id)
+	}
+}
+
+func (l *replyListener) expect(id string) <-chan RawDelivery {
+	reply := make(chan RawDelivery, 1)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.pending[id] = reply
+	return reply
+}
+
+func (l *replyListener) forget(id string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.pending, id)
+}
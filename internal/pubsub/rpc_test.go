@@ -0,0 +1,111 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRequestServe(t *testing.T) {
+	b := NewMemoryBroker()
+	defer b.Close()
+	err := b.DeclareExchange("ex", ExchangeDirect, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expirations := make(chan time.Duration, 1)
+	sub, err := Serve(b, "ex", "double", "double", SimpleQueueTransient,
+		func(ctx context.Context, d Delivery[int]) (int, error) {
+			expirations <- d.Expiration
+			if d.Value < 0 {
+				return 0, errors.New("negative")
+			}
+			return 2 * d.Value, nil
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close(context.Background())
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	got, err := Request[int, int](ctx, b, "ex", "double", 21)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != 42 {
+		t.Errorf("Request = %d, want 42", got)
+	}
+	if exp := <-expirations; exp <= 0 || exp > testTimeout {
+		t.Errorf("request expires after %v, want the time left until the deadline", exp)
+	}
+
+	_, err = Request[int, int](ctx, b, "ex", "double", -1)
+	var remoteErr *RemoteError
+	if !errors.As(err, &remoteErr) || remoteErr.Message != "negative" {
+		t.Errorf("Request = %v, want a *RemoteError", err)
+	}
+}
+
+func TestServeDropsExpiredRequests(t *testing.T) {
+	b := NewMemoryBroker()
+	defer b.Close()
+	err := b.DeclareExchange("ex", ExchangeDirect, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan int, 2)
+	sub, err := Serve(b, "ex", "double", "double", SimpleQueueTransient,
+		func(ctx context.Context, d Delivery[int]) (int, error) {
+			served <- d.Value
+			return 2 * d.Value, nil
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close(context.Background())
+	_, err = b.DeclareQueue("replies", QueueOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	replies, err := b.Consume("replies", ConsumeOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer replies.Close()
+
+	// Sent a minute ago by a requester that gave up after a second.
+	err = b.Publish(context.Background(), "ex", "double", Message{
+		ContentType: ContentTypeJSON,
+		MessageID:   "stale",
+		ReplyTo:     "replies",
+		Timestamp:   time.Now().Add(-time.Minute),
+		Expiration:  time.Second,
+		Body:        []byte("1"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b.Publish(context.Background(), "ex", "double", Message{
+		ContentType: ContentTypeJSON,
+		MessageID:   "fresh",
+		ReplyTo:     "replies",
+		Timestamp:   time.Now(),
+		Expiration:  time.Minute,
+		Body:        []byte("2"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := receive(t, replies)
+	d.Ack()
+	if d.CorrelationID != "fresh" {
+		t.Errorf("answered %q, want only the fresh request", d.CorrelationID)
+	}
+	expectNone(t, replies)
+	if len(served) != 1 || <-served != 2 {
+		t.Error("the stale request reached the handler")
+	}
+}
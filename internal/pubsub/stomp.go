@@ -0,0 +1,465 @@
+package pubsub
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-stomp/stomp/v3"
+	"github.com/go-stomp/stomp/v3/frame"
+	"github.com/google/uuid"
+)
+
+// ErrSingleBinding is returned when binding a queue a second time over
+// STOMP, where a subscription's queue is bound to a single destination.
+var ErrSingleBinding = errors.New("stomp queues can only have one binding")
+
+type STOMPOptions struct {
+	// Login and Passcode are left out of the CONNECT frame when empty, for
+	// brokers identifying clients by their TLS certificate.
+	Login    string
+	Passcode string
+	// Host is the vhost to connect to, "/" when empty.
+	Host      string
+	Heartbeat time.Duration
+	// TLS is used to connect when not nil.
+	TLS *tls.Config
+}
+
+// STOMPBroker is a Broker talking to RabbitMQ's STOMP plugin.
+//
+// Exchange e with routing key k maps to the destination /exchange/e/k and
+// the default exchange to /amq/queue/<queue>. STOMP cannot declare
+// exchanges, so they have to exist already, e.g. applied with
+// peril-topology. Queues are created by RabbitMQ when subscribed to, durable
+// ones right away when bound so that they collect messages before anyone
+// consumes them. Unlike AMQPBroker, it does not reconnect. Without exchanges
+// of its own to delay retries in, RetryLater requeues a message once and
+// dead-letters it the second time.
+type STOMPBroker struct {
+	conn *stomp.Conn
+
+	mu     sync.Mutex
+	queues map[string]*stompQueue
+
+	// receipted hands confirmed publishes to the goroutine waiting for
+	// their receipts, which go-stomp only gives up on after its own
+	// timeout.
+	receipted chan receiptedSend
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+type receiptedSend struct {
+	ctx  context.Context
+	dest string
+	msg  Message
+	sent chan error
+}
+
+type stompQueue struct {
+	name    string
+	opts    QueueOptions
+	binding *stompBinding
+}
+
+type stompBinding struct {
+	exchange string
+	key      string
+}
+
+func DialSTOMP(addr string, opts STOMPOptions) (*STOMPBroker, error) {
+	var netConn net.Conn
+	var err error
+	if opts.TLS != nil {
+		netConn, err = tls.Dial("tcp", addr, opts.TLS)
+	} else {
+		netConn, err = net.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	host := opts.Host
+	if host == "" {
+		host = "/"
+	}
+	connOpts := []func(*stomp.Conn) error{stomp.ConnOpt.Host(host)}
+	if opts.Login != "" || opts.Passcode != "" {
+		connOpts = append(connOpts, stomp.ConnOpt.Login(opts.Login, opts.Passcode))
+	}
+	if opts.Heartbeat > 0 {
+		connOpts = append(connOpts, stomp.ConnOpt.HeartBeat(opts.Heartbeat, opts.Heartbeat))
+	}
+	conn, err := stomp.Connect(netConn, connOpts...)
+	if err != nil {
+		netConn.Close()
+		return nil, err
+	}
+	return newSTOMPBroker(conn), nil
+}
+
+func newSTOMPBroker(conn *stomp.Conn) *STOMPBroker {
+	b := &STOMPBroker{
+		conn:      conn,
+		queues:    map[string]*stompQueue{},
+		receipted: make(chan receiptedSend),
+		done:      make(chan struct{}),
+	}
+	go b.sendReceipted()
+	return b
+}
+
+func exchangeDestination(exchange, key string) string {
+	if exchange == "" {
+		return "/amq/queue/" + key
+	}
+	return "/exchange/" + exchange + "/" + key
+}
+
+// parseDestination is the inverse of exchangeDestination, also accepting the
+// /queue/<queue> destinations unbound queues are consumed from.
+func parseDestination(dest string) (exchange, key string) {
+	switch {
+	case strings.HasPrefix(dest, "/exchange/"):
+		exchange, key, _ = strings.Cut(strings.TrimPrefix(dest, "/exchange/"), "/")
+		return exchange, key
+	case strings.HasPrefix(dest, "/amq/queue/"):
+		return "", strings.TrimPrefix(dest, "/amq/queue/")
+	case strings.HasPrefix(dest, "/queue/"):
+		return "", strings.TrimPrefix(dest, "/queue/")
+	}
+	return "", dest
+}
+
+// DeclareExchange only checks the exchange type, exchanges cannot be
+// declared over STOMP.
+func (b *STOMPBroker) DeclareExchange(name, kind string, durable bool) error {
+	switch kind {
+	case ExchangeDirect, ExchangeTopic, ExchangeFanout:
+		return nil
+	}
+	return fmt.Errorf("unsupported exchange type: %s", kind)
+}
+
+func (b *STOMPBroker) declaresExchanges() bool {
+	return false
+}
+
+func (b *STOMPBroker) DeclareQueue(name string, opts QueueOptions) (string, error) {
+	if name == "" {
+		name = "stomp-gen-" + uuid.NewString()
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if q, ok := b.queues[name]; ok {
+		if q.opts.Durable != opts.Durable || q.opts.AutoDelete != opts.AutoDelete || q.opts.Exclusive != opts.Exclusive {
+			return "", fmt.Errorf("inequivalent arguments for queue %s", name)
+		}
+		return name, nil
+	}
+	b.queues[name] = &stompQueue{name: name, opts: opts}
+	return name, nil
+}
+
+func (b *STOMPBroker) BindQueue(queueName, key, exchange string) error {
+	b.mu.Lock()
+	q, ok := b.queues[queueName]
+	if !ok {
+		b.mu.Unlock()
+		return fmt.Errorf("no queue %s", queueName)
+	}
+	binding := stompBinding{exchange: exchange, key: key}
+	if q.binding != nil {
+		b.mu.Unlock()
+		if *q.binding == binding {
+			return nil
+		}
+		return ErrSingleBinding
+	}
+	q.binding = &binding
+	b.mu.Unlock()
+
+	if !q.opts.Durable || q.opts.AutoDelete {
+		return nil
+	}
+	// Subscribing creates and binds the queue, which outlives the
+	// subscription since it is durable.
+	sub, err := b.conn.Subscribe(exchangeDestination(exchange, key), stomp.AckClientIndividual, queueHeaders(q)...)
+	if err != nil {
+		return err
+	}
+	return sub.Unsubscribe()
+}
+
+// queueHeaders are the SUBSCRIBE headers RabbitMQ creates a queue from.
+func queueHeaders(q *stompQueue) []func(*frame.Frame) error {
+	opts := []func(*frame.Frame) error{
+		stomp.SubscribeOpt.Header("x-queue-name", q.name),
+		stomp.SubscribeOpt.Header("durable", strconv.FormatBool(q.opts.Durable)),
+		stomp.SubscribeOpt.Header("auto-delete", strconv.FormatBool(q.opts.AutoDelete)),
+		stomp.SubscribeOpt.Header("exclusive", strconv.FormatBool(q.opts.Exclusive)),
+	}
+	for k, v := range q.opts.Args {
+		opts = append(opts, stomp.SubscribeOpt.Header(k, fmt.Sprint(v)))
+	}
+	return opts
+}
+
+func (b *STOMPBroker) Publish(ctx context.Context, exchange, key string, msg Message) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return b.conn.Send(exchangeDestination(exchange, key), msg.ContentType, msg.Body, sendHeaders(msg)...)
+}
+
+// PublishConfirmed waits for the broker's receipt. STOMP has no equivalent
+// of the mandatory flag, so unroutable messages are not reported.
+func (b *STOMPBroker) PublishConfirmed(ctx context.Context, exchange, key string, msg Message) error {
+	send := receiptedSend{
+		ctx:  ctx,
+		dest: exchangeDestination(exchange, key),
+		msg:  msg,
+		sent: make(chan error, 1),
+	}
+	select {
+	case b.receipted <- send:
+	case <-ctx.Done():
+		return confirmErr(ctx)
+	case <-b.done:
+		return ErrBrokerClosed
+	}
+	select {
+	case err := <-send.sent:
+		return err
+	case <-ctx.Done():
+		// Still sent, the receipt is waited for without anyone to tell.
+		return confirmErr(ctx)
+	}
+}
+
+func confirmErr(ctx context.Context) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return ErrConfirmTimeout
+	}
+	return ctx.Err()
+}
+
+// sendReceipted sends confirmed publishes one at a time until the broker is
+// closed, skipping those whose caller gave up while they were queued.
+func (b *STOMPBroker) sendReceipted() {
+	for {
+		select {
+		case send := <-b.receipted:
+			if send.ctx.Err() != nil {
+				send.sent <- confirmErr(send.ctx)
+				continue
+			}
+			opts := append(sendHeaders(send.msg), stomp.SendOpt.Receipt)
+			send.sent <- b.conn.Send(send.dest, send.msg.ContentType, send.msg.Body, opts...)
+		case <-b.done:
+			return
+		}
+	}
+}
+
+// sendHeaders maps message properties to the headers RabbitMQ turns into
+// AMQP properties. Other headers travel as strings.
+func sendHeaders(msg Message) []func(*frame.Frame) error {
+	opts := []func(*frame.Frame) error{}
+	add := func(k, v string) {
+		if v != "" {
+			opts = append(opts, stomp.SendOpt.Header(k, v))
+		}
+	}
+	add("amqp-message-id", msg.MessageID)
+	add("correlation-id", msg.CorrelationID)
+	add("reply-to", msg.ReplyTo)
+	add("app-id", msg.AppID)
+	add("type", msg.Type)
+	if !msg.Timestamp.IsZero() {
+		add("timestamp", strconv.FormatInt(msg.Timestamp.Unix(), 10))
+	}
+	add("expiration", expirationOf(msg.Expiration))
+	// Empty headers are kept, an empty original exchange being the default
+	// one.
+	for k, v := range msg.Headers {
+		opts = append(opts, stomp.SendOpt.Header(k, fmt.Sprint(v)))
+	}
+	return opts
+}
+
+func (b *STOMPBroker) Consume(queueName string, opts ConsumeOptions) (Consumer, error) {
+	b.mu.Lock()
+	q, ok := b.queues[queueName]
+	b.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("no queue %s", queueName)
+	}
+
+	// Queues only reached through the default exchange are subscribed to
+	// directly.
+	dest := "/queue/" + q.name
+	if q.binding != nil {
+		dest = exchangeDestination(q.binding.exchange, q.binding.key)
+	}
+	subOpts := queueHeaders(q)
+	if opts.Prefetch > 0 {
+		subOpts = append(subOpts, stomp.SubscribeOpt.Header("prefetch-count", strconv.Itoa(opts.Prefetch)))
+	}
+	sub, err := b.conn.Subscribe(dest, stomp.AckClientIndividual, subOpts...)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &stompConsumer{
+		broker:     b,
+		queue:      q,
+		sub:        sub,
+		deliveries: make(chan RawDelivery),
+		done:       make(chan struct{}),
+		stopped:    make(chan struct{}),
+	}
+	go c.run()
+	return c, nil
+}
+
+func (b *STOMPBroker) Close() error {
+	b.closeOnce.Do(func() {
+		close(b.done)
+		forgetRetryDelays(b)
+	})
+	return b.conn.Disconnect()
+}
+
+type stompConsumer struct {
+	broker     *STOMPBroker
+	queue      *stompQueue
+	sub        *stomp.Subscription
+	deliveries chan RawDelivery
+	done       chan struct{}
+	stopped    chan struct{}
+	closeOnce  sync.Once
+}
+
+func (c *stompConsumer) run() {
+	defer close(c.stopped)
+	defer close(c.deliveries)
+	for {
+		select {
+		case msg, ok := <-c.sub.C:
+			if !ok || msg.Err != nil {
+				return
+			}
+			select {
+			case c.deliveries <- c.fromSTOMPMessage(msg):
+			case <-c.done:
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *stompConsumer) fromSTOMPMessage(msg *stomp.Message) RawDelivery {
+	d := RawDelivery{
+		Message: Message{
+			ContentType: msg.ContentType,
+			Headers:     map[string]any{},
+			Body:        msg.Body,
+		},
+		acker: stompAcker{consumer: c, msg: msg},
+	}
+	d.Exchange, d.RoutingKey = parseDestination(msg.Destination)
+	for i := 0; i < msg.Header.Len(); i++ {
+		k, v := msg.Header.GetAt(i)
+		switch k {
+		case "amqp-message-id":
+			d.MessageID = v
+		case "correlation-id":
+			d.CorrelationID = v
+		case "reply-to":
+			d.ReplyTo = v
+		case "app-id":
+			d.AppID = v
+		case "type":
+			d.Type = v
+		case "timestamp":
+			if sec, err := strconv.ParseInt(v, 10, 64); err == nil {
+				d.Timestamp = time.Unix(sec, 0)
+			}
+		case "expiration":
+			d.Expiration = parseExpiration(v)
+		case "redelivered":
+			d.Redelivered = v == "true"
+		case frame.Destination, frame.MessageId, frame.Subscription, frame.Ack,
+			frame.ContentType, frame.ContentLength, "persistent", "priority":
+		default:
+			d.Headers[k] = v
+		}
+	}
+	return d
+}
+
+func (c *stompConsumer) Deliveries() <-chan RawDelivery {
+	return c.deliveries
+}
+
+func (c *stompConsumer) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		close(c.done)
+		<-c.stopped
+		// Unacknowledged messages go back to the queue with the
+		// subscription.
+		err = c.sub.Unsubscribe()
+	})
+	return err
+}
+
+type stompAcker struct {
+	consumer *stompConsumer
+	msg      *stomp.Message
+}
+
+func (a stompAcker) ack() error {
+	return a.consumer.broker.conn.Ack(a.msg)
+}
+
+// nack requeues with a NACK frame. go-stomp cannot set the requeue header
+// RabbitMQ needs to dead-letter instead, so the message is forwarded to the
+// queue's dead-letter exchange and acknowledged.
+func (a stompAcker) nack(requeue bool) error {
+	conn := a.consumer.broker.conn
+	if requeue {
+		return conn.Nack(a.msg)
+	}
+
+	q := a.consumer.queue
+	if dlx, ok := q.opts.Args["x-dead-letter-exchange"].(string); ok {
+		d := a.consumer.fromSTOMPMessage(a.msg)
+		key := d.RoutingKey
+		if dlk, ok := q.opts.Args["x-dead-letter-routing-key"].(string); ok {
+			key = dlk
+		}
+		if _, ok := d.Headers[HeaderOriginalExchange]; !ok {
+			d.Headers[HeaderOriginalExchange] = d.Exchange
+			d.Headers[HeaderOriginalRoutingKey] = d.RoutingKey
+		}
+		d.Headers[HeaderOriginalQueue] = q.name
+		// As in RabbitMQ, dead-lettered messages no longer expire.
+		d.Expiration = 0
+		err := conn.Send(exchangeDestination(dlx, key), d.ContentType, d.Body, append(sendHeaders(d.Message), stomp.SendOpt.Receipt)...)
+		if err != nil {
+			return err
+		}
+	}
+	return conn.Ack(a.msg)
+}
@@ -0,0 +1,343 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-stomp/stomp/v3"
+	"github.com/go-stomp/stomp/v3/frame"
+)
+
+// fakeSTOMP is the server end of a STOMPBroker's connection. It records the
+// frames the broker sends and answers those asking for a receipt, unless
+// holding receipts back.
+type fakeSTOMP struct {
+	frames chan *frame.Frame
+
+	mu      sync.Mutex
+	w       *frame.Writer
+	holding bool
+	held    []*frame.Frame
+}
+
+func startSTOMP(t *testing.T) (*STOMPBroker, *fakeSTOMP) {
+	t.Helper()
+	client, server := net.Pipe()
+	f := &fakeSTOMP{frames: make(chan *frame.Frame, 64), w: frame.NewWriter(server)}
+	go f.serve(frame.NewReader(server))
+	conn, err := stomp.Connect(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := newSTOMPBroker(conn)
+	t.Cleanup(func() {
+		f.release()
+		b.Close()
+		server.Close()
+	})
+	return b, f
+}
+
+func (f *fakeSTOMP) serve(r *frame.Reader) {
+	for {
+		fr, err := r.Read()
+		if err != nil {
+			return
+		}
+		if fr == nil {
+			continue
+		}
+		if fr.Command == frame.CONNECT || fr.Command == frame.STOMP {
+			f.write(frame.New(frame.CONNECTED, frame.Version, "1.2", frame.HeartBeat, "0,0"))
+			continue
+		}
+		if _, ok := fr.Header.Contains(frame.Receipt); ok {
+			f.mu.Lock()
+			if f.holding {
+				f.held = append(f.held, fr)
+				f.mu.Unlock()
+			} else {
+				f.mu.Unlock()
+				f.receipt(fr)
+			}
+		}
+		if fr.Command != frame.DISCONNECT && fr.Command != frame.UNSUBSCRIBE {
+			f.frames <- fr
+		}
+	}
+}
+
+func (f *fakeSTOMP) write(fr *frame.Frame) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.w.Write(fr)
+}
+
+func (f *fakeSTOMP) receipt(fr *frame.Frame) {
+	f.write(frame.New(frame.RECEIPT, frame.ReceiptId, fr.Header.Get(frame.Receipt)))
+}
+
+func (f *fakeSTOMP) hold() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.holding = true
+}
+
+func (f *fakeSTOMP) release() {
+	f.mu.Lock()
+	held := f.held
+	f.held = nil
+	f.holding = false
+	f.mu.Unlock()
+	for _, fr := range held {
+		f.receipt(fr)
+	}
+}
+
+// next returns the next frame the broker sent, which must be a command.
+func (f *fakeSTOMP) next(t *testing.T, command string) *frame.Frame {
+	t.Helper()
+	select {
+	case fr := <-f.frames:
+		if fr.Command != command {
+			t.Fatalf("broker sent %s %v, want %s", fr.Command, fr.Header, command)
+		}
+		return fr
+	case <-time.After(testTimeout):
+		t.Fatalf("broker sent no %s", command)
+		return nil
+	}
+}
+
+func (f *fakeSTOMP) expectNone(t *testing.T) {
+	t.Helper()
+	select {
+	case fr := <-f.frames:
+		t.Fatalf("unexpected %s %v", fr.Command, fr.Header)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// deliver sends a message to the subscription, acknowledged by the given
+// ack id.
+func (f *fakeSTOMP) deliver(sub *frame.Frame, ack string, msg Message) {
+	fr := frame.New(frame.MESSAGE,
+		frame.Destination, sub.Header.Get(frame.Destination),
+		frame.Subscription, sub.Header.Get(frame.Id),
+		frame.MessageId, ack,
+		frame.Ack, ack,
+		frame.ContentType, msg.ContentType,
+	)
+	fr.Command = frame.SEND
+	for _, opt := range sendHeaders(msg) {
+		opt(fr)
+	}
+	fr.Command = frame.MESSAGE
+	fr.Body = msg.Body
+	f.write(fr)
+}
+
+func TestParseDestination(t *testing.T) {
+	tests := []struct {
+		dest         string
+		wantExchange string
+		wantKey      string
+	}{
+		{"/exchange/peril_topic/army_moves.alice", "peril_topic", "army_moves.alice"},
+		{"/exchange/peril_direct/", "peril_direct", ""},
+		{"/exchange/peril_direct", "peril_direct", ""},
+		{"/exchange/peril_topic/a/b", "peril_topic", "a/b"},
+		{"/amq/queue/peril_dlq", "", "peril_dlq"},
+		{"/queue/game_logs", "", "game_logs"},
+		{"/topic/news", "", "/topic/news"},
+	}
+	for _, tt := range tests {
+		exchange, key := parseDestination(tt.dest)
+		if exchange != tt.wantExchange || key != tt.wantKey {
+			t.Errorf("parseDestination(%q) = %q, %q, want %q, %q", tt.dest, exchange, key, tt.wantExchange, tt.wantKey)
+		}
+	}
+
+	for _, ek := range [][2]string{{"peril_topic", "war.bob"}, {"", "peril_dlq"}} {
+		exchange, key := parseDestination(exchangeDestination(ek[0], ek[1]))
+		if exchange != ek[0] || key != ek[1] {
+			t.Errorf("parseDestination(exchangeDestination(%q, %q)) = %q, %q", ek[0], ek[1], exchange, key)
+		}
+	}
+}
+
+func TestSTOMPHeaders(t *testing.T) {
+	sent := Message{
+		ContentType:   ContentTypeJSON,
+		MessageID:     "m1",
+		CorrelationID: "c1",
+		ReplyTo:       "/amq/queue/replies",
+		Timestamp:     time.Unix(1700000000, 500),
+		AppID:         "alice",
+		Type:          "gamelogic.ArmyMove",
+		Headers: map[string]any{
+			HeaderRetryAttempt:     2,
+			HeaderOriginalExchange: "peril_topic",
+		},
+		Body:       []byte(`{}`),
+		Expiration: 1500 * time.Millisecond,
+	}
+	f := frame.New(frame.SEND,
+		frame.Destination, "/exchange/peril_topic/army_moves.alice",
+		frame.MessageId, "broker-id",
+		frame.Subscription, "sub-1",
+		"redelivered", "true",
+	)
+	for _, opt := range sendHeaders(sent) {
+		err := opt(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	d := (&stompConsumer{}).fromSTOMPMessage(&stomp.Message{
+		Destination: f.Header.Get(frame.Destination),
+		ContentType: sent.ContentType,
+		Header:      f.Header,
+		Body:        sent.Body,
+	})
+	want := sent
+	// Timestamps travel in seconds and headers as strings.
+	want.Timestamp = time.Unix(1700000000, 0)
+	want.Headers = map[string]any{
+		HeaderRetryAttempt:     "2",
+		HeaderOriginalExchange: "peril_topic",
+	}
+	if !reflect.DeepEqual(d.Message, want) {
+		t.Errorf("received %+v, want %+v", d.Message, want)
+	}
+	if d.Exchange != "peril_topic" || d.RoutingKey != "army_moves.alice" || !d.Redelivered {
+		t.Errorf("delivered from %q, %q, redelivered %v", d.Exchange, d.RoutingKey, d.Redelivered)
+	}
+	if env := envelopeOf(d); env.Attempt != 2 || env.Sender != "alice" {
+		t.Errorf("envelope has attempt %d from %q, want 2 from alice", env.Attempt, env.Sender)
+	}
+}
+
+func TestSTOMPAckNack(t *testing.T) {
+	b, f := startSTOMP(t)
+	_, err := b.DeclareQueue("q", QueueOptions{Args: map[string]any{"x-dead-letter-exchange": "dlx"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := b.Consume("q", ConsumeOptions{Prefetch: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	sub := f.next(t, frame.SUBSCRIBE)
+	if dest := sub.Header.Get(frame.Destination); dest != "/queue/q" {
+		t.Errorf("subscribed to %s, want /queue/q", dest)
+	}
+	if sub.Header.Get(frame.Ack) != "client-individual" || sub.Header.Get("prefetch-count") != "3" ||
+		sub.Header.Get("x-dead-letter-exchange") != "dlx" {
+		t.Errorf("subscribed with %v", sub.Header)
+	}
+
+	f.deliver(sub, "a1", Message{MessageID: "acked"})
+	err = receive(t, c).Ack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id := f.next(t, frame.ACK).Header.Get(frame.Id); id != "a1" {
+		t.Errorf("ACK for %q, want a1", id)
+	}
+
+	f.deliver(sub, "a2", Message{MessageID: "requeued"})
+	err = receive(t, c).Nack(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id := f.next(t, frame.NACK).Header.Get(frame.Id); id != "a2" {
+		t.Errorf("NACK for %q, want a2", id)
+	}
+
+	// Dead-lettering resends the message to the dead-letter exchange,
+	// then acknowledges it.
+	f.deliver(sub, "a3", Message{MessageID: "dead", Expiration: time.Minute, Body: []byte("x")})
+	err = receive(t, c).Nack(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	send := f.next(t, frame.SEND)
+	if dest := send.Header.Get(frame.Destination); dest != "/exchange/dlx/q" {
+		t.Errorf("dead-lettered to %s, want /exchange/dlx/q", dest)
+	}
+	for k, want := range map[string]string{
+		"amqp-message-id":        "dead",
+		HeaderOriginalExchange:   "",
+		HeaderOriginalRoutingKey: "q",
+		HeaderOriginalQueue:      "q",
+	} {
+		if got, ok := send.Header.Contains(k); !ok || got != want {
+			t.Errorf("dead-lettered with %s %q, want %q", k, got, want)
+		}
+	}
+	if _, ok := send.Header.Contains("expiration"); ok {
+		t.Error("dead-lettered message still expires")
+	}
+	if id := f.next(t, frame.ACK).Header.Get(frame.Id); id != "a3" {
+		t.Errorf("ACK for %q, want a3", id)
+	}
+	f.expectNone(t)
+}
+
+func TestSTOMPPublishConfirmed(t *testing.T) {
+	b, f := startSTOMP(t)
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	err := b.PublishConfirmed(ctx, "ex", "k", Message{MessageID: "first"})
+	if err != nil {
+		t.Fatalf("PublishConfirmed = %v", err)
+	}
+	send := f.next(t, frame.SEND)
+	if dest := send.Header.Get(frame.Destination); dest != "/exchange/ex/k" {
+		t.Errorf("sent to %s, want /exchange/ex/k", dest)
+	}
+
+	// Callers give up on their deadline while the receipt is late, and
+	// publishes queued behind it are not sent once their caller is gone.
+	f.hold()
+	for _, id := range []string{"late", "abandoned"} {
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		err = b.PublishConfirmed(ctx, "ex", "k", Message{MessageID: id})
+		cancel()
+		if !errors.Is(err, ErrConfirmTimeout) {
+			t.Errorf("PublishConfirmed(%s) with a late receipt = %v, want ErrConfirmTimeout", id, err)
+		}
+	}
+	if id := f.next(t, frame.SEND).Header.Get("amqp-message-id"); id != "late" {
+		t.Errorf("sent %q, want late", id)
+	}
+	f.release()
+	err = b.PublishConfirmed(ctx, "ex", "k", Message{MessageID: "last"})
+	if err != nil {
+		t.Fatalf("PublishConfirmed after the late receipt = %v", err)
+	}
+	if id := f.next(t, frame.SEND).Header.Get("amqp-message-id"); id != "last" {
+		t.Errorf("sent %q, want last", id)
+	}
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = b.PublishConfirmed(cancelled, "ex", "k", Message{})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("PublishConfirmed with a cancelled context = %v", err)
+	}
+	b.Close()
+	err = b.PublishConfirmed(context.Background(), "ex", "k", Message{})
+	if !errors.Is(err, ErrBrokerClosed) {
+		t.Errorf("PublishConfirmed after Close = %v, want ErrBrokerClosed", err)
+	}
+	f.expectNone(t)
+}
@@ -0,0 +1,114 @@
+package pubsub
+
+type SubscribeOption func(*subscribeConfig)
+
+type subscribeConfig struct {
+	defaultContentType  string
+	decodeFailurePolicy DecodeFailurePolicy
+	quarantineQueue     string
+	prefetch            int
+	workers             int
+	orderingKey         func(Envelope) string
+	retryPolicy         RetryPolicy
+	middlewares         []Middleware
+}
+
+func newSubscribeConfig(opts []SubscribeOption) subscribeConfig {
+	cfg := subscribeConfig{
+		defaultContentType:  ContentTypeJSON,
+		decodeFailurePolicy: DecodeFailureDeadLetter,
+		quarantineQueue:     DefaultQuarantineQueue,
+		workers:             1,
+		retryPolicy:         DefaultRetryPolicy,
+	}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	return cfg
+}
+
+// prepare declares whatever the subscription needs besides its own queue.
+func (cfg subscribeConfig) prepare(b Broker) error {
+	if cfg.decodeFailurePolicy == DecodeFailureQuarantine {
+		_, err := b.DeclareQueue(cfg.quarantineQueue, QueueOptions{Durable: true})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WithDefaultContentType sets how deliveries without a content type are
+// decoded.
+func WithDefaultContentType(contentType string) SubscribeOption {
+	return func(cfg *subscribeConfig) {
+		cfg.defaultContentType = contentType
+	}
+}
+
+func WithDecodeFailurePolicy(policy DecodeFailurePolicy) SubscribeOption {
+	return func(cfg *subscribeConfig) {
+		cfg.decodeFailurePolicy = policy
+	}
+}
+
+// WithQuarantineQueue sets the queue undecodable messages are parked in
+// under DecodeFailureQuarantine.
+func WithQuarantineQueue(queueName string) SubscribeOption {
+	return func(cfg *subscribeConfig) {
+		cfg.quarantineQueue = queueName
+	}
+}
+
+// WithPrefetch limits how many deliveries the broker hands the subscription
+// before they are acknowledged.
+func WithPrefetch(n int) SubscribeOption {
+	return func(cfg *subscribeConfig) {
+		cfg.prefetch = n
+	}
+}
+
+// WithWorkers runs up to n handlers concurrently.
+func WithWorkers(n int) SubscribeOption {
+	return func(cfg *subscribeConfig) {
+		cfg.workers = max(n, 1)
+	}
+}
+
+// WithOrderedBy keeps deliveries sharing a key in order when running several
+// workers, by always handing them to the same worker.
+func WithOrderedBy(key func(Envelope) string) SubscribeOption {
+	return func(cfg *subscribeConfig) {
+		cfg.orderingKey = key
+	}
+}
+
+// WithRetryPolicy sets how deliveries handled with RetryLater are retried.
+func WithRetryPolicy(policy RetryPolicy) SubscribeOption {
+	return func(cfg *subscribeConfig) {
+		cfg.retryPolicy = policy
+	}
+}
+
+// WithMiddleware wraps the subscription's handler in mws, inside any
+// middleware installed with Use.
+func WithMiddleware(mws ...Middleware) SubscribeOption {
+	return func(cfg *subscribeConfig) {
+		cfg.middlewares = append(cfg.middlewares, mws...)
+	}
+}
+
+// WithDeduplication acknowledges messages store remembers as handled
+// without handling them again. Being a middleware, it runs inside the
+// ones given before it.
+func WithDeduplication(store SeenStore) SubscribeOption {
+	return WithMiddleware(Deduplicate(store))
+}
+
+func ByRoutingKey(env Envelope) string {
+	return env.RoutingKey
+}
+
+func BySender(env Envelope) string {
+	return env.Sender
+}
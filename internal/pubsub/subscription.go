@@ -0,0 +1,138 @@
+package pubsub
+
+import (
+	"context"
+	"hash/fnv"
+	"sync"
+)
+
+type Handler[T any] func(ctx context.Context, d Delivery[T]) Acktype
+
+// Subscription is a running consumer started by Subscribe.
+type Subscription struct {
+	queue    string
+	consumer Consumer
+
+	// ctx is handed to handlers and cancelled when the subscription stops
+	// or Close gives up waiting for them.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+}
+
+func newSubscription(queue string, consumer Consumer) *Subscription {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Subscription{
+		queue:    queue,
+		consumer: consumer,
+		ctx:      ctx,
+		cancel:   cancel,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+func (s *Subscription) Queue() string {
+	return s.queue
+}
+
+// Done is closed once the subscription stopped handling deliveries, either
+// because it was closed or because the broker went away.
+func (s *Subscription) Done() <-chan struct{} {
+	return s.done
+}
+
+func (s *Subscription) run(workers int, orderingKey func(Envelope) string, process func(ctx context.Context, msg RawDelivery)) {
+	defer close(s.done)
+	defer s.cancel()
+
+	// Without an ordering key all workers share one inbox, otherwise each
+	// key is always dispatched to the same worker.
+	inboxes := make([]chan RawDelivery, workers)
+	shared := make(chan RawDelivery)
+	var wg sync.WaitGroup
+	for i := range inboxes {
+		inboxes[i] = shared
+		if orderingKey != nil {
+			inboxes[i] = make(chan RawDelivery)
+		}
+		wg.Add(1)
+		go func(inbox <-chan RawDelivery) {
+			defer wg.Done()
+			for msg := range inbox {
+				process(s.ctx, msg)
+			}
+		}(inboxes[i])
+	}
+	defer func() {
+		if orderingKey == nil {
+			close(shared)
+		} else {
+			for _, inbox := range inboxes {
+				close(inbox)
+			}
+		}
+		wg.Wait()
+	}()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case msg, ok := <-s.consumer.Deliveries():
+			if !ok {
+				return
+			}
+			inbox := shared
+			if orderingKey != nil {
+				h := fnv.New32a()
+				h.Write([]byte(orderingKey(envelopeOf(msg))))
+				inbox = inboxes[h.Sum32()%uint32(workers)]
+			}
+			select {
+			case inbox <- msg:
+			case <-s.stop:
+				// Left unacked, the consumer puts it back when closed.
+				return
+			}
+		}
+	}
+}
+
+// Close stops taking new deliveries and waits for the handlers in flight to
+// finish before closing the consumer. If ctx is done first, the handlers'
+// context is cancelled and Close returns without them. Deliveries that were
+// not handled are returned to the queue.
+func (s *Subscription) Close(ctx context.Context) error {
+	s.stopOnce.Do(func() {
+		close(s.stop)
+	})
+
+	var err error
+	select {
+	case <-s.done:
+	case <-ctx.Done():
+		s.cancel()
+		err = ctx.Err()
+	}
+	if cerr := s.consumer.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func settle(b Broker, cfg subscribeConfig, queueName string, msg RawDelivery, ack Acktype) {
+	switch ack {
+	case Ack:
+		msg.Ack()
+	case NackDiscard:
+		msg.Nack(false)
+	case NackRequeue:
+		msg.Nack(true)
+	case RetryLater:
+		retryLater(b, cfg.retryPolicy, queueName, msg)
+	}
+}
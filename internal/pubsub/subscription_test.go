@@ -0,0 +1,212 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// subscribeDurable subscribes handler to the durable queue name, bound to ex
+// with the name as key, so that what is left in the queue can be looked at
+// after the subscription closes.
+func subscribeDurable(t *testing.T, b Broker, name string, handler Handler[string], opts ...SubscribeOption) *Subscription {
+	t.Helper()
+	sub, err := Subscribe(b, "ex", name, name, SimpleQueueDurable, handler, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sub
+}
+
+func TestSubscriptionCloseDrainsHandlers(t *testing.T) {
+	b := NewMemoryBroker()
+	defer b.Close()
+	declare(t, b, "ex", ExchangeDirect, nil)
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	handlerErr := make(chan error, 1)
+	sub := subscribeDurable(t, b, "drain", func(ctx context.Context, d Delivery[string]) Acktype {
+		close(started)
+		<-release
+		handlerErr <- ctx.Err()
+		return Ack
+	})
+	err := PublishJSON(b, "ex", "drain", "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-started
+
+	closed := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+		defer cancel()
+		closed <- sub.Close(ctx)
+	}()
+	select {
+	case err := <-closed:
+		t.Fatalf("Close returned %v with a handler in flight", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	if err := <-closed; err != nil {
+		t.Fatalf("Close = %v", err)
+	}
+	if err := <-handlerErr; err != nil {
+		t.Errorf("handler context was cancelled while draining: %v", err)
+	}
+	c, err := b.Consume("drain", ConsumeOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	expectNone(t, c)
+}
+
+func TestSubscriptionCloseCancelsHandlers(t *testing.T) {
+	b := NewMemoryBroker()
+	defer b.Close()
+	declare(t, b, "ex", ExchangeDirect, nil)
+
+	// Requeued, the delivery may come back before the subscription stops.
+	started := make(chan struct{}, 1)
+	cancelled := make(chan struct{}, 1)
+	sub := subscribeDurable(t, b, "cancel", func(ctx context.Context, d Delivery[string]) Acktype {
+		select {
+		case started <- struct{}{}:
+		default:
+		}
+		<-ctx.Done()
+		select {
+		case cancelled <- struct{}{}:
+		default:
+		}
+		return NackRequeue
+	})
+	err := PublishJSON(b, "ex", "cancel", "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err = sub.Close(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Close = %v, want context.DeadlineExceeded", err)
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(testTimeout):
+		t.Fatal("handler context was not cancelled")
+	}
+
+	// The delivery the handler gave up on is back in the queue.
+	c, err := b.Consume("cancel", ConsumeOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if d := receive(t, c); !d.Redelivered {
+		t.Error("delivery was not marked redelivered")
+	}
+}
+
+func TestSubscriptionWorkers(t *testing.T) {
+	b := NewMemoryBroker()
+	defer b.Close()
+	declare(t, b, "ex", ExchangeDirect, nil)
+
+	const workers = 3
+	started := make(chan string, workers+1)
+	release := make(chan struct{})
+	sub := subscribeDurable(t, b, "workers", func(ctx context.Context, d Delivery[string]) Acktype {
+		started <- d.Value
+		<-release
+		return Ack
+	}, WithWorkers(workers))
+	defer sub.Close(context.Background())
+	defer close(release)
+
+	for i := range workers + 1 {
+		err := PublishJSON(b, "ex", "workers", fmt.Sprint(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := range workers {
+		select {
+		case <-started:
+		case <-time.After(testTimeout):
+			t.Fatalf("%d handlers running, want %d", i, workers)
+		}
+	}
+	select {
+	case v := <-started:
+		t.Fatalf("handled %s with all %d workers busy", v, workers)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// TestSubscriptionOrderedBy interleaves deliveries for several keys and
+// checks each key's are handled in the order they were published, however
+// long the handlers take.
+func TestSubscriptionOrderedBy(t *testing.T) {
+	b := NewMemoryBroker()
+	defer b.Close()
+	declare(t, b, "ex", ExchangeTopic, nil)
+
+	keys := []string{"k.alice", "k.bob", "k.carol", "k.dave", "k.eve"}
+	const perKey = 20
+	var mu sync.Mutex
+	got := map[string][]string{}
+	handled := 0
+	done := make(chan struct{})
+	sub, err := Subscribe(b, "ex", "ordered", "k.*", SimpleQueueDurable,
+		func(ctx context.Context, d Delivery[string]) Acktype {
+			time.Sleep(time.Duration(rand.Intn(500)) * time.Microsecond)
+			mu.Lock()
+			defer mu.Unlock()
+			got[d.RoutingKey] = append(got[d.RoutingKey], d.Value)
+			handled++
+			if handled == len(keys)*perKey {
+				close(done)
+			}
+			return Ack
+		},
+		WithWorkers(4),
+		WithOrderedBy(ByRoutingKey),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close(context.Background())
+
+	want := map[string][]string{}
+	for i := range perKey {
+		for _, key := range keys {
+			err := PublishJSON(b, "ex", key, fmt.Sprint(i))
+			if err != nil {
+				t.Fatal(err)
+			}
+			want[key] = append(want[key], fmt.Sprint(i))
+		}
+	}
+	select {
+	case <-done:
+	case <-time.After(testTimeout):
+		t.Fatal("not every delivery was handled")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("handled %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,36 @@
+package pubsub
+
+import "testing"
+
+func TestMatchTopic(t *testing.T) {
+	tests := []struct {
+		pattern string
+		key     string
+		want    bool
+	}{
+		{"army_moves.alice", "army_moves.alice", true},
+		{"army_moves.alice", "army_moves.bob", false},
+		{"army_moves.*", "army_moves.alice", true},
+		{"army_moves.*", "army_moves", false},
+		{"army_moves.*", "army_moves.alice.extra", false},
+		{"*.alice", "war.alice", true},
+		{"#", "", true},
+		{"#", "game_logs.alice", true},
+		{"game_logs.#", "game_logs", true},
+		{"game_logs.#", "game_logs.alice.europe", true},
+		{"game_logs.#", "war.alice", false},
+		{"#.alice", "war.alice", true},
+		{"#.alice", "alice", true},
+		{"#.alice", "war.bob", false},
+		{"war.#.europe", "war.europe", true},
+		{"war.#.europe", "war.alice.bob.europe", true},
+		{"war.*.europe", "war.europe", false},
+		{"*.#", "war", true},
+	}
+	for _, tt := range tests {
+		got := MatchTopic(tt.pattern, tt.key)
+		if got != tt.want {
+			t.Errorf("MatchTopic(%q, %q) = %v, want %v", tt.pattern, tt.key, got, tt.want)
+		}
+	}
+}
@@ -6,6 +6,24 @@ type PlayingState struct {
 	IsPaused bool
 }
 
+// GetPlayingState asks the server whether the game is paused, answered with a
+// PlayingState.
+type GetPlayingState struct{}
+
+// GetState asks the server for the sender's units, answered with a
+// gamelogic.StateDelta resetting them.
+type GetState struct{}
+
+// Join asks the server to claim the sender's username, answered with a
+// Session. A client that joined before sends the token it got in
+// HeaderToken to join again.
+type Join struct{}
+
+// Session holds the token the server issued for a username.
+type Session struct {
+	Token string
+}
+
 type GameLog struct {
 	CurrentTime time.Time
 	Message     string
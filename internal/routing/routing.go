@@ -8,9 +8,34 @@ const (
 	PauseKey = "pause"
 
 	GameLogSlug = "game_logs"
+
+	GetPlayingStateKey = "get_playing_state"
+
+	// Intents clients send the server, answered with the StateDelta of the
+	// change they made.
+	SpawnKey = "spawn"
+	MoveKey  = "move"
+	// GetStateKey asks the server for every unit of the sender.
+	GetStateKey = "get_state"
+	// JoinKey claims the sender's username, answered with the Session
+	// token that intents must carry in HeaderToken.
+	JoinKey = "join"
+
+	StateDeltasPrefix = "deltas"
+	WarResultsPrefix  = "war_results"
 )
 
+// HeaderToken carries the token proving an intent comes from its sender.
+const HeaderToken = "x-peril-token"
+
 const (
 	ExchangePerilDirect = "peril_direct"
 	ExchangePerilTopic  = "peril_topic"
+	ExchangePerilDLX    = "peril_dlx"
+)
+
+const (
+	QueuePerilDLQ = "peril_dlq"
+	// QueuePerilServerLock is held by the one server running the game.
+	QueuePerilServerLock = "peril_server_lock"
 )
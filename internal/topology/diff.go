@@ -0,0 +1,227 @@
+package topology
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/gabrieldiem/learn-pub-sub-starter/internal/pubsub"
+)
+
+// definitions is the part of a RabbitMQ definitions export, as produced by
+// rabbitmqctl export_definitions or GET /api/definitions, that a Spec covers.
+type definitions struct {
+	Exchanges []struct {
+		Name       string `json:"name"`
+		Vhost      string `json:"vhost"`
+		Type       string `json:"type"`
+		Durable    bool   `json:"durable"`
+		AutoDelete bool   `json:"auto_delete"`
+	} `json:"exchanges"`
+	Queues []struct {
+		Name       string         `json:"name"`
+		Vhost      string         `json:"vhost"`
+		Durable    bool           `json:"durable"`
+		AutoDelete bool           `json:"auto_delete"`
+		Arguments  map[string]any `json:"arguments"`
+	} `json:"queues"`
+	Bindings []struct {
+		Source          string `json:"source"`
+		Vhost           string `json:"vhost"`
+		Destination     string `json:"destination"`
+		DestinationType string `json:"destination_type"`
+		RoutingKey      string `json:"routing_key"`
+	} `json:"bindings"`
+}
+
+// ParseDefinitions reads the topology of one vhost out of a RabbitMQ
+// definitions export. Exclusive queues are never exported.
+func ParseDefinitions(r io.Reader, vhost string) (Spec, error) {
+	var defs definitions
+	err := json.NewDecoder(r).Decode(&defs)
+	if err != nil {
+		return Spec{}, fmt.Errorf("could not parse definitions: %v", err)
+	}
+
+	spec := Spec{}
+	for _, ex := range defs.Exchanges {
+		if ex.Vhost != vhost {
+			continue
+		}
+		spec.Exchanges = append(spec.Exchanges, Exchange{Name: ex.Name, Type: ex.Type, Durable: ex.Durable})
+	}
+	for _, q := range defs.Queues {
+		if q.Vhost != vhost {
+			continue
+		}
+		args := normalizeArgs(q.Arguments)
+		if len(args) == 0 {
+			args = nil
+		}
+		spec.Queues = append(spec.Queues, Queue{Name: q.Name, Durable: q.Durable, AutoDelete: q.AutoDelete, Args: args})
+	}
+	for _, b := range defs.Bindings {
+		// Bindings to the default exchange are implicit.
+		if b.Vhost != vhost || b.Source == "" || b.DestinationType != "queue" {
+			continue
+		}
+		spec.Bindings = append(spec.Bindings, Binding{Exchange: b.Source, Queue: b.Destination, Key: b.RoutingKey})
+	}
+	return spec, nil
+}
+
+type ChangeKind int
+
+const (
+	// Missing is in the spec but not on the broker, Apply will create it.
+	Missing ChangeKind = iota
+	// Extra is on the broker but not in the spec.
+	Extra
+	// Mismatch exists on both sides with different settings, Apply will
+	// fail on it until the broker's copy is deleted.
+	Mismatch
+)
+
+func (k ChangeKind) String() string {
+	switch k {
+	case Missing:
+		return "+"
+	case Extra:
+		return "-"
+	case Mismatch:
+		return "~"
+	}
+	return "?"
+}
+
+type Change struct {
+	Kind   ChangeKind
+	Object string
+	Detail string
+}
+
+func (c Change) String() string {
+	if c.Detail == "" {
+		return fmt.Sprintf("%s %s", c.Kind, c.Object)
+	}
+	return fmt.Sprintf("%s %s: %s", c.Kind, c.Object, c.Detail)
+}
+
+// Diff lists what differs between the wanted spec and what a broker has.
+// Entities the broker creates by itself, such as the amq.* exchanges, are
+// left out, as are those the game declares as it runs unless the spec has
+// them: transient queues, the retry delay exchanges and queues, and their
+// bindings.
+func Diff(want, have Spec) []Change {
+	changes := []Change{}
+
+	haveExchanges := map[string]Exchange{}
+	for _, ex := range have.Exchanges {
+		if ex.Name == "" || strings.HasPrefix(ex.Name, "amq.") {
+			continue
+		}
+		haveExchanges[ex.Name] = ex
+	}
+	for _, ex := range want.Exchanges {
+		object := "exchange " + ex.Name
+		got, ok := haveExchanges[ex.Name]
+		delete(haveExchanges, ex.Name)
+		if !ok {
+			changes = append(changes, Change{Kind: Missing, Object: object})
+		} else if got != ex {
+			changes = append(changes, Change{Kind: Mismatch, Object: object,
+				Detail: fmt.Sprintf("want %s durable=%v, have %s durable=%v", ex.Type, ex.Durable, got.Type, got.Durable)})
+		}
+	}
+	// Left out of the extra bindings along with the exchanges and queues.
+	runtime := map[string]struct{}{}
+	for _, name := range sortedKeys(haveExchanges) {
+		if isRetryDelay(name) {
+			runtime["exchange "+name] = struct{}{}
+			continue
+		}
+		changes = append(changes, Change{Kind: Extra, Object: "exchange " + name})
+	}
+
+	haveQueues := map[string]Queue{}
+	for _, q := range have.Queues {
+		haveQueues[q.Name] = q
+	}
+	for _, q := range want.Queues {
+		object := "queue " + q.Name
+		got, ok := haveQueues[q.Name]
+		delete(haveQueues, q.Name)
+		if !ok {
+			changes = append(changes, Change{Kind: Missing, Object: object})
+			continue
+		}
+		if got.Durable != q.Durable || got.AutoDelete != q.AutoDelete {
+			changes = append(changes, Change{Kind: Mismatch, Object: object,
+				Detail: fmt.Sprintf("want durable=%v auto_delete=%v, have durable=%v auto_delete=%v",
+					q.Durable, q.AutoDelete, got.Durable, got.AutoDelete)})
+		}
+		wantArgs, haveArgs := normalizeArgs(q.Args), normalizeArgs(got.Args)
+		if len(wantArgs) != 0 || len(haveArgs) != 0 {
+			if !reflect.DeepEqual(wantArgs, haveArgs) {
+				changes = append(changes, Change{Kind: Mismatch, Object: object,
+					Detail: fmt.Sprintf("want arguments %v, have %v", wantArgs, haveArgs)})
+			}
+		}
+	}
+	for _, name := range sortedKeys(haveQueues) {
+		q := haveQueues[name]
+		if !q.Durable || q.AutoDelete || q.Exclusive || isRetryDelay(name) {
+			runtime["queue "+name] = struct{}{}
+			continue
+		}
+		changes = append(changes, Change{Kind: Extra, Object: "queue " + name})
+	}
+
+	haveBindings := map[Binding]struct{}{}
+	for _, b := range have.Bindings {
+		haveBindings[b] = struct{}{}
+	}
+	for _, b := range want.Bindings {
+		if _, ok := haveBindings[b]; ok {
+			delete(haveBindings, b)
+			continue
+		}
+		changes = append(changes, Change{Kind: Missing, Object: bindingName(b)})
+	}
+	extra := make([]string, 0, len(haveBindings))
+	for b := range haveBindings {
+		_, fromRuntime := runtime["exchange "+b.Exchange]
+		_, toRuntime := runtime["queue "+b.Queue]
+		if fromRuntime || toRuntime {
+			continue
+		}
+		extra = append(extra, bindingName(b))
+	}
+	sort.Strings(extra)
+	for _, name := range extra {
+		changes = append(changes, Change{Kind: Extra, Object: name})
+	}
+	return changes
+}
+
+// isRetryDelay reports whether name is one of the exchanges and queues
+// pubsub declares for RetryLater, one per delay.
+func isRetryDelay(name string) bool {
+	return strings.HasPrefix(name, pubsub.RetryQueuePrefix+"_")
+}
+
+func bindingName(b Binding) string {
+	return fmt.Sprintf("binding %s -> %s (%q)", b.Exchange, b.Queue, b.Key)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,159 @@
+package topology
+
+import (
+	"strings"
+	"testing"
+)
+
+const definitionsExport = `{
+  "exchanges": [
+    {"name": "peril_direct", "vhost": "/", "type": "direct", "durable": true, "auto_delete": false},
+    {"name": "peril_topic", "vhost": "/", "type": "fanout", "durable": true, "auto_delete": false},
+    {"name": "amq.topic", "vhost": "/", "type": "topic", "durable": true, "auto_delete": false},
+    {"name": "leftover", "vhost": "/", "type": "topic", "durable": false, "auto_delete": false},
+    {"name": "peril_retry_1000ms", "vhost": "/", "type": "fanout", "durable": true, "auto_delete": false},
+    {"name": "peril_direct", "vhost": "other", "type": "topic", "durable": false, "auto_delete": false}
+  ],
+  "queues": [
+    {"name": "game_logs", "vhost": "/", "durable": true, "auto_delete": false,
+     "arguments": {"x-dead-letter-exchange": "peril_dlx", "x-message-ttl": 5000}},
+    {"name": "pause_test", "vhost": "/", "durable": false, "auto_delete": true, "arguments": {}},
+    {"name": "old_logs", "vhost": "/", "durable": true, "auto_delete": false, "arguments": {}},
+    {"name": "peril_retry_1000ms", "vhost": "/", "durable": true, "auto_delete": false,
+     "arguments": {"x-dead-letter-exchange": "", "x-message-ttl": 1000}},
+    {"name": "game_logs", "vhost": "other", "durable": false, "auto_delete": false, "arguments": {}}
+  ],
+  "bindings": [
+    {"source": "peril_topic", "vhost": "/", "destination": "game_logs", "destination_type": "queue", "routing_key": "game_logs.*"},
+    {"source": "", "vhost": "/", "destination": "game_logs", "destination_type": "queue", "routing_key": "game_logs"},
+    {"source": "peril_topic", "vhost": "/", "destination": "peril_direct", "destination_type": "exchange", "routing_key": "#"},
+    {"source": "peril_direct", "vhost": "/", "destination": "pause_test", "destination_type": "queue", "routing_key": "pause"},
+    {"source": "peril_topic", "vhost": "/", "destination": "old_logs", "destination_type": "queue", "routing_key": "game_logs.*"},
+    {"source": "peril_retry_1000ms", "vhost": "/", "destination": "peril_retry_1000ms", "destination_type": "queue", "routing_key": ""}
+  ]
+}`
+
+func TestParseDefinitions(t *testing.T) {
+	spec, err := ParseDefinitions(strings.NewReader(definitionsExport), "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(spec.Exchanges) != 5 {
+		t.Errorf("got %d exchanges, want the 5 of vhost /", len(spec.Exchanges))
+	}
+	if len(spec.Queues) != 4 {
+		t.Fatalf("got %d queues, want the 4 of vhost /", len(spec.Queues))
+	}
+	if spec.Queues[1].Args != nil {
+		t.Errorf("empty arguments parsed as %v, want nil", spec.Queues[1].Args)
+	}
+	// Only bindings from a named exchange to a queue are kept.
+	if len(spec.Bindings) != 4 {
+		t.Errorf("got bindings %+v, want 4", spec.Bindings)
+	}
+
+	_, err = ParseDefinitions(strings.NewReader("{"), "/")
+	if err == nil {
+		t.Error("parsed a truncated export")
+	}
+}
+
+func TestDiff(t *testing.T) {
+	have, err := ParseDefinitions(strings.NewReader(definitionsExport), "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Spec{
+		Exchanges: []Exchange{
+			{Name: "peril_direct", Type: "direct", Durable: true},
+			{Name: "peril_topic", Type: "topic", Durable: true},
+			{Name: "peril_dlx", Type: "fanout", Durable: true},
+		},
+		Queues: []Queue{
+			// JSON numbers and YAML ints must compare equal.
+			{Name: "game_logs", Durable: true, Args: map[string]any{"x-dead-letter-exchange": "peril_dlx", "x-message-ttl": 5000}},
+			{Name: "peril_dlq", Durable: true},
+		},
+		Bindings: []Binding{
+			{Exchange: "peril_topic", Queue: "game_logs", Key: "game_logs.*"},
+			{Exchange: "peril_dlx", Queue: "peril_dlq", Key: ""},
+		},
+	}
+
+	got := []string{}
+	for _, c := range Diff(want, have) {
+		got = append(got, c.String())
+	}
+	expected := []string{
+		"~ exchange peril_topic: want topic durable=true, have fanout durable=true",
+		"+ exchange peril_dlx",
+		"- exchange leftover",
+		"+ queue peril_dlq",
+		"- queue old_logs",
+		`+ binding peril_dlx -> peril_dlq ("")`,
+		`- binding peril_topic -> old_logs ("game_logs.*")`,
+	}
+	if strings.Join(got, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Diff got:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(expected, "\n"))
+	}
+
+	if changes := Diff(want, want); len(changes) != 0 {
+		t.Errorf("Diff of a spec against itself = %v, want none", changes)
+	}
+}
+
+// TestDiffLeavesRuntimeEntitiesOut checks a broker the game is running on
+// matches its spec, whatever clients and retries declared meanwhile.
+func TestDiffLeavesRuntimeEntitiesOut(t *testing.T) {
+	want := Peril()
+	have := Peril()
+	have.Exchanges = append(have.Exchanges,
+		Exchange{Name: "peril_retry_1000ms", Type: "fanout", Durable: true},
+		Exchange{Name: "amq.direct", Type: "direct", Durable: true},
+	)
+	have.Queues = append(have.Queues,
+		Queue{Name: "peril_retry_1000ms", Durable: true, Args: map[string]any{"x-message-ttl": 1000}},
+		Queue{Name: "army_moves.alice", AutoDelete: true, Exclusive: true},
+		Queue{Name: "amq.gen-JzTY20BRgKO", AutoDelete: true},
+	)
+	have.Bindings = append(have.Bindings,
+		Binding{Exchange: "peril_retry_1000ms", Queue: "peril_retry_1000ms"},
+		Binding{Exchange: "peril_topic", Queue: "army_moves.alice", Key: "army_moves.*"},
+	)
+	if changes := Diff(want, have); len(changes) != 0 {
+		t.Errorf("Diff = %v, want none", changes)
+	}
+
+	// Unless the spec has them.
+	want.Queues = append(want.Queues, Queue{Name: "army_moves.alice", Durable: true})
+	got := []string{}
+	for _, c := range Diff(want, have) {
+		got = append(got, c.String())
+	}
+	expected := []string{
+		"~ queue army_moves.alice: want durable=true auto_delete=false, have durable=false auto_delete=true",
+		`- binding peril_topic -> army_moves.alice ("army_moves.*")`,
+	}
+	if strings.Join(got, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Diff got:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(expected, "\n"))
+	}
+}
+
+func TestDiffArgumentMismatch(t *testing.T) {
+	want := Spec{Queues: []Queue{{Name: "q", Durable: true, Args: map[string]any{"x-dead-letter-exchange": "peril_dlx"}}}}
+	have := Spec{Queues: []Queue{{Name: "q", Durable: false}}}
+	changes := Diff(want, have)
+	if len(changes) != 2 || changes[0].Kind != Mismatch || changes[1].Kind != Mismatch {
+		t.Fatalf("got %v, want a settings and an arguments mismatch", changes)
+	}
+	if !strings.Contains(changes[1].Detail, "peril_dlx") {
+		t.Errorf("argument mismatch %q does not name the argument", changes[1].Detail)
+	}
+}
+
+func TestPerilIsValid(t *testing.T) {
+	err := Peril().Validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
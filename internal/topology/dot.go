@@ -0,0 +1,38 @@
+package topology
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Dot renders the spec as a Graphviz digraph: exchanges as diamonds, queues
+// as boxes, bindings as edges labelled with their key and dead-letter
+// exchanges as dashed edges.
+func (s Spec) Dot() string {
+	var sb strings.Builder
+	sb.WriteString("digraph topology {\n")
+	sb.WriteString("\trankdir=LR;\n")
+	for _, ex := range s.Exchanges {
+		fmt.Fprintf(&sb, "\t%q [shape=diamond, label=%q];\n", "exchange:"+ex.Name, ex.Name+"\n("+ex.Type+")")
+	}
+	for _, q := range s.Queues {
+		fmt.Fprintf(&sb, "\t%q [shape=box, label=%q];\n", "queue:"+q.Name, q.Name)
+	}
+	for _, b := range s.Bindings {
+		fmt.Fprintf(&sb, "\t%q -> %q [label=%q];\n", "exchange:"+b.Exchange, "queue:"+b.Queue, b.Key)
+	}
+	for _, q := range s.Queues {
+		dlx, ok := q.Args["x-dead-letter-exchange"].(string)
+		if !ok {
+			continue
+		}
+		// The default exchange routes by queue name, so there is no node to
+		// point at.
+		if dlx == "" {
+			continue
+		}
+		fmt.Fprintf(&sb, "\t%q -> %q [style=dashed, label=\"dead letters\"];\n", "queue:"+q.Name, "exchange:"+dlx)
+	}
+	sb.WriteString("}\n")
+	return sb.String()
+}
@@ -0,0 +1,199 @@
+package topology
+
+import (
+	"fmt"
+	"os"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/gabrieldiem/learn-pub-sub-starter/internal/pubsub"
+	"github.com/gabrieldiem/learn-pub-sub-starter/internal/routing"
+)
+
+// Spec describes the exchanges, queues and bindings a broker needs before
+// the game can run.
+type Spec struct {
+	Exchanges []Exchange `yaml:"exchanges"`
+	Queues    []Queue    `yaml:"queues"`
+	Bindings  []Binding  `yaml:"bindings"`
+}
+
+type Exchange struct {
+	Name    string `yaml:"name"`
+	Type    string `yaml:"type"`
+	Durable bool   `yaml:"durable"`
+}
+
+type Queue struct {
+	Name       string         `yaml:"name"`
+	Durable    bool           `yaml:"durable"`
+	AutoDelete bool           `yaml:"auto_delete,omitempty"`
+	Exclusive  bool           `yaml:"exclusive,omitempty"`
+	Args       map[string]any `yaml:"arguments,omitempty"`
+}
+
+type Binding struct {
+	Exchange string `yaml:"exchange"`
+	Queue    string `yaml:"queue"`
+	Key      string `yaml:"key"`
+}
+
+// deadLettered are the arguments of every queue declared by
+// pubsub.DeclareAndBind, which must match for the declarations to agree.
+func deadLettered() map[string]any {
+	return map[string]any{"x-dead-letter-exchange": routing.ExchangePerilDLX}
+}
+
+// Peril is the topology shared by the server and clients. Queues belonging
+// to a single client are declared by the client itself when subscribing.
+func Peril() Spec {
+	return Spec{
+		Exchanges: []Exchange{
+			{Name: routing.ExchangePerilDirect, Type: pubsub.ExchangeDirect, Durable: true},
+			{Name: routing.ExchangePerilTopic, Type: pubsub.ExchangeTopic, Durable: true},
+			{Name: routing.ExchangePerilDLX, Type: pubsub.ExchangeFanout, Durable: true},
+		},
+		Queues: []Queue{
+			{Name: routing.QueuePerilDLQ, Durable: true},
+			{Name: pubsub.DefaultQuarantineQueue, Durable: true},
+			{Name: routing.GameLogSlug, Durable: true, Args: deadLettered()},
+			{Name: routing.GetPlayingStateKey, Durable: true, Args: deadLettered()},
+			{Name: routing.SpawnKey, Durable: true, Args: deadLettered()},
+			{Name: routing.MoveKey, Durable: true, Args: deadLettered()},
+			{Name: routing.GetStateKey, Durable: true, Args: deadLettered()},
+			{Name: routing.JoinKey, Durable: true, Args: deadLettered()},
+		},
+		Bindings: []Binding{
+			{Exchange: routing.ExchangePerilDLX, Queue: routing.QueuePerilDLQ, Key: ""},
+			{Exchange: routing.ExchangePerilTopic, Queue: routing.GameLogSlug, Key: routing.GameLogSlug + ".*"},
+			{Exchange: routing.ExchangePerilDirect, Queue: routing.GetPlayingStateKey, Key: routing.GetPlayingStateKey},
+			{Exchange: routing.ExchangePerilDirect, Queue: routing.SpawnKey, Key: routing.SpawnKey},
+			{Exchange: routing.ExchangePerilDirect, Queue: routing.MoveKey, Key: routing.MoveKey},
+			{Exchange: routing.ExchangePerilDirect, Queue: routing.GetStateKey, Key: routing.GetStateKey},
+			{Exchange: routing.ExchangePerilDirect, Queue: routing.JoinKey, Key: routing.JoinKey},
+		},
+	}
+}
+
+// Load reads a spec from a YAML file.
+func Load(path string) (Spec, error) {
+	dat, err := os.ReadFile(path)
+	if err != nil {
+		return Spec{}, err
+	}
+	return Parse(dat)
+}
+
+func Parse(dat []byte) (Spec, error) {
+	var spec Spec
+	err := yaml.Unmarshal(dat, &spec)
+	if err != nil {
+		return Spec{}, fmt.Errorf("could not parse topology: %v", err)
+	}
+	for i := range spec.Queues {
+		spec.Queues[i].Args = normalizeArgs(spec.Queues[i].Args)
+	}
+	return spec, spec.Validate()
+}
+
+func (s Spec) YAML() ([]byte, error) {
+	return yaml.Marshal(s)
+}
+
+// Validate checks that names are unique and that bindings refer to declared
+// exchanges and queues.
+func (s Spec) Validate() error {
+	exchanges := map[string]struct{}{}
+	for _, ex := range s.Exchanges {
+		if ex.Name == "" {
+			return fmt.Errorf("exchange without a name")
+		}
+		switch ex.Type {
+		case pubsub.ExchangeDirect, pubsub.ExchangeTopic, pubsub.ExchangeFanout:
+		default:
+			return fmt.Errorf("exchange %s has unsupported type %q", ex.Name, ex.Type)
+		}
+		if _, ok := exchanges[ex.Name]; ok {
+			return fmt.Errorf("exchange %s declared twice", ex.Name)
+		}
+		exchanges[ex.Name] = struct{}{}
+	}
+
+	queues := map[string]struct{}{}
+	for _, q := range s.Queues {
+		if q.Name == "" {
+			return fmt.Errorf("queue without a name")
+		}
+		if _, ok := queues[q.Name]; ok {
+			return fmt.Errorf("queue %s declared twice", q.Name)
+		}
+		queues[q.Name] = struct{}{}
+	}
+
+	for _, b := range s.Bindings {
+		if _, ok := exchanges[b.Exchange]; !ok {
+			return fmt.Errorf("binding of %s refers to undeclared exchange %s", b.Queue, b.Exchange)
+		}
+		if _, ok := queues[b.Queue]; !ok {
+			return fmt.Errorf("binding to %s refers to undeclared queue %s", b.Exchange, b.Queue)
+		}
+	}
+	return nil
+}
+
+// Apply declares everything in the spec. Declarations are idempotent, so it
+// is safe to apply on every start; it fails if the broker already has an
+// entity of the same name with different settings.
+func Apply(b pubsub.Broker, spec Spec) error {
+	err := spec.Validate()
+	if err != nil {
+		return err
+	}
+	for _, ex := range spec.Exchanges {
+		err := b.DeclareExchange(ex.Name, ex.Type, ex.Durable)
+		if err != nil {
+			return fmt.Errorf("could not declare exchange %s: %v", ex.Name, err)
+		}
+	}
+	for _, q := range spec.Queues {
+		_, err := b.DeclareQueue(q.Name, pubsub.QueueOptions{
+			Durable:    q.Durable,
+			AutoDelete: q.AutoDelete,
+			Exclusive:  q.Exclusive,
+			Args:       q.Args,
+		})
+		if err != nil {
+			return fmt.Errorf("could not declare queue %s: %v", q.Name, err)
+		}
+	}
+	for _, bnd := range spec.Bindings {
+		err := b.BindQueue(bnd.Queue, bnd.Key, bnd.Exchange)
+		if err != nil {
+			return fmt.Errorf("could not bind %s to %s: %v", bnd.Queue, bnd.Exchange, err)
+		}
+	}
+	return nil
+}
+
+// normalizeArgs turns numeric arguments into int64, the type RabbitMQ
+// reports them with, whatever they were decoded from.
+func normalizeArgs(args map[string]any) map[string]any {
+	if args == nil {
+		return nil
+	}
+	out := make(map[string]any, len(args))
+	for k, v := range args {
+		switch n := v.(type) {
+		case int:
+			v = int64(n)
+		case int32:
+			v = int64(n)
+		case float64:
+			if n == float64(int64(n)) {
+				v = int64(n)
+			}
+		}
+		out[k] = v
+	}
+	return out
+}
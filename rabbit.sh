@@ -12,19 +12,45 @@ start_or_run () {
     fi
 }
 
+start_or_run_tls () {
+    docker inspect peril_rabbitmq_tls > /dev/null 2>&1
+
+    if [ $? -eq 0 ]; then
+        echo "Starting Peril RabbitMQ TLS container..."
+        docker start peril_rabbitmq_tls
+    else
+        if [ ! -f certs/ca.pem ]; then
+            echo "No certificates found, run ./certs.sh first"
+            exit 1
+        fi
+        echo "Peril RabbitMQ TLS container not found, creating a new one..."
+        docker run -d --name peril_rabbitmq_tls -p 5671:5671 -p 15672:15672 \
+            -v "$PWD/certs:/etc/rabbitmq/certs:ro" \
+            -v "$PWD/rabbitmq/rabbitmq.conf:/etc/rabbitmq/conf.d/20-peril-tls.conf:ro" \
+            -v "$PWD/rabbitmq/enabled_plugins:/etc/rabbitmq/enabled_plugins:ro" \
+            rabbitmq:3.13-management
+        echo "Once it is up, create the user named in the client certificate, e.g.:"
+        echo "  docker exec peril_rabbitmq_tls rabbitmqctl add_user peril \$(openssl rand -hex 16)"
+        echo "  docker exec peril_rabbitmq_tls rabbitmqctl set_permissions peril '.*' '.*' '.*'"
+    fi
+}
+
 case "$1" in
     start)
         start_or_run
         ;;
+    start-tls)
+        start_or_run_tls
+        ;;
     stop)
         echo "Stopping Peril RabbitMQ container..."
-        docker stop peril_rabbitmq
+        docker stop peril_rabbitmq peril_rabbitmq_tls 2>/dev/null
         ;;
     logs)
         echo "Fetching logs for Peril RabbitMQ container..."
         docker logs -f peril_rabbitmq
         ;;
     *)
-        echo "Usage: $0 {start|stop|logs}"
+        echo "Usage: $0 {start|start-tls|stop|logs}"
         exit 1
 esac